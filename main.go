@@ -1,47 +1,185 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	// Avoid conflicts with net/mail
 	"github.com/naive9527/mitmsmtpd/smtpd" // It is actually a modified version of https://github.com/mhale/smtpd.
 	"github.com/naive9527/mitmsmtpd/utils"
 )
 
-func ListenAndServeTLSAuth(addr string, certFile string, keyFile string, handler smtpd.Handler, appname string, hostname string, authHandler smtpd.AuthHandler, authMechs map[string]bool) error {
-	srv := &smtpd.Server{Addr: addr, Handler: handler, Appname: appname, Hostname: hostname, AuthHandler: authHandler, AuthRequired: true,
-		AuthMechs: authMechs}
-	err := srv.ConfigureTLS(certFile, keyFile)
-	if err != nil {
+func main() {
+	configPath := flag.String("config", "config.yaml", "Path to the configuration file")
+	watch := flag.Duration("watch", 0, "Reload the configuration when the file changes, checking at this interval (0 = only on SIGHUP)")
+	flag.Parse()
+
+	if err := run(*configPath, *watch); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// run starts the gateway and serves until SIGINT or SIGTERM, or until a listener fails. Everything that keeps
+// the gateway from starting, e.g. an invalid configuration or an address in use, is returned before any
+// connection is accepted.
+func run(configPath string, watch time.Duration) error {
+	// Registered first: the default action of SIGHUP would kill a gateway still starting up. A SIGHUP received
+	// meanwhile is handled once the gateway serves.
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	defer signal.Stop(hups)
+
+	if err := utils.InitConfig(configPath); err != nil {
+		return err
+	}
+	cfg := utils.Cfg()
+
+	if _, err := utils.Xlog(cfg.Logging.Path, cfg.Logging.Filename); err != nil {
+		return err
+	}
+	smtpd.Debug = cfg.SmptdServer.Debug
+
+	// Listen on every address first, so that an unusable one is reported before anything is served.
+	servers := make([]*smtpd.Server, len(cfg.Listeners))
+	listeners := make([]net.Listener, len(cfg.Listeners))
+	for i, l := range cfg.Listeners {
+		servers[i] = cfg.NewServer(l)
+		ln, err := servers[i].Listen()
+		if err != nil {
+			return fmt.Errorf("listener %s: %w", l.Name, err)
+		}
+		listeners[i] = ln
+	}
+	var adminLn net.Listener
+	if cfg.Admin.Address != "" {
+		var err error
+		if adminLn, err = net.Listen("tcp", cfg.Admin.Address); err != nil {
+			return fmt.Errorf("admin interface: %w", err)
+		}
+	}
+
+	if cfg.Queue.Enabled {
+		q := cfg.Queue
+		var report utils.ReportFunc
+		if q.DSN {
+			report = utils.SendDSN
+		}
+		var err error
+		utils.QueueIns, err = utils.NewMailQueue(q.Path, q.KeyFile, q.Workers, q.ScanInterval, q.InitialBackoff, q.MaxBackoff, q.MaxAge, q.DelayWarning, utils.DeliverQueuedMail, report)
+		if err != nil {
+			return err
+		}
+		utils.QueueIns.Start()
+	}
+
+	if cfg.SmtpProbe.Enable {
+		utils.UpstreamHealthIns = utils.NewUpstreamHealth()
+		utils.UpstreamHealthIns.Start()
+	}
+	if p := cfg.UpstreamPool; p.Enabled {
+		utils.UpstreamPoolIns = utils.NewUpstreamPool(p.MaxIdle, p.MaxActive, p.MaxMessages, p.IdleTimeout, p.HealthCheck)
+		utils.UpstreamPoolIns.StartJanitor(10 * time.Second)
+	}
+
+	utils.MailInfoCacheIns.StartJanitor(time.Minute)
+	utils.BanListIns.StartJanitor(time.Minute)
+	if adminLn != nil {
+		go func() {
+			if err := utils.ServeAdmin(adminLn); err != nil {
+				slog.Error(fmt.Sprintf("admin interface stopped: %s", err.Error()))
+			}
+		}()
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go reloadOnSignal(configPath, hups)
+	if watch > 0 {
+		go utils.WatchConfig(configPath, watch)
+	}
+
+	// All listeners share the queue and the credential cache; the process ends when one of them fails.
+	timeout := time.Duration(cfg.SmptdServer.ShutdownTimeout) * time.Second
+	errs := make(chan error, len(servers))
+	for i, srv := range servers {
+		l := cfg.Listeners[i]
+		slog.Info(fmt.Sprintf("Starting SMTP listener %s on %s", l.Name, listeners[i].Addr()), "TLS", l.TLS, "AuthRequired", srv.AuthRequired)
+		go func() {
+			errs <- fmt.Errorf("listener %s: %w", l.Name, srv.Serve(listeners[i]))
+		}()
+	}
+	select {
+	case err := <-errs:
+		shutdown(servers, timeout)
 		return err
+	case sig := <-sigs:
+		slog.Info(fmt.Sprintf("Received %s, shutting down within %s", sig, timeout))
+		go func() {
+			sig := <-sigs
+			slog.Warn(fmt.Sprintf("Received %s again, exiting without waiting", sig))
+			utils.MailInfoCacheIns.Close()
+			os.Exit(1)
+		}()
+		shutdown(servers, timeout)
+		return nil
 	}
-	return srv.ListenAndServe()
 }
 
-func main() {
-	utils.Xlog(utils.CFG.Logging.Path, utils.CFG.Logging.Filename)
-	var err error
-
-	smtpd.Debug = utils.CFG.SmptdServer.Debug
-	server := utils.CFG.SmptdServer.Address
-	certFile := utils.CFG.SmtpdTLS.Cert
-	keyFile := utils.CFG.SmtpdTLS.Key
-	appName := utils.CFG.SmptdServer.Appname
-	hostname := utils.CFG.SmptdServer.Hostname
-
-	slog.Info(fmt.Sprintf("Starting SMTP server on server %s", server))
-	if utils.CFG.SmtpdAuth.Required && utils.CFG.SmtpdTLS.TLSEnabled {
-		err = ListenAndServeTLSAuth(server, certFile, keyFile, utils.MailHandler, appName, hostname, utils.AuthHandler, utils.CFG.SmtpdAuth.Mechanisms)
-	} else if !utils.CFG.SmtpdAuth.Required && utils.CFG.SmtpdTLS.TLSEnabled {
-		err = smtpd.ListenAndServeTLS(server, certFile, keyFile, utils.MailHandler, appName, hostname)
-	} else if !utils.CFG.SmtpdAuth.Required && !utils.CFG.SmtpdTLS.TLSEnabled {
-		err = smtpd.ListenAndServe(server, utils.MailHandler, appName, hostname)
-	} else {
-		slog.Error("Invalid configuration")
-	}
-
-	if err != nil {
-		slog.Error(err.Error())
+// shutdown stops accepting connections and closes the idle sessions at once, lets the sessions relaying an email
+// and the queue deliveries in progress finish within timeout, and then wipes the cached credentials.
+func shutdown(servers []*smtpd.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn(fmt.Sprintf("listener %s: sessions still running after %s were cancelled", srv.Name, timeout))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if utils.QueueIns != nil {
+		stopped := make(chan struct{})
+		go func() {
+			utils.QueueIns.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			slog.Warn(fmt.Sprintf("Deliveries still running after %s were abandoned, they are retried on the next start", timeout))
+		}
+	}
+
+	if utils.UpstreamPoolIns != nil {
+		utils.UpstreamPoolIns.Close()
+	}
+	if utils.UpstreamHealthIns != nil {
+		utils.UpstreamHealthIns.Close()
+	}
+	utils.BanListIns.Close()
+	utils.MailInfoCacheIns.Close()
+	utils.LogAccessHits()
+	slog.Info("Shutdown complete, cached credentials wiped")
+}
+
+// reloadOnSignal reloads the configuration file on every SIGHUP received on hups.
+func reloadOnSignal(path string, hups <-chan os.Signal) {
+	for range hups {
+		slog.Info("Received SIGHUP, reloading configuration")
+		utils.ReloadConfig(path)
 	}
 }
@@ -0,0 +1,254 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// SessionInfo describes the SMTP session a handler is called for.
+// Handlers must treat it as read-only.
+type SessionInfo struct {
+	ID         string                       // Unique session ID, for correlating log entries
+	Listener   string                       // Name of the server that accepted the session
+	RemoteAddr net.Addr                     // Client address, as supplied with a PROXY protocol header if any
+	ProxyAddr  net.Addr                     // Address of the load balancer that sent the PROXY protocol header, nil without one
+	RemoteIP   string                       // Client IP address, as overridden by XCLIENT ADDR if trusted
+	RemoteHost string                       // Client hostname according to reverse DNS lookup or XCLIENT NAME
+	HeloName   string                       // Hostname as supplied with HELO or EHLO
+	TLS        *tls.ConnectionState         // TLS version, cipher suite and client certificates, nil if TLS is not in use
+	Identity   *Identity                    // Who authenticated on the session, nil if not authenticated
+	XClient    XClientInfo                  // Information supplied with XCLIENT
+	MailParams map[string]string            // ESMTP parameters of the current MAIL command, keys in upper case
+	RcptParams map[string]map[string]string // ESMTP parameters of the accepted RCPT commands by recipient address, keys in upper case
+}
+
+// XClientInfo holds the information supplied by a trusted proxy with XCLIENT.
+type XClientInfo struct {
+	Raw  string // Arguments of the last XCLIENT command
+	Addr string // Client address supplied with XCLIENT ADDR
+	Name string // Client hostname supplied with XCLIENT NAME
+}
+
+// SessionHandler is the context-aware counterpart of Handler/MsgIDHandler.
+// HandleMail is called upon successful receipt of an email and returns an optional message ID.
+// The context is cancelled when the client disconnects or the server is closed.
+// Return a *Reply to choose the response, other errors result in a "451 4.3.5" response.
+//
+// A SessionHandler may additionally implement SessionStreamHandler, SessionConnectHandler, SessionMailFromHandler, SessionRcptHandler,
+// SessionAuthHandler and SessionLogoutHandler. The legacy function types implement these interfaces as adapters.
+type SessionHandler interface {
+	HandleMail(ctx context.Context, info *SessionInfo, from string, to []string, data []byte) (string, error)
+}
+
+// SessionStreamHandler is implemented by a SessionHandler that reads the message instead of receiving it as a
+// byte slice, and is then called in place of HandleMail. data holds the message with the Received header and can be
+// read several times, e.g. with io.NewSectionReader(data, 0, data.Size()). Large messages are read from a temporary
+// file (see Server.SpoolThreshold), so they are never held in memory as a whole. data must not be used after
+// HandleMailStream returns. The return values are handled as for HandleMail.
+type SessionStreamHandler interface {
+	HandleMailStream(ctx context.Context, info *SessionInfo, from string, to []string, data *io.SectionReader) (string, error)
+}
+
+// SessionConnectHandler is called when a client connects, before the greeting is sent and after the PROXY protocol
+// header, if any, so info.RemoteIP is the address of the client. It runs before the TLS handshake of a TLS listener
+// and the reverse DNS lookup, so info.TLS and info.RemoteHost are not set yet. Return nil to accept the connection.
+// A *Reply (or an error formatted as an SMTP reply, e.g. "554 5.7.1 Access denied") is sent instead of the greeting
+// and the connection is closed, any other error results in a "421 4.3.0" response. On a TLS listener the
+// connection is closed without a reply.
+type SessionConnectHandler interface {
+	HandleConnect(ctx context.Context, info *SessionInfo) error
+}
+
+// SessionMailFromHandler is called on MAIL. Return nil to accept the sender.
+// Errors are handled as for HandlerMail.
+type SessionMailFromHandler interface {
+	HandleMailFrom(ctx context.Context, info *SessionInfo, from string) error
+}
+
+// SessionRcptHandler is called on RCPT. Return nil to accept the recipient.
+// A *Reply (or an error formatted as an SMTP reply, e.g. "550 5.7.1 Recipient address rejected") refuses this recipient only
+// and is sent to the client, any other error results in a "451 4.3.0" response.
+type SessionRcptHandler interface {
+	HandleRcpt(ctx context.Context, info *SessionInfo, from string, to string) error
+}
+
+// SessionAuthHandler is called when a login attempt is performed. Returns true if credentials are correct.
+type SessionAuthHandler interface {
+	HandleAuth(ctx context.Context, info *SessionInfo, mechanism string, username []byte, password []byte, shared []byte) (bool, error)
+}
+
+// SessionLogoutHandler is called when an authenticated session ends, for any reason.
+type SessionLogoutHandler interface {
+	HandleLogout(ctx context.Context, info *SessionInfo)
+}
+
+// HandleMail adapts a Handler to the SessionHandler interface.
+func (f Handler) HandleMail(ctx context.Context, info *SessionInfo, from string, to []string, data []byte) (string, error) {
+	return "", f(info.RemoteAddr, from, to, data)
+}
+
+// HandleMail adapts a MsgIDHandler to the SessionHandler interface.
+func (f MsgIDHandler) HandleMail(ctx context.Context, info *SessionInfo, from string, to []string, data []byte) (string, error) {
+	return f(info.RemoteAddr, from, to, data)
+}
+
+// HandleMail adapts an IdentityMsgIDHandler to the SessionHandler interface.
+func (f IdentityMsgIDHandler) HandleMail(ctx context.Context, info *SessionInfo, from string, to []string, data []byte) (string, error) {
+	return f(info.RemoteAddr, info.Identity, from, to, data)
+}
+
+// HandleMailFrom adapts a HandlerMail to the SessionMailFromHandler interface.
+func (f HandlerMail) HandleMailFrom(ctx context.Context, info *SessionInfo, from string) error {
+	return f(info.RemoteAddr, from)
+}
+
+// HandleRcpt adapts a HandlerRcpt to the SessionRcptHandler interface.
+// A refused recipient results in a "550 5.1.0" response.
+func (f HandlerRcpt) HandleRcpt(ctx context.Context, info *SessionInfo, from string, to string) error {
+	if !f(info.RemoteAddr, from, to) {
+		return errors.New("550 5.1.0 Requested action not taken: mailbox unavailable")
+	}
+	return nil
+}
+
+// HandleAuth adapts an AuthHandler to the SessionAuthHandler interface.
+func (f AuthHandler) HandleAuth(ctx context.Context, info *SessionInfo, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
+	return f(info.RemoteAddr, mechanism, username, password, shared)
+}
+
+// HandleLogout adapts a LogoutHandler to the SessionLogoutHandler interface.
+func (f LogoutHandler) HandleLogout(ctx context.Context, info *SessionInfo) {
+	f(info.RemoteAddr, info.Identity)
+}
+
+// Determine the mail handler: SessionHandler takes precedence over the legacy function fields.
+func (srv *Server) mailHandler() SessionHandler {
+	switch {
+	case srv.SessionHandler != nil:
+		return srv.SessionHandler
+	case srv.Handler != nil:
+		return srv.Handler
+	case srv.MsgIDHandler != nil:
+		return srv.MsgIDHandler
+	case srv.IdentityMsgIDHandler != nil:
+		return srv.IdentityMsgIDHandler
+	}
+	return nil
+}
+
+func (srv *Server) streamHandler() SessionStreamHandler {
+	if h, ok := srv.SessionHandler.(SessionStreamHandler); ok {
+		return h
+	}
+	return nil
+}
+
+func (srv *Server) connectHandler() SessionConnectHandler {
+	if h, ok := srv.SessionHandler.(SessionConnectHandler); ok {
+		return h
+	}
+	return nil
+}
+
+func (srv *Server) mailFromHandler() SessionMailFromHandler {
+	if h, ok := srv.SessionHandler.(SessionMailFromHandler); ok {
+		return h
+	}
+	if srv.HandlerMail != nil {
+		return srv.HandlerMail
+	}
+	return nil
+}
+
+func (srv *Server) rcptHandler() SessionRcptHandler {
+	if h, ok := srv.SessionHandler.(SessionRcptHandler); ok {
+		return h
+	}
+	if srv.HandlerRcpt != nil {
+		return srv.HandlerRcpt
+	}
+	return nil
+}
+
+// Authentication is enabled if either the SessionHandler or the AuthHandler can check credentials.
+func (srv *Server) authHandler() SessionAuthHandler {
+	if h, ok := srv.SessionHandler.(SessionAuthHandler); ok {
+		return h
+	}
+	if srv.AuthHandler != nil {
+		return srv.AuthHandler
+	}
+	return nil
+}
+
+func (srv *Server) logoutHandler() SessionLogoutHandler {
+	if h, ok := srv.SessionHandler.(SessionLogoutHandler); ok {
+		return h
+	}
+	if srv.LogoutHandler != nil {
+		return srv.LogoutHandler
+	}
+	return nil
+}
+
+// Base context of all sessions, cancelled when the server is closed.
+func (srv *Server) baseContext() context.Context {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.ctx == nil {
+		srv.ctx, srv.cancelCtx = context.WithCancel(context.Background())
+	}
+	return srv.ctx
+}
+
+func (srv *Server) cancelBaseContext() {
+	srv.baseContext()
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.cancelCtx()
+}
+
+// Snapshot the session state for a handler call.
+func (s *session) info() *SessionInfo {
+	info := &SessionInfo{
+		ID:         s.id,
+		Listener:   s.srv.Name,
+		RemoteAddr: s.remoteAddr,
+		ProxyAddr:  s.proxyAddr,
+		RemoteIP:   s.remoteIP,
+		RemoteHost: s.remoteHost,
+		HeloName:   s.remoteName,
+		Identity:   s.identity,
+		XClient:    XClientInfo{Raw: s.xClient, Addr: s.xClientADDR, Name: s.xClientNAME},
+		MailParams: s.mailParams,
+		RcptParams: s.rcptParams,
+	}
+	if tlsConn, ok := s.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		info.TLS = &state
+	}
+	return info
+}
+
+// Cancel ctx if the client goes away while a handler is running.
+// The returned function stops watching and must be called before reading from the client again.
+func (s *session) watchDisconnect(cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := s.br.Peek(1); err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				cancel()
+			}
+		}
+	}()
+	return func() {
+		s.conn.SetReadDeadline(time.Now())
+		<-done
+		s.conn.SetReadDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,357 @@
+package smtpd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockSessionHandler struct {
+	infos []*SessionInfo
+	rcpts []string
+	to    [][]string
+	mail  func(ctx context.Context) (string, error)
+}
+
+func (m *mockSessionHandler) HandleMail(ctx context.Context, info *SessionInfo, from string, to []string, data []byte) (string, error) {
+	m.infos = append(m.infos, info)
+	m.to = append(m.to, to)
+	if m.mail != nil {
+		return m.mail(ctx)
+	}
+	return "", nil
+}
+
+func (m *mockSessionHandler) HandleMailFrom(ctx context.Context, info *SessionInfo, from string) error {
+	if from == "spoofed@example.com" {
+		return errors.New("553 5.7.1 Sender address not allowed")
+	}
+	return nil
+}
+
+func (m *mockSessionHandler) HandleRcpt(ctx context.Context, info *SessionInfo, from string, to string) error {
+	m.rcpts = append(m.rcpts, to)
+	switch to {
+	case "refused@example.com":
+		return errors.New("550 5.7.1 Recipient address not allowed")
+	case "broken@example.com":
+		return errors.New("lookup failed")
+	}
+	return nil
+}
+
+func (m *mockSessionHandler) HandleAuth(ctx context.Context, info *SessionInfo, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
+	switch string(username) {
+	case "unavailable":
+		return false, errors.New("verification server unreachable")
+	case "rejected":
+		return false, NewReply(535, "5.7.8", "Authentication credentials invalid")
+	}
+	return string(username) == "valid", nil
+}
+
+func TestSessionHandlerInfo(t *testing.T) {
+	m := &mockSessionHandler{}
+	server := &Server{
+		TLSConfig:      &tls.Config{Certificates: []tls.Certificate{cert}},
+		SessionHandler: m,
+	}
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	cmdCode(t, conn, "STARTTLS", "220")
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("Failed to perform TLS handshake: %v", err)
+	}
+
+	cmdCode(t, tlsConn, "EHLO client.example.com", "250")
+	cmdCode(t, tlsConn, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00valid\x00password")), "235")
+	cmdCode(t, tlsConn, "MAIL FROM:<sender@example.com> SIZE=100", "250")
+	cmdCode(t, tlsConn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, tlsConn, "RCPT TO:<refused@example.com>", "550")
+	cmdCode(t, tlsConn, "DATA", "354")
+	cmdCode(t, tlsConn, "Test message.\r\n.", "250")
+	cmdCode(t, tlsConn, "QUIT", "221")
+	tlsConn.Close()
+
+	if len(m.rcpts) != 2 {
+		t.Errorf("HandleRcpt called %d times, want 2 calls", len(m.rcpts))
+	}
+	if len(m.infos) != 1 {
+		t.Fatalf("HandleMail called %d times, want one call", len(m.infos))
+	}
+	info := m.infos[0]
+	if info.ID == "" {
+		t.Errorf("SessionInfo.ID is empty")
+	}
+	if info.HeloName != "client.example.com" {
+		t.Errorf("SessionInfo.HeloName is %q, want %q", info.HeloName, "client.example.com")
+	}
+	if info.TLS == nil || info.TLS.Version == 0 {
+		t.Errorf("SessionInfo.TLS is %v, want the connection state", info.TLS)
+	}
+	if info.Identity == nil || info.Identity.Username != "valid" || info.Identity.Mechanism != "PLAIN" {
+		t.Errorf("SessionInfo.Identity is %+v, want valid/PLAIN", info.Identity)
+	}
+	if info.MailParams["SIZE"] != "100" {
+		t.Errorf("SessionInfo.MailParams is %v, want SIZE=100", info.MailParams)
+	}
+}
+
+func TestSessionHandlerEnvelopeVerdicts(t *testing.T) {
+	m := &mockSessionHandler{}
+	conn := newConn(t, &Server{SessionHandler: m})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	cmdCode(t, conn, "MAIL FROM:<spoofed@example.com>", "553")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "503")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<refused@example.com>", "550")
+	cmdCode(t, conn, "RCPT TO:<broken@example.com>", "451")
+	cmdCode(t, conn, "RCPT TO:<other@example.com>", "250")
+	cmdCode(t, conn, "DATA", "354")
+	cmdCode(t, conn, "Test message.\r\n.", "250")
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+
+	if len(m.to) != 1 {
+		t.Fatalf("HandleMail called %d times, want one call", len(m.to))
+	}
+	if fmt.Sprint(m.to[0]) != "[recipient@example.com other@example.com]" {
+		t.Errorf("HandleMail got recipients %v, want only the accepted ones", m.to[0])
+	}
+}
+
+func TestSessionHandlerDSNParams(t *testing.T) {
+	m := &mockSessionHandler{}
+	conn := newConn(t, &Server{SessionHandler: m})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> RET=hdrs ENVID=QQ314159+2B1", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com> NOTIFY=success,failure ORCPT=rfc822;recipient+2Balias@example.com", "250")
+	cmdCode(t, conn, "RCPT TO:<refused@example.com> NOTIFY=NEVER", "550")
+	cmdCode(t, conn, "RCPT TO:<other@example.com>", "250")
+	cmdCode(t, conn, "DATA", "354")
+	cmdCode(t, conn, "Test message.\r\n.", "250")
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+
+	if len(m.infos) != 1 {
+		t.Fatalf("HandleMail called %d times, want one call", len(m.infos))
+	}
+	info := m.infos[0]
+	if info.MailParams["RET"] != "HDRS" || info.MailParams["ENVID"] != "QQ314159+2B1" {
+		t.Errorf("SessionInfo.MailParams is %v, want RET=HDRS ENVID=QQ314159+2B1", info.MailParams)
+	}
+	want := map[string]map[string]string{
+		"recipient@example.com": {"NOTIFY": "SUCCESS,FAILURE", "ORCPT": "rfc822;recipient+2Balias@example.com"},
+	}
+	if fmt.Sprint(info.RcptParams) != fmt.Sprint(want) {
+		t.Errorf("SessionInfo.RcptParams is %v, want %v", info.RcptParams, want)
+	}
+}
+
+type connectHandler struct {
+	mockSessionHandler
+	err   error
+	infos chan *SessionInfo // Receives the info of every connection, if not nil
+}
+
+func (h *connectHandler) HandleConnect(ctx context.Context, info *SessionInfo) error {
+	if h.infos != nil {
+		h.infos <- info
+	}
+	return h.err
+}
+
+func TestSessionHandlerConnect(t *testing.T) {
+	tests := []struct {
+		err    error
+		banner string
+	}{
+		{nil, "220 "},
+		{NewReply(554, "5.7.1", "Access denied"), "554 5.7.1 Access denied"},
+		{errors.New("554 5.7.1 Client host rejected"), "554 5.7.1 Client host rejected"},
+		{errors.New("lookup failed"), "421 4.3.0 "},
+	}
+
+	for _, tt := range tests {
+		h := &connectHandler{err: tt.err}
+		clientConn, serverConn := net.Pipe()
+		session := (&Server{SessionHandler: h}).newSession(serverConn)
+		go session.serve()
+
+		reader := bufio.NewReader(clientConn)
+		banner, _ := reader.ReadString('\n')
+		if !strings.HasPrefix(banner, tt.banner) {
+			t.Errorf("Banner for handler error %v is %q, want %q", tt.err, banner, tt.banner)
+		}
+		if tt.err != nil {
+			if line, err := reader.ReadString('\n'); err != io.EOF {
+				t.Errorf("Refused connection got %q, %v, want it closed", line, err)
+			}
+		}
+		clientConn.Close()
+	}
+}
+
+func TestSessionHandlerConnectBeforeTLS(t *testing.T) {
+	h := &connectHandler{err: NewReply(554, "5.7.1", "Access denied"), infos: make(chan *SessionInfo, 1)}
+	srv := &Server{
+		SessionHandler: h,
+		TLSConfig:      &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSListener:    true,
+	}
+	conn, err := net.Dial("tcp", newProxyServer(t, srv))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// The client is refused before the handshake, without a reply it could not read anyway.
+	info := <-h.infos
+	if info.TLS != nil || info.RemoteHost != "" {
+		t.Errorf("SessionInfo is %+v, want it before the TLS handshake and the reverse DNS lookup", info)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Refused connection got %d bytes, %v, want it closed", n, err)
+	}
+}
+
+func TestSessionHandlerCancelledOnDisconnect(t *testing.T) {
+	cancelled := make(chan error, 1)
+	m := &mockSessionHandler{mail: func(ctx context.Context) (string, error) {
+		select {
+		case <-ctx.Done():
+			cancelled <- ctx.Err()
+		case <-time.After(2 * time.Second):
+			cancelled <- nil
+		}
+		return "", ctx.Err()
+	}}
+	conn := newConn(t, &Server{SessionHandler: m})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, conn, "DATA", "354")
+
+	// Send the message and go away without waiting for the reply.
+	fmt.Fprintf(conn, "Test message.\r\n.\r\n")
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("Handler context error is %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSessionHandlerCancelledOnClose(t *testing.T) {
+	srv := &Server{}
+	started := make(chan struct{})
+	srv.SessionHandler = &mockSessionHandler{mail: func(ctx context.Context) (string, error) {
+		close(started)
+		<-ctx.Done()
+		return "", fmt.Errorf("421 4.3.2 Service shutting down")
+	}}
+	conn := newConn(t, srv)
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, conn, "DATA", "354")
+
+	go func() {
+		<-started
+		srv.Close()
+	}()
+	cmdCode(t, conn, "Test message.\r\n.", "421")
+	conn.Close()
+}
+
+func TestLegacyHandlerAdapters(t *testing.T) {
+	var addr net.Addr
+	var legacy SessionHandler = MsgIDHandler(func(remoteAddr net.Addr, from string, to []string, data []byte) (string, error) {
+		addr = remoteAddr
+		return "ID", nil
+	})
+	info := &SessionInfo{RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25}}
+	id, err := legacy.HandleMail(context.Background(), info, "sender@example.com", []string{"recipient@example.com"}, nil)
+	if id != "ID" || err != nil || addr != info.RemoteAddr {
+		t.Errorf("MsgIDHandler adapter returned %q, %v with address %v", id, err, addr)
+	}
+
+	// SessionHandler takes precedence over the legacy handlers.
+	m := &mockSessionHandler{}
+	srv := &Server{SessionHandler: m, Handler: func(net.Addr, string, []string, []byte) error { return nil }, AuthHandler: authHandler}
+	if srv.mailHandler() != SessionHandler(m) || srv.authHandler() != SessionAuthHandler(m) {
+		t.Errorf("SessionHandler does not take precedence over the legacy handlers")
+	}
+
+	// Without any handler, authentication stays disabled.
+	if (&Server{}).authHandler() != nil {
+		t.Errorf("authHandler() is not nil without handlers")
+	}
+}
+
+type streamHandler struct {
+	mockSessionHandler
+	messages []string
+}
+
+func (h *streamHandler) HandleMailStream(ctx context.Context, info *SessionInfo, from string, to []string, data *io.SectionReader) (string, error) {
+	// Read the message twice, as a handler that validates it before relaying it does.
+	if _, err := io.Copy(io.Discard, data); err != nil {
+		return "", err
+	}
+	message, err := io.ReadAll(io.NewSectionReader(data, 0, data.Size()))
+	if err != nil {
+		return "", err
+	}
+	h.messages = append(h.messages, string(message))
+	return "STREAMED", nil
+}
+
+func TestSessionStreamHandler(t *testing.T) {
+	h := &streamHandler{}
+	dir := t.TempDir()
+	conn := newConn(t, &Server{SessionHandler: h, SpoolDir: dir, SpoolThreshold: 64})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+
+	body := strings.Repeat("Line of a message larger than the spool threshold.\r\n", 10)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, conn, "DATA", "354")
+	if resp := cmdCode(t, conn, body+"..Dot\r\n.", "250"); !strings.HasSuffix(resp, "queued as STREAMED") {
+		t.Errorf("DATA response is %q, want the ID returned by HandleMailStream", resp)
+	}
+
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	bdatCode(t, conn, body, false, "250")
+	bdatCode(t, conn, "Last chunk\r\n", true, "250")
+	cmdCode(t, conn, "QUIT", "221")
+
+	want := []string{body + ".Dot\r\n", body + "Last chunk\r\n"}
+	if len(h.messages) != len(want) {
+		t.Fatalf("HandleMailStream called %d times, want %d calls", len(h.messages), len(want))
+	}
+	for i, message := range h.messages {
+		if !strings.HasPrefix(message, "Received: ") || !strings.HasSuffix(message, "\r\n"+want[i]) {
+			t.Errorf("Message %d is %q, want the Received header followed by %q", i, message, want[i])
+		}
+	}
+	if len(h.mockSessionHandler.to) != 0 {
+		t.Errorf("HandleMail called %d times, want no call with a stream handler", len(h.mockSessionHandler.to))
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d spool files left in %s", len(entries), dir)
+	}
+}
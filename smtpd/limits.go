@@ -0,0 +1,149 @@
+package smtpd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limits protect the server, and the accounts it relays for, from clients that connect or send too much.
+// Zero values mean no limit.
+type Limits struct {
+	MaxConnections       int // Concurrent connections in total
+	MaxConnectionsPerIP  int // Concurrent connections per client IP address
+	MaxMessages          int // Messages per session, the client has to reconnect to send more
+	MaxRecipientsPerHour int // Recipients of delivered messages per authenticated user, over the last hour
+	MaxAuthFailures      int // Rejected AUTH credentials per session before it is closed; temporary failures do not count
+	MaxCommands          int // Commands per session before it is closed
+}
+
+// Admit a new connection against MaxConnections and, unless ip is empty, MaxConnectionsPerIP.
+// On success, the connection must be released with releaseConn.
+func (srv *Server) acquireConn(ip string) error {
+	srv.limitsMu.Lock()
+	defer srv.limitsMu.Unlock()
+	if srv.Limits.MaxConnections > 0 && srv.conns >= srv.Limits.MaxConnections {
+		return fmt.Errorf("421 4.7.0 %s Too many connections, try again later", srv.Hostname)
+	}
+	if err := srv.checkConnsPerIP(ip); err != nil {
+		return err
+	}
+	srv.conns++
+	srv.countConnPerIP(ip)
+	return nil
+}
+
+// Count a connection admitted without an address, i.e. from a load balancer, against MaxConnectionsPerIP of the
+// client ip of its PROXY header. On success, releaseConn(ip) releases both.
+func (srv *Server) acquireConnIP(ip string) error {
+	srv.limitsMu.Lock()
+	defer srv.limitsMu.Unlock()
+	if err := srv.checkConnsPerIP(ip); err != nil {
+		return err
+	}
+	srv.countConnPerIP(ip)
+	return nil
+}
+
+// Must be called with limitsMu held.
+func (srv *Server) checkConnsPerIP(ip string) error {
+	if ip != "" && srv.Limits.MaxConnectionsPerIP > 0 && srv.connsPerIP[ip] >= srv.Limits.MaxConnectionsPerIP {
+		return fmt.Errorf("421 4.7.0 %s Too many connections from %s, try again later", srv.Hostname, ip)
+	}
+	return nil
+}
+
+// Must be called with limitsMu held.
+func (srv *Server) countConnPerIP(ip string) {
+	if ip == "" {
+		return
+	}
+	if srv.connsPerIP == nil {
+		srv.connsPerIP = make(map[string]int)
+	}
+	srv.connsPerIP[ip]++
+}
+
+func (srv *Server) releaseConn(ip string) {
+	srv.limitsMu.Lock()
+	defer srv.limitsMu.Unlock()
+	srv.conns--
+	if ip == "" {
+		return
+	}
+	if srv.connsPerIP[ip]--; srv.connsPerIP[ip] <= 0 {
+		delete(srv.connsPerIP, ip)
+	}
+}
+
+// RecipientQuota holds the recipients of the messages delivered per authenticated user during the last hour,
+// which Limits.MaxRecipientsPerHour is checked against. Servers sharing a quota, e.g. the listeners of one
+// process, give every user MaxRecipientsPerHour in total rather than on each of them.
+type RecipientQuota struct {
+	mu  sync.Mutex
+	log map[string][]time.Time // Delivery time of every recent recipient by authenticated user
+}
+
+// NewRecipientQuota returns an empty quota to share between servers, see Server.RecipientQuota.
+func NewRecipientQuota() *RecipientQuota {
+	return &RecipientQuota{log: make(map[string][]time.Time)}
+}
+
+// Return the quota of the server: the shared one, or else its own.
+func (srv *Server) quota() *RecipientQuota {
+	if srv.RecipientQuota != nil {
+		return srv.RecipientQuota
+	}
+	srv.limitsMu.Lock()
+	defer srv.limitsMu.Unlock()
+	if srv.ownQuota == nil {
+		srv.ownQuota = NewRecipientQuota()
+	}
+	return srv.ownQuota
+}
+
+// Report whether the authenticated user may have n recipients in the current transaction, given the
+// recipients of the messages delivered for it during the last hour.
+func (srv *Server) recipientQuota(identity *Identity, n int) bool {
+	if srv.Limits.MaxRecipientsPerHour <= 0 || identity == nil {
+		return true
+	}
+	q := srv.quota()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.recent(identity.Username))+n <= srv.Limits.MaxRecipientsPerHour
+}
+
+// Count the recipients of a delivered message against the authenticated user's hourly quota.
+func (srv *Server) recordRecipients(identity *Identity, n int) {
+	if srv.Limits.MaxRecipientsPerHour <= 0 || identity == nil {
+		return
+	}
+	q := srv.quota()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	times := q.recent(identity.Username)
+	for i := 0; i < n; i++ {
+		times = append(times, now)
+	}
+	q.log[identity.Username] = times
+}
+
+// Drop the entries older than an hour from the user's recipient log and return the rest.
+// Must be called with mu held.
+func (q *RecipientQuota) recent(user string) []time.Time {
+	times := q.log[user]
+	cutoff := time.Now().Add(-time.Hour)
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	if i == len(times) {
+		delete(q.log, user)
+		return nil
+	}
+	times = times[i:]
+	q.log[user] = times
+	return times
+}
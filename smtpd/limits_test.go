@@ -0,0 +1,226 @@
+package smtpd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Connect through a PROXY protocol header, so that every connection can have its own client address.
+func dialAs(t *testing.T, addr, ip string) (net.Conn, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	fmt.Fprintf(conn, "PROXY TCP4 %s 192.0.2.10 56324 25\r\n", ip)
+	banner, _ := bufio.NewReader(conn).ReadString('\n')
+	return conn, banner
+}
+
+// Expect a 421 reply to cmd, and the connection to be closed afterwards.
+func cmdClosed(t *testing.T, conn net.Conn, cmd string) {
+	fmt.Fprintf(conn, "%s\r\n", cmd)
+	reader := bufio.NewReader(conn)
+	if resp, _ := reader.ReadString('\n'); !strings.HasPrefix(resp, "421 4.7.0 ") {
+		t.Errorf("Command %q response is %q, want 421 4.7.0", cmd, resp)
+	}
+	if line, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("Command %q got %q, %v after 421, want the connection closed", cmd, line, err)
+	}
+}
+
+func sendMessage(t *testing.T, conn net.Conn, rcpts ...string) {
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	for _, rcpt := range rcpts {
+		cmdCode(t, conn, "RCPT TO:<"+rcpt+">", "250")
+	}
+	cmdCode(t, conn, "DATA", "354")
+	cmdCode(t, conn, "Test message.\r\n.", "250")
+}
+
+func TestMaxConnections(t *testing.T) {
+	srv := &Server{ProxyProtocol: []string{"127.0.0.1"}, Limits: Limits{MaxConnections: 3, MaxConnectionsPerIP: 2}}
+	addr := newProxyServer(t, srv)
+
+	conn1, banner := dialAs(t, addr, "192.0.2.1")
+	defer conn1.Close()
+	if !strings.HasPrefix(banner, "220") {
+		t.Errorf("First connection banner is %q, want 220", banner)
+	}
+	conn2, banner := dialAs(t, addr, "192.0.2.1")
+	if !strings.HasPrefix(banner, "220") {
+		t.Errorf("Second connection banner is %q, want 220", banner)
+	}
+	conn3, banner := dialAs(t, addr, "192.0.2.1")
+	if !strings.HasPrefix(banner, "421 4.7.0") {
+		t.Errorf("Third connection from the same address got %q, want 421", banner)
+	}
+	conn3.Close()
+	conn4, banner := dialAs(t, addr, "192.0.2.2")
+	defer conn4.Close()
+	if !strings.HasPrefix(banner, "220") {
+		t.Errorf("Connection from another address got %q, want 220", banner)
+	}
+	conn5, banner := dialAs(t, addr, "192.0.2.3")
+	if !strings.HasPrefix(banner, "421 4.7.0") {
+		t.Errorf("Connection over the total limit got %q, want 421", banner)
+	}
+	conn5.Close()
+
+	// Closed connections no longer count.
+	cmdCode(t, conn2, "QUIT", "221")
+	conn2.Close()
+	for i := 0; ; i++ {
+		conn, banner := dialAs(t, addr, "192.0.2.1")
+		conn.Close()
+		if strings.HasPrefix(banner, "220") {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("Connection after a QUIT got %q, want 220", banner)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxConnectionsBeforeHandshake(t *testing.T) {
+	srv := &Server{
+		ProxyProtocol: []string{"127.0.0.1"},
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSListener:   true,
+		Limits:        Limits{MaxConnections: 1},
+	}
+	addr := newProxyServer(t, srv)
+
+	// A connection holds its slot as soon as it is accepted, before its PROXY header and TLS handshake.
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer idle.Close()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Over the limit, a TLS listener closes the connection without a handshake.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection over the limit got %d bytes, %v, want it closed", n, err)
+	}
+}
+
+func TestMaxMessages(t *testing.T) {
+	conn := newConn(t, &Server{Limits: Limits{MaxMessages: 2}})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	sendMessage(t, conn, "recipient@example.com")
+	sendMessage(t, conn, "recipient@example.com")
+	cmdClosed(t, conn, "MAIL FROM:<sender@example.com>")
+	conn.Close()
+}
+
+func TestMaxCommands(t *testing.T) {
+	conn := newConn(t, &Server{Limits: Limits{MaxCommands: 3}})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	cmdCode(t, conn, "NOOP", "250")
+	cmdCode(t, conn, "NOOP", "250")
+	cmdClosed(t, conn, "NOOP")
+	conn.Close()
+}
+
+func TestMaxAuthFailures(t *testing.T) {
+	srv := &Server{SessionHandler: &mockSessionHandler{}, AuthMechs: map[string]bool{"PLAIN": true}, Limits: Limits{MaxAuthFailures: 2}}
+	invalid := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00invalid\x00password"))
+	valid := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00valid\x00password"))
+
+	conn := newConn(t, srv)
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	cmdCode(t, conn, invalid, "535")
+	cmdClosed(t, conn, invalid)
+	conn.Close()
+
+	// The limit applies to failures only.
+	conn = newConn(t, srv)
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	cmdCode(t, conn, invalid, "535")
+	cmdCode(t, conn, valid, "235")
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+
+	// Temporary failures and malformed input do not count, a 535 reply of the handler does.
+	conn = newConn(t, srv)
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	cmdCode(t, conn, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00unavailable\x00password")), "454")
+	cmdCode(t, conn, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00unavailable\x00password")), "454")
+	cmdCode(t, conn, "AUTH PLAIN !", "501")
+	cmdCode(t, conn, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00rejected\x00password")), "535")
+	cmdClosed(t, conn, invalid)
+	conn.Close()
+}
+
+func TestMaxRecipientsPerHour(t *testing.T) {
+	srv := &Server{SessionHandler: &mockSessionHandler{}, AuthMechs: map[string]bool{"PLAIN": true}, Limits: Limits{MaxRecipientsPerHour: 3}}
+	login := func() net.Conn {
+		conn := newConn(t, srv)
+		cmdCode(t, conn, "EHLO host.example.com", "250")
+		cmdCode(t, conn, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00valid\x00password")), "235")
+		return conn
+	}
+
+	conn := login()
+	sendMessage(t, conn, "one@example.com", "two@example.com")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<three@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<four@example.com>", "452")
+	cmdCode(t, conn, "DATA", "354")
+	cmdCode(t, conn, "Test message.\r\n.", "250")
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+
+	// The quota is per user, not per session.
+	conn = login()
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<five@example.com>", "452")
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+
+	// Recipients older than an hour no longer count.
+	q := srv.quota()
+	q.mu.Lock()
+	for i := range q.log["valid"] {
+		q.log["valid"][i] = q.log["valid"][i].Add(-time.Hour)
+	}
+	q.mu.Unlock()
+	conn = login()
+	sendMessage(t, conn, "five@example.com")
+	conn.Close()
+}
+
+func TestSharedRecipientQuota(t *testing.T) {
+	quota := NewRecipientQuota()
+	login := func(srv *Server) net.Conn {
+		conn := newConn(t, srv)
+		cmdCode(t, conn, "EHLO host.example.com", "250")
+		cmdCode(t, conn, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00valid\x00password")), "235")
+		return conn
+	}
+	newServer := func() *Server {
+		return &Server{SessionHandler: &mockSessionHandler{}, AuthMechs: map[string]bool{"PLAIN": true}, Limits: Limits{MaxRecipientsPerHour: 2}, RecipientQuota: quota}
+	}
+
+	// The recipients sent through one listener count on the other.
+	conn := login(newServer())
+	sendMessage(t, conn, "one@example.com", "two@example.com")
+	conn.Close()
+	conn = login(newServer())
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<three@example.com>", "452")
+	conn.Close()
+}
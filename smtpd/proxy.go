@@ -0,0 +1,141 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Support for the PROXY protocol (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt),
+// so that the address of the client is known behind a load balancer.
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// trustsProxy reports whether ip is listed in ProxyProtocol, i.e. a load balancer that sends a PROXY header.
+func (srv *Server) trustsProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, entry := range srv.ProxyProtocol {
+		if prefix, err := netip.ParsePrefix(entry); err == nil && prefix.Contains(addr) {
+			return true
+		}
+		if trusted, err := netip.ParseAddr(entry); err == nil && trusted.Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header and returns the client address it carries.
+// It returns nil if the header has no client address: for LOCAL connections, e.g. health checks of the
+// load balancer, and for UNKNOWN or non-TCP protocols.
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		return readProxyV2(br)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readProxyV1(br)
+	}
+	return nil, errors.New("PROXY protocol header missing")
+}
+
+// readProxyV1 reads the human-readable header, e.g. "PROXY TCP4 192.0.2.1 192.0.2.10 56324 25\r\n".
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	// The header line is at most 107 bytes long, CRLF included.
+	var line []byte
+	for len(line) < 107 {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long or not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+	src, err1 := netip.ParseAddr(fields[2])
+	dst, err2 := netip.ParseAddr(fields[3])
+	srcPort, err3 := strconv.ParseUint(fields[4], 10, 16)
+	_, err4 := strconv.ParseUint(fields[5], 10, 16)
+	if err := errors.Join(err1, err2, err3, err4); err != nil || src.Is4() != (fields[1] == "TCP4") || dst.Is4() != src.Is4() {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(srcPort))), nil
+}
+
+// readProxyV2 reads the binary header: the signature, version and command, address family and protocol,
+// length of the addresses and TLVs, then the addresses and TLVs. TLVs are skipped.
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %#x", header[12]&0x0f)
+	}
+
+	var src netip.AddrPort
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("PROXY v2 header too short for IPv4 addresses")
+		}
+		src = netip.AddrPortFrom(netip.AddrFrom4([4]byte(payload[0:4])), binary.BigEndian.Uint16(payload[8:10]))
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("PROXY v2 header too short for IPv6 addresses")
+		}
+		src = netip.AddrPortFrom(netip.AddrFrom16([16]byte(payload[0:16])), binary.BigEndian.Uint16(payload[32:34]))
+	default: // UNSPEC, UDP and UNIX sockets
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(src), nil
+}
+
+// bufferedConn reads through the session reader, so that bytes it has already buffered after the PROXY
+// header, such as the start of a TLS handshake, are not lost.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
@@ -0,0 +1,201 @@
+package smtpd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start a server on a loopback TCP listener, so that the peer address can be trusted.
+func newProxyServer(t *testing.T, srv *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv.DisableReverseDNS = true
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close(); ln.Close() })
+	return ln.Addr().String()
+}
+
+// Build a PROXY v2 header with the given command, family and address block.
+func proxyV2(command, family byte, addrs []byte) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return string(append(header, addrs...))
+}
+
+func TestProxyProtocol(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 192, 0, 2, 10, 0xdc, 0x04, 0, 25}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	copy(v6[16:], net.ParseIP("2001:db8::10"))
+	binary.BigEndian.PutUint16(v6[32:], 56324)
+	binary.BigEndian.PutUint16(v6[34:], 25)
+	tlv := append(append([]byte{}, v4...), 0x04, 0x00, 0x01, 0x00) // PP2_TYPE_NOOP
+
+	tests := []struct {
+		header string
+		ip     string
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.10 56324 25\r\n", "192.0.2.1"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::10 56324 25\r\n", "2001:db8::1"},
+		{"PROXY UNKNOWN\r\n", "127.0.0.1"},
+		{proxyV2(0x1, 0x11, v4), "192.0.2.1"},
+		{proxyV2(0x1, 0x21, v6), "2001:db8::1"},
+		{proxyV2(0x1, 0x11, tlv), "192.0.2.1"},
+		{proxyV2(0x0, 0x00, nil), "127.0.0.1"},               // LOCAL
+		{proxyV2(0x1, 0x31, make([]byte, 216)), "127.0.0.1"}, // UNIX stream
+	}
+
+	for _, tt := range tests {
+		m := &mockSessionHandler{}
+		srv := &Server{ProxyProtocol: []string{"10.0.0.1", "127.0.0.0/8"}, SessionHandler: m}
+		addr := newProxyServer(t, srv)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		fmt.Fprint(conn, tt.header)
+		if banner, _ := bufio.NewReader(conn).ReadString('\n'); !strings.HasPrefix(banner, "220") {
+			t.Errorf("Banner after header %q is %q, want 220", tt.header, banner)
+			conn.Close()
+			continue
+		}
+		cmdCode(t, conn, "EHLO host.example.com", "250")
+		cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+		cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+		cmdCode(t, conn, "DATA", "354")
+		cmdCode(t, conn, "Test message.\r\n.", "250")
+		cmdCode(t, conn, "QUIT", "221")
+		conn.Close()
+
+		if len(m.infos) != 1 {
+			t.Fatalf("HandleMail called %d times after header %q, want one call", len(m.infos), tt.header)
+		}
+		info := m.infos[0]
+		if info.RemoteIP != tt.ip {
+			t.Errorf("RemoteIP after header %q is %q, want %q", tt.header, info.RemoteIP, tt.ip)
+		}
+		if host, _, _ := net.SplitHostPort(info.RemoteAddr.String()); host != tt.ip {
+			t.Errorf("RemoteAddr after header %q is %v, want %s", tt.header, info.RemoteAddr, tt.ip)
+		}
+		if (info.ProxyAddr != nil) != (tt.ip != "127.0.0.1") {
+			t.Errorf("ProxyAddr after header %q is %v", tt.header, info.ProxyAddr)
+		}
+	}
+}
+
+func TestProxyProtocolReceivedHeader(t *testing.T) {
+	data := make(chan []byte, 1)
+	srv := &Server{ProxyProtocol: []string{"127.0.0.1"}, Handler: func(_ net.Addr, _ string, _ []string, msg []byte) error {
+		data <- msg
+		return nil
+	}}
+	conn, err := net.Dial("tcp", newProxyServer(t, srv))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "PROXY TCP4 192.0.2.1 192.0.2.10 56324 25\r\n")
+	bufio.NewReader(conn).ReadString('\n')
+	cmdCode(t, conn, "HELO host.example.com", "250")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, conn, "DATA", "354")
+	cmdCode(t, conn, "Test message.\r\n.", "250")
+
+	if received := <-data; !strings.Contains(string(received), "[192.0.2.1]") {
+		t.Errorf("Received header does not name the proxied client: %q", received)
+	}
+}
+
+func TestProxyProtocolRefused(t *testing.T) {
+	tests := []struct {
+		header string
+	}{
+		{"EHLO host.example.com\r\n"}, // Header missing
+		{"PROXY TCP4 192.0.2.1 192.0.2.10 56324\r\n"},
+		{"PROXY TCP4 2001:db8::1 192.0.2.10 56324 25\r\n"},
+		{"PROXY TCP4 192.0.2.1 192.0.2.10 56324 70000\r\n"},
+		{"PROXY TCP4 192.0.2.1 192.0.2.10 56324 25\n"},
+		{"PROXY " + strings.Repeat("x", 120) + "\r\n"},
+		{proxyV2(0x1, 0x11, []byte{192, 0, 2, 1})},
+		{proxyV2(0x2, 0x11, nil)}, // Unknown command
+	}
+
+	for _, tt := range tests {
+		srv := &Server{ProxyProtocol: []string{"127.0.0.1"}, Timeout: time.Second}
+		conn, err := net.Dial("tcp", newProxyServer(t, srv))
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		fmt.Fprint(conn, tt.header)
+		if line, err := bufio.NewReader(conn).ReadString('\n'); err != io.EOF {
+			t.Errorf("Header %q got %q, %v, want the connection closed", tt.header, line, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	m := &mockSessionHandler{}
+	srv := &Server{ProxyProtocol: []string{"192.0.2.0/24"}, SessionHandler: m}
+	conn, err := net.Dial("tcp", newProxyServer(t, srv))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	bufio.NewReader(conn).ReadString('\n')
+
+	// A header from an untrusted peer is just an unknown command.
+	cmdCode(t, conn, "PROXY TCP4 192.0.2.1 192.0.2.10 56324 25", "500")
+	cmdCode(t, conn, "HELO host.example.com", "250")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, conn, "DATA", "354")
+	cmdCode(t, conn, "Test message.\r\n.", "250")
+	if len(m.infos) != 1 || m.infos[0].RemoteIP != "127.0.0.1" || m.infos[0].ProxyAddr != nil {
+		t.Errorf("Untrusted PROXY header changed the session: %+v", m.infos)
+	}
+}
+
+func TestProxyProtocolTLSListener(t *testing.T) {
+	m := &mockSessionHandler{}
+	srv := &Server{
+		ProxyProtocol:  []string{"127.0.0.1"},
+		TLSConfig:      &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSListener:    true,
+		SessionHandler: m,
+	}
+	conn, err := net.Dial("tcp", newProxyServer(t, srv))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// The TLS handshake follows the header immediately.
+	fmt.Fprint(conn, "PROXY TCP4 192.0.2.1 192.0.2.10 56324 465\r\n")
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("Failed to perform TLS handshake: %v", err)
+	}
+	bufio.NewReader(tlsConn).ReadString('\n')
+	cmdCode(t, tlsConn, "EHLO host.example.com", "250")
+	cmdCode(t, tlsConn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, tlsConn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, tlsConn, "DATA", "354")
+	cmdCode(t, tlsConn, "Test message.\r\n.", "250")
+
+	if len(m.infos) != 1 || m.infos[0].RemoteIP != "192.0.2.1" || m.infos[0].TLS == nil {
+		t.Errorf("SessionInfo is %+v, want the proxied client over TLS", m.infos)
+	}
+}
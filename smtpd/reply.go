@@ -0,0 +1,90 @@
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Reply is an SMTP reply. Handlers return a *Reply as error to choose the response sent to the client,
+// e.g. NewReply(550, "5.7.1", "Attachments are not allowed"). Replies with more than one line are
+// sent as a multi-line reply (RFC 5321 section 4.2.1).
+type Reply struct {
+	Code         int      // Reply code, 200-599
+	EnhancedCode string   // Enhanced status code (RFC 3463) such as "5.7.1", optional
+	Lines        []string // Text of the reply, one entry per line
+}
+
+// NewReply returns a reply with the given code, enhanced status code and text lines.
+func NewReply(code int, enhancedCode string, lines ...string) *Reply {
+	return &Reply{Code: code, EnhancedCode: enhancedCode, Lines: lines}
+}
+
+// Error returns the reply on a single line, for logging.
+func (r *Reply) Error() string {
+	return r.line(' ', strings.Join(r.Lines, " "))
+}
+
+// Temporary reports whether the reply is a transient (4xx) failure the client should retry.
+func (r *Reply) Temporary() bool {
+	return r.Code >= 400 && r.Code < 500
+}
+
+// Format the reply as sent on the wire, without the trailing CRLF.
+func (r *Reply) String() string {
+	if len(r.Lines) <= 1 {
+		return r.Error()
+	}
+	lines := make([]string, len(r.Lines))
+	for i, text := range r.Lines {
+		sep := byte('-')
+		if i == len(r.Lines)-1 {
+			sep = ' '
+		}
+		lines[i] = r.line(sep, text)
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+func (r *Reply) line(sep byte, text string) string {
+	if r.EnhancedCode != "" {
+		text = r.EnhancedCode + " " + text
+	}
+	return fmt.Sprintf("%d%c%s", r.Code, sep, strings.TrimRight(text, " "))
+}
+
+func (r *Reply) valid() bool {
+	if r.Code < 200 || r.Code > 599 {
+		return false
+	}
+	for _, text := range r.Lines {
+		if strings.ContainsAny(text, "\r\n") {
+			return false
+		}
+	}
+	return true
+}
+
+// Report whether a failed AUTH rejected the credentials: the handler refused them, or replied 535.
+// Temporary failures, e.g. an unreachable verification server, and malformed input do not count as failures.
+func rejectsCredentials(err error) bool {
+	if err == nil {
+		return true
+	}
+	text := err.Error()
+	return replyRE.MatchString(text) && strings.HasPrefix(text, "535")
+}
+
+// Send a handler error to the client. A *Reply is sent as is, as are errors whose text is formatted
+// as an SMTP reply (e.g. "550 5.7.1 Rejected"). Other errors are replaced by fallback.
+func (s *session) writeError(err error, fallback string) {
+	var reply *Reply
+	switch {
+	case errors.As(err, &reply) && reply.valid():
+		s.writef("%s", reply.String())
+	case replyRE.MatchString(err.Error()):
+		s.writef("%s", err.Error())
+	default:
+		s.writef("%s", fallback)
+	}
+}
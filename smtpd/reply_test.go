@@ -0,0 +1,77 @@
+package smtpd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"testing"
+)
+
+func TestReplyString(t *testing.T) {
+	tests := []struct {
+		reply *Reply
+		want  string
+	}{
+		{NewReply(550, "5.7.1", "Rejected"), "550 5.7.1 Rejected"},
+		{NewReply(451, "", "Try again later"), "451 Try again later"},
+		{NewReply(250, "2.0.0"), "250 2.0.0"},
+		{NewReply(554, "5.7.1", "Rejected by policy", "Contact postmaster"), "554-5.7.1 Rejected by policy\r\n554 5.7.1 Contact postmaster"},
+	}
+	for _, tt := range tests {
+		if got := tt.reply.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+
+	if got := NewReply(554, "5.7.1", "one", "two").Error(); got != "554 5.7.1 one two" {
+		t.Errorf("Error() = %q, want a single line", got)
+	}
+	if !NewReply(451, "4.4.1").Temporary() || NewReply(550, "5.7.1").Temporary() {
+		t.Errorf("Temporary() does not match the reply class")
+	}
+}
+
+func TestReplyFromHandler(t *testing.T) {
+	var reply error
+	m := &mockSessionHandler{mail: func(ctx context.Context) (string, error) { return "", reply }}
+	conn := newConn(t, &Server{SessionHandler: m})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+
+	send := func() (int, string, error) {
+		cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+		cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+		cmdCode(t, conn, "DATA", "354")
+		fmt.Fprintf(conn, "Test message.\r\n.\r\n")
+		return textproto.NewReader(bufio.NewReader(conn)).ReadResponse(0)
+	}
+
+	// A permanent failure with a multi-line reply
+	reply = NewReply(554, "5.7.1", "Rejected by policy", "Contact postmaster")
+	code, msg, _ := send()
+	if code != 554 || msg != "5.7.1 Rejected by policy\n5.7.1 Contact postmaster" {
+		t.Errorf("Multi-line reply is %d %q", code, msg)
+	}
+
+	// A wrapped reply
+	reply = fmt.Errorf("upstream: %w", NewReply(451, "4.4.1", "Upstream server unavailable"))
+	if code, msg, _ = send(); code != 451 || msg != "4.4.1 Upstream server unavailable" {
+		t.Errorf("Wrapped reply is %d %q", code, msg)
+	}
+
+	// An invalid reply falls back to the default
+	reply = NewReply(999, "", "Invalid")
+	if code, _, _ = send(); code != 451 {
+		t.Errorf("Invalid reply code is %d, want 451", code)
+	}
+
+	// Plain errors keep falling back to the default
+	reply = errors.New("local failure")
+	if code, _, _ = send(); code != 451 {
+		t.Errorf("Plain error reply code is %d, want 451", code)
+	}
+
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+}
@@ -5,29 +5,35 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 var (
 	// Debug `true` enables verbose logging.
 	Debug      = false
-	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:\s?<(.+)>`)
+	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:\s?<(.+?)>(\s(.*))?`)
 	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:\s?<(.*)>(\s(.*))?`) // Delivery Status Notifications are sent with "MAIL FROM:<>"
-	mailSizeRE = regexp.MustCompile(`[Ss][Ii][Zz][Ee]=(\d+)`)
+	replyRE    = regexp.MustCompile(`^([2-5][0-9]{2})[\s\-](.+)$`)
 )
 
 // Handler function called upon successful receipt of an email.
@@ -38,14 +44,37 @@ type Handler func(remoteAddr net.Addr, from string, to []string, data []byte) er
 // Results in a "250 2.0.0 Ok: queued as <message-id>" response.
 type MsgIDHandler func(remoteAddr net.Addr, from string, to []string, data []byte) (string, error)
 
+// IdentityMsgIDHandler function called upon successful receipt of an email, along with the identity
+// that authenticated on the session (nil if the session is not authenticated). Returns a message ID.
+// Results in a "250 2.0.0 Ok: queued as <message-id>" response.
+type IdentityMsgIDHandler func(remoteAddr net.Addr, identity *Identity, from string, to []string, data []byte) (string, error)
+
+// HandlerMail function called on MAIL. Return nil to accept the sender.
+// A *Reply (or an error formatted as an SMTP reply, e.g. "553 5.7.1 Sender address rejected") is sent to the client,
+// any other error results in a "451 4.3.0" response.
+type HandlerMail func(remoteAddr net.Addr, from string) error
+
 // HandlerRcpt function called on RCPT. Return accept status.
 type HandlerRcpt func(remoteAddr net.Addr, from string, to string) bool
 
 // AuthHandler function called when a login attempt is performed. Returns true if credentials are correct.
 type AuthHandler func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error)
 
+// LogoutHandler function called when an authenticated session ends, for any reason.
+type LogoutHandler func(remoteAddr net.Addr, identity *Identity)
+
+// Identity describes who authenticated on a session.
+// Handlers use Username to find the credentials of the session, never the MAIL FROM address.
+type Identity struct {
+	Username  string // Username as supplied with AUTH
+	Mechanism string // Authentication mechanism used: LOGIN, PLAIN or CRAM-MD5
+}
+
 var ErrServerClosed = errors.New("Server has been closed")
 
+// errShuttingDown interrupts a session waiting for the next command when the server shuts down.
+var errShuttingDown = errors.New("server is shutting down")
+
 // ListenAndServe listens on the TCP network address addr
 // and then calls Serve with handler to handle requests
 // on incoming connections.
@@ -85,31 +114,49 @@ type LogFunc func(remoteIP, verb, line string)
 
 // Server is an SMTP server.
 type Server struct {
-	Addr              string // TCP address to listen on, defaults to ":25" (all addresses, port 25) if empty
-	Appname           string
-	AuthHandler       AuthHandler
-	AuthMechs         map[string]bool // Override list of allowed authentication mechanisms. Currently supported: LOGIN, PLAIN, CRAM-MD5. Enabling LOGIN and PLAIN will reduce RFC 4954 compliance.
-	AuthRequired      bool            // Require authentication for every command except AUTH, EHLO, HELO, NOOP, RSET or QUIT as per RFC 4954. Ignored if AuthHandler is not configured.
-	DisableReverseDNS bool            // Disable reverse DNS lookups, enforces "unknown" hostname
-	Handler           Handler
-	HandlerRcpt       HandlerRcpt
-	Hostname          string
-	LogRead           LogFunc
-	LogWrite          LogFunc
-	MaxSize           int // Maximum message size allowed, in bytes
-	MaxRecipients     int // Maximum number of recipients, defaults to 100.
-	MsgIDHandler      MsgIDHandler
-	Timeout           time.Duration
-	TLSConfig         *tls.Config
-	TLSListener       bool // Listen for incoming TLS connections only (not recommended as it may reduce compatibility). Ignored if TLS is not configured.
-	TLSRequired       bool // Require TLS for every command except NOOP, EHLO, STARTTLS, or QUIT as per RFC 3207. Ignored if TLS is not configured.
-
-	inShutdown   int32 // server was closed or shutdown
-	openSessions int32 // count of open sessions
-	mu           sync.Mutex
-	shutdownChan chan struct{} // let the sessions know we are shutting down
+	Addr                 string // TCP address to listen on, defaults to ":25" (all addresses, port 25) if empty
+	Appname              string
+	AuthHandler          AuthHandler
+	AuthMechs            map[string]bool // Override list of allowed authentication mechanisms. Currently supported: LOGIN, PLAIN, CRAM-MD5. Enabling LOGIN and PLAIN will reduce RFC 4954 compliance.
+	AuthRequired         bool            // Require authentication for every command except AUTH, EHLO, HELO, NOOP, RSET or QUIT as per RFC 4954. Ignored if AuthHandler is not configured.
+	DisableReverseDNS    bool            // Disable reverse DNS lookups, enforces "unknown" hostname
+	Handler              Handler
+	HandlerMail          HandlerMail
+	HandlerRcpt          HandlerRcpt
+	Hostname             string
+	IdentityMsgIDHandler IdentityMsgIDHandler
+	Limits               Limits // Connection, session and rate limits
+	LogoutHandler        LogoutHandler
+	LogRead              LogFunc
+	LogWrite             LogFunc
+	MaxSize              int // Maximum message size allowed, in bytes
+	MaxRecipients        int // Maximum number of recipients, defaults to 100.
+	MsgIDHandler         MsgIDHandler
+	Name                 string          // Name of the listener, passed to session handlers when one process runs several servers
+	RecipientQuota       *RecipientQuota // Hourly recipient quota shared with other servers, see Limits.MaxRecipientsPerHour; the server has its own if nil
+	SessionHandler       SessionHandler  // Context-aware handler, takes precedence over Handler, MsgIDHandler, IdentityMsgIDHandler, HandlerMail, HandlerRcpt, AuthHandler and LogoutHandler
+	SpoolDir             string          // Directory of the temporary files holding large messages, defaults to os.TempDir()
+	SpoolThreshold       int             // Messages larger than this, in bytes, are received into a temporary file instead of memory, defaults to 1 MiB
+	Timeout              time.Duration
+	TLSConfig            *tls.Config
+	TLSListener          bool // Listen for incoming TLS connections only, i.e. implicit TLS (SMTPS, port 465 as per RFC 8314). Ignored if TLS is not configured.
+	TLSRequired          bool // Require TLS for every command except NOOP, EHLO, STARTTLS, or QUIT as per RFC 3207. Ignored if TLS is not configured.
+
+	inShutdown int32 // server was closed or shutdown, only set with mu held
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{} // listeners being served, closed on shutdown
+	sessions   map[*session]struct{}     // open sessions
+	sessionsWG sync.WaitGroup            // done when all sessions have ended
+	ctx        context.Context
+	cancelCtx  context.CancelFunc // cancels the context of all sessions
+
+	limitsMu   sync.Mutex
+	conns      int             // count of admitted connections
+	connsPerIP map[string]int  // admitted connections by client IP address
+	ownQuota   *RecipientQuota // hourly recipient quota, unless RecipientQuota is shared
 
 	XClientAllowed []string // List of XCLIENT allowed IP addresses
+	ProxyProtocol  []string // IP addresses or CIDR ranges of load balancers that send a PROXY protocol (v1 or v2) header ahead of every connection
 }
 
 // ConfigureTLS creates a TLS configuration from certificate and key files.
@@ -158,8 +205,19 @@ func (srv *Server) ConfigureTLSWithPassphrase(
 // calls Serve to handle requests on incoming connections.  If
 // srv.Addr is blank, ":25" is used.
 func (srv *Server) ListenAndServe() error {
-	if atomic.LoadInt32(&srv.inShutdown) != 0 {
-		return ErrServerClosed
+	ln, err := srv.Listen()
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+// Listen fills in the defaults of the server and listens on the TCP network address srv.Addr,
+// so that a process serving several addresses can report an unusable one before serving any.
+// The listener is then passed to Serve. If srv.Addr is blank, ":25" is used.
+func (srv *Server) Listen() (net.Listener, error) {
+	if srv.shuttingDown() {
+		return nil, ErrServerClosed
 	}
 
 	if srv.Addr == "" {
@@ -175,78 +233,125 @@ func (srv *Server) ListenAndServe() error {
 		srv.Timeout = 5 * time.Minute
 	}
 
-	var ln net.Listener
-	var err error
-
-	// If TLSListener is enabled, listen for TLS connections only.
-	if srv.TLSConfig != nil && srv.TLSListener {
-		ln, err = tls.Listen("tcp", srv.Addr, srv.TLSConfig)
-	} else {
-		ln, err = net.Listen("tcp", srv.Addr)
-	}
-	if err != nil {
-		return err
-	}
-	return srv.Serve(ln)
+	// If TLSListener is enabled, the sessions start TLS themselves, after a PROXY protocol header.
+	return net.Listen("tcp", srv.Addr)
 }
 
 // Serve creates a new SMTP session after a network connection is established.
+// It returns ErrServerClosed once Shutdown or Close has been called.
 func (srv *Server) Serve(ln net.Listener) error {
-	if atomic.LoadInt32(&srv.inShutdown) != 0 {
+	defer ln.Close()
+	if !srv.trackListener(ln, true) {
 		return ErrServerClosed
 	}
+	defer srv.trackListener(ln, false)
 
-	defer ln.Close()
 	for {
-
-		// if we are shutting down, don't accept new connections
-		select {
-		case <-srv.getShutdownChan():
-			return ErrServerClosed
-		default:
-		}
-
 		conn, err := ln.Accept()
 		if err != nil {
+			// Shutdown and Close close the listener to stop accepting connections at once.
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
 				continue
 			}
 			return err
 		}
 
-		session := srv.newSession(conn)
-		atomic.AddInt32(&srv.openSessions, 1)
-		go session.serve()
+		// The limits are checked before anything is read from the client, let alone a TLS handshake. Behind a load
+		// balancer, the per-IP limit applies to the client address of the PROXY header instead, see session.serve.
+		s := srv.newSession(conn)
+		limitIP := s.remoteIP
+		if srv.trustsProxy(s.remoteIP) {
+			limitIP = ""
+		}
+		if err := srv.acquireConn(limitIP); err != nil {
+			go s.refuseLimit(err)
+			continue
+		}
+		s.limited, s.limitIP = true, limitIP
+		go s.serve()
 	}
 }
 
 type session struct {
 	srv           *Server
+	id            string
+	ctx           context.Context
 	conn          net.Conn
+	idle          bool // Waiting for the next command, guarded by srv.mu
 	br            *bufio.Reader
 	bw            *bufio.Writer
-	remoteIP      string // Remote IP address
-	remoteHost    string // Remote hostname according to reverse DNS lookup
-	remoteName    string // Remote hostname as supplied with EHLO
-	xClient       string // Information string as supplied with XCLIENT
-	xClientADDR   string // Information string as supplied with XCLIENT ADDR
-	xClientNAME   string // Information string as supplied with XCLIENT NAME
-	xClientTrust  bool   // Trust XCLIENT from current IP address
+	remoteAddr    net.Addr // Client address, as supplied with a PROXY protocol header if any
+	proxyAddr     net.Addr // Address of the load balancer that sent the PROXY protocol header, if any
+	remoteIP      string   // Remote IP address
+	remoteHost    string   // Remote hostname according to reverse DNS lookup
+	remoteName    string   // Remote hostname as supplied with EHLO
+	xClient       string   // Information string as supplied with XCLIENT
+	xClientADDR   string   // Information string as supplied with XCLIENT ADDR
+	xClientNAME   string   // Information string as supplied with XCLIENT NAME
+	xClientTrust  bool     // Trust XCLIENT from current IP address
 	tls           bool
 	authenticated bool
+	identity      *Identity                    // Who authenticated on this session
+	mailParams    map[string]string            // ESMTP parameters of the current MAIL command
+	rcptParams    map[string]map[string]string // ESMTP parameters of the accepted RCPT commands, by recipient
+	messages      int                          // Messages delivered in this session
+	authFailures  int                          // Failed AUTH attempts in this session
+	commands      int                          // Commands received in this session
+	limited       bool                         // Counted against Limits.MaxConnections, see acquireConn
+	limitIP       string                       // Address counted against Limits.MaxConnectionsPerIP, empty if none
 }
 
 // Create new session from connection.
 func (srv *Server) newSession(conn net.Conn) (s *session) {
 	s = &session{
 		srv:  srv,
+		id:   newSessionID(),
 		conn: conn,
 		br:   bufio.NewReader(conn),
 		bw:   bufio.NewWriter(conn),
 	}
 
-	// Get remote end info for the Received header.
-	s.remoteIP, _, _ = net.SplitHostPort(s.conn.RemoteAddr().String())
+	s.remoteAddr = conn.RemoteAddr()
+	s.remoteIP, _, _ = net.SplitHostPort(s.remoteAddr.String())
+
+	// Set tls = true if TLS is already in use.
+	_, s.tls = s.conn.(*tls.Conn)
+	return
+}
+
+// Read the PROXY protocol header of a trusted load balancer, so that remoteIP is the address of the client.
+// Runs in the session goroutine, since it may block.
+func (s *session) readProxy() error {
+	if !s.srv.trustsProxy(s.remoteIP) {
+		return nil
+	}
+	if s.srv.Timeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
+	}
+	src, err := readProxyHeader(s.br)
+	if err != nil {
+		return fmt.Errorf("PROXY protocol header from %s: %w", s.remoteIP, err)
+	}
+	if src != nil {
+		s.proxyAddr, s.remoteAddr = s.remoteAddr, src
+		s.remoteIP, _, _ = net.SplitHostPort(src.String())
+	}
+	return nil
+}
+
+// Start TLS on a TLS listener and get the remote end info for the Received header. Only done once the client
+// has been accepted, so that refused clients cost neither a handshake nor a DNS lookup.
+func (s *session) start() {
+	if s.srv.TLSConfig != nil && s.srv.TLSListener && !s.tls {
+		s.conn = tls.Server(&bufferedConn{Conn: s.conn, br: s.br}, s.srv.TLSConfig)
+		s.br = bufio.NewReader(s.conn)
+		s.bw = bufio.NewWriter(s.conn)
+		s.tls = true
+	}
+
 	if !s.srv.DisableReverseDNS {
 		names, err := net.LookupAddr(s.remoteIP)
 		if err == nil && len(names) > 0 {
@@ -258,86 +363,173 @@ func (srv *Server) newSession(conn net.Conn) (s *session) {
 		s.remoteHost = "unknown"
 	}
 
-	// Set tls = true if TLS is already in use.
-	_, s.tls = s.conn.(*tls.Conn)
-
-	for _, checkIP := range srv.XClientAllowed {
+	for _, checkIP := range s.srv.XClientAllowed {
 		if s.remoteIP == checkIP {
 			s.xClientTrust = true
 		}
 	}
-	return
 }
 
-func (srv *Server) getShutdownChan() <-chan struct{} {
+// Refuse a connection over the limits right after Accept, see refuse. The client may have sent data already,
+// e.g. a PROXY header: closing the socket with unread data would reset the connection and the reply could be lost,
+// so the rest of the input is discarded until the client closes, for a second at most.
+func (s *session) refuseLimit(err error) {
+	defer s.conn.Close()
+	s.refuse(err, "")
+	if tcpConn, ok := s.conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+		tcpConn.SetReadDeadline(time.Now().Add(time.Second))
+		io.Copy(io.Discard, io.LimitReader(tcpConn, 4096))
+	}
+}
+
+// Refuse the client before the greeting with the reply for err, see writeError. On a TLS listener the client
+// expects a handshake first, the connection is closed without a reply.
+func (s *session) refuse(err error, fallback string) {
+	if s.srv.TLSConfig != nil && s.srv.TLSListener && !s.tls {
+		if Debug {
+			log.Println(s.remoteIP, "refused:", err)
+		}
+		return
+	}
+	s.writeError(err, fallback)
+}
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+// Register or unregister a listener. Listeners can not be registered once the server is shutting down.
+func (srv *Server) trackListener(ln net.Listener, add bool) bool {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
-	if srv.shutdownChan == nil {
-		srv.shutdownChan = make(chan struct{})
+	if !add {
+		delete(srv.listeners, ln)
+		return true
 	}
-
-	return srv.shutdownChan
+	if srv.shuttingDown() {
+		return false
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	srv.listeners[ln] = struct{}{}
+	return true
 }
 
-func (srv *Server) closeShutdownChan() {
+// Register or unregister a session. Sessions can not be registered once the server is shutting down,
+// so that sessionsWG is never incremented while Shutdown waits for it.
+func (srv *Server) trackSession(s *session, add bool) bool {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
-	if srv.shutdownChan == nil {
-		srv.shutdownChan = make(chan struct{})
+	if !add {
+		delete(srv.sessions, s)
+		srv.sessionsWG.Done()
+		return true
 	}
+	if srv.shuttingDown() {
+		return false
+	}
+	if srv.sessions == nil {
+		srv.sessions = make(map[*session]struct{})
+	}
+	srv.sessions[s] = struct{}{}
+	srv.sessionsWG.Add(1)
+	return true
+}
 
-	select {
-	case <-srv.shutdownChan:
-	default:
-		close(srv.shutdownChan)
+// Mark the server as shutting down, close its listeners and interrupt the sessions waiting for a command,
+// which then reply 421 and end. Must be called with mu held.
+func (srv *Server) beginShutdown() {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	for ln := range srv.listeners {
+		ln.Close()
+	}
+	for s := range srv.sessions {
+		if s.idle {
+			s.conn.SetReadDeadline(time.Now())
+		}
 	}
 }
 
-// Close - closes the connection without waiting
+// Close stops the server without waiting: the listeners are closed, sessions waiting for a command get a 421
+// reply and the context of the running handlers is cancelled.
 func (srv *Server) Close() error {
-	atomic.StoreInt32(&srv.inShutdown, 1)
-	srv.closeShutdownChan()
+	srv.mu.Lock()
+	srv.beginShutdown()
+	srv.mu.Unlock()
+	srv.cancelBaseContext()
 	return nil
 }
 
-// Shutdown - waits for current sessions to complete before closing
+// Shutdown stops the server gracefully. The listeners are closed at once and sessions waiting for a command
+// get a 421 reply and are closed, while sessions in the middle of a command, e.g. relaying an email after DATA,
+// finish it first. Shutdown returns when all sessions have ended, or when ctx is done: then the context of the
+// running handlers is cancelled as with Close and ctx.Err() is returned.
 func (srv *Server) Shutdown(ctx context.Context) error {
-	atomic.StoreInt32(&srv.inShutdown, 1)
-	srv.closeShutdownChan()
-
-	// wait for up to 30 seconds to allow the current sessions to
-	// end
-	timer := time.NewTimer(100 * time.Millisecond)
-	defer timer.Stop()
-
-	for i := 0; i < 300; i++ {
-
-		// wait for open sessions to close
-		if atomic.LoadInt32(&srv.openSessions) == 0 {
-			break
-		}
-
-		select {
-		case <-timer.C:
-			timer.Reset(100 * time.Millisecond)
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
+	srv.mu.Lock()
+	srv.beginShutdown()
+	srv.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.sessionsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		srv.Close()
+		return ctx.Err()
 	}
-
-	return nil
 }
 
 // Function called to handle connection requests.
 func (s *session) serve() {
-	defer atomic.AddInt32(&s.srv.openSessions, -1)
+	if s.limited {
+		defer func() { s.srv.releaseConn(s.limitIP) }()
+	}
+	if !s.srv.trackSession(s, true) {
+		s.conn.Close() // The server has shut down since the connection was accepted
+		return
+	}
+	defer s.srv.trackSession(s, false)
 	defer s.conn.Close()
+	defer func() { s.bw.Flush() }() // Send replies still buffered for pipelined commands, e.g. after QUIT
+
+	var cancel context.CancelFunc
+	s.ctx, cancel = context.WithCancel(s.srv.baseContext())
+	defer cancel()
+	defer s.logout()
 
 	var from string
 	var gotFrom bool
 	var to []string
-	var buffer bytes.Buffer
+	body := s.srv.newSpool() // Message data received with DATA, or the chunks received with BDAT so far
+	defer body.Reset()
+	var chunking bool // A BDAT transfer is in progress
+
+	if err := s.readProxy(); err != nil {
+		if Debug {
+			log.Println(s.remoteIP, err)
+		}
+		return
+	}
+	if s.limited && s.limitIP == "" && s.proxyAddr != nil {
+		if err := s.srv.acquireConnIP(s.remoteIP); err != nil {
+			s.refuse(err, "")
+			return
+		}
+		s.limitIP = s.remoteIP
+	}
+	if h := s.srv.connectHandler(); h != nil {
+		if err := h.HandleConnect(s.ctx, s.info()); err != nil {
+			s.refuse(err, fmt.Sprintf("421 4.3.0 %s Service not available, closing transmission channel", s.srv.Hostname))
+			return
+		}
+	}
+	s.start()
 
 	// Send banner.
 	s.writef("220 %s %s ESMTP Service ready", s.srv.Hostname, s.srv.Appname)
@@ -347,14 +539,22 @@ loop:
 		// Attempt to read a line from the socket.
 		// On timeout, send a timeout message and return from serve().
 		// On error, assume the client has gone away i.e. return from serve().
-		line, err := s.readLine()
+		line, err := s.readCommand()
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if err == errShuttingDown {
+				s.writef("421 4.3.2 %s %s ESMTP Service shutting down, closing transmission channel", s.srv.Hostname, s.srv.Appname)
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
 			}
 			break
 		}
 
+		s.commands++
+		if s.srv.Limits.MaxCommands > 0 && s.commands > s.srv.Limits.MaxCommands {
+			s.writef("421 4.7.0 %s Too many commands, closing transmission channel", s.srv.Hostname)
+			break
+		}
+
 		verb, args := s.parseLine(line)
 
 		switch verb {
@@ -366,63 +566,57 @@ loop:
 			from = ""
 			gotFrom = false
 			to = nil
-			buffer.Reset()
+			body.Reset()
+			chunking = false
 		case "EHLO":
 			s.remoteName = args
-			s.writef(s.makeEHLOResponse())
+			s.writef("%s", s.makeEHLOResponse())
 
 			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET.
 			from = ""
 			gotFrom = false
 			to = nil
-			buffer.Reset()
+			body.Reset()
+			chunking = false
 		case "MAIL":
 			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
 				break
 			}
-			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+			if s.srv.authHandler() != nil && s.srv.AuthRequired && !s.authenticated {
 				s.writef("530 5.7.0 Authentication required")
 				break
 			}
+			if s.srv.Limits.MaxMessages > 0 && s.messages >= s.srv.Limits.MaxMessages {
+				s.writef("421 4.7.0 %s Too many messages in this session, closing transmission channel", s.srv.Hostname)
+				break loop
+			}
 
 			match := mailFromRE.FindStringSubmatch(args)
 			if match == nil {
 				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid FROM parameter)")
 			} else {
-				// Validate the SIZE parameter if one was sent.
-				if len(match[2]) > 0 { // A parameter is present
-					sizeMatch := mailSizeRE.FindStringSubmatch(match[3])
-					if sizeMatch == nil {
-						s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
-					} else {
-						// Enforce the maximum message size if one is set.
-						size, err := strconv.Atoi(sizeMatch[1])
-						if err != nil { // Bad SIZE parameter
-							s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
-						} else if s.srv.MaxSize > 0 && size > s.srv.MaxSize { // SIZE above maximum size, if set
-							err = maxSizeExceeded(s.srv.MaxSize)
-							s.writef(err.Error())
-						} else { // SIZE ok
-							from = match[1]
-							gotFrom = true
-							s.writef("250 2.1.0 Ok")
-						}
-					}
-				} else { // No parameters after FROM
-					from = match[1]
-					gotFrom = true
-					s.writef("250 2.1.0 Ok")
+				// Validate the parameters (SIZE, BODY) if any were sent.
+				params := parseMailParams(match[3])
+				if err := s.checkMailParams(params); err != nil {
+					s.writef("%s", err.Error())
+				} else if err := checkAddress(match[1], params); err != nil {
+					s.writef("%s", err.Error())
+				} else {
+					s.mailParams = params
+					s.rcptParams = nil
+					from, gotFrom = s.acceptMailFrom(match[1])
 				}
 			}
 			to = nil
-			buffer.Reset()
+			body.Reset()
+			chunking = false
 		case "RCPT":
 			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
 				break
 			}
-			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+			if s.srv.authHandler() != nil && s.srv.AuthRequired && !s.authenticated {
 				s.writef("530 5.7.0 Authentication required")
 				break
 			}
@@ -441,17 +635,14 @@ loop:
 				}
 				if len(to) == s.srv.MaxRecipients {
 					s.writef("452 4.5.3 Too many recipients")
-				} else {
-					accept := true
-					if s.srv.HandlerRcpt != nil {
-						accept = s.srv.HandlerRcpt(s.conn.RemoteAddr(), from, match[1])
-					}
-					if accept {
-						to = append(to, match[1])
-						s.writef("250 2.1.5 Ok")
-					} else {
-						s.writef("550 5.1.0 Requested action not taken: mailbox unavailable")
-					}
+				} else if !s.srv.recipientQuota(s.identity, len(to)+1) {
+					s.writef("452 4.5.3 Too many recipients in the last hour, try again later")
+				} else if err := checkAddress(match[1], s.mailParams); err != nil {
+					s.writef("%s", err.Error())
+				} else if params, err := parseRcptParams(match[3]); err != nil {
+					s.writef("%s", err.Error())
+				} else if s.acceptRcpt(from, match[1], params) {
+					to = append(to, match[1])
 				}
 			}
 		case "DATA":
@@ -459,7 +650,7 @@ loop:
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
 				break
 			}
-			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+			if s.srv.authHandler() != nil && s.srv.AuthRequired && !s.authenticated {
 				s.writef("530 5.7.0 Authentication required")
 				break
 			}
@@ -467,6 +658,15 @@ loop:
 				s.writef("503 5.5.1 Bad sequence of commands (MAIL & RCPT required before DATA)")
 				break
 			}
+			// RFC 3030 does not allow mixing DATA and BDAT in a transaction, and BINARYMIME requires BDAT.
+			if chunking {
+				s.writef("503 5.5.1 Bad sequence of commands (BDAT in progress)")
+				break
+			}
+			if s.mailParams["BODY"] == "BINARYMIME" {
+				s.writef("503 5.5.1 Bad sequence of commands (BDAT required for BINARYMIME)")
+				break
+			}
 
 			s.writef("354 Start mail input; end with <CR><LF>.<CR><LF>")
 
@@ -474,8 +674,9 @@ loop:
 			// On timeout, send a timeout message and return from serve().
 			// On net.Error, assume the client has gone away i.e. return from serve().
 			// On other errors, allow the client to try again.
-			data, err := s.readData()
+			err := s.readData(body)
 			if err != nil {
+				body.Reset()
 				switch err.(type) {
 				case net.Error:
 					if err.(net.Error).Timeout() {
@@ -483,7 +684,7 @@ loop:
 					}
 					break loop
 				case maxSizeExceededError:
-					s.writef(err.Error())
+					s.writef("%s", err.Error())
 					continue
 				default:
 					s.writef("451 4.3.0 Requested action aborted: local error in processing")
@@ -491,50 +692,75 @@ loop:
 				}
 			}
 
-			// Create Received header & write message body into buffer.
-			buffer.Reset()
-			buffer.Write(s.makeHeaders(to))
-			buffer.Write(data)
+			delivered := s.deliver(from, to, body)
+			body.Reset()
+			if !delivered {
+				break
+			}
 
-			// Pass mail on to handler.
-			if s.srv.Handler != nil {
-				err := s.srv.Handler(s.conn.RemoteAddr(), from, to, buffer.Bytes())
-				if err != nil {
-					checkErrFormat := regexp.MustCompile(`^([2-5][0-9]{2})[\s\-](.+)$`)
-					if checkErrFormat.MatchString(err.Error()) {
-						s.writef(err.Error())
-					} else {
-						s.writef("451 4.3.5 Unable to process mail")
-					}
-					break
-				}
-				s.writef("250 2.0.0 Ok: queued")
-			} else if s.srv.MsgIDHandler != nil {
-				msgID, err := s.srv.MsgIDHandler(s.conn.RemoteAddr(), from, to, buffer.Bytes())
-				if err != nil {
-					checkErrFormat := regexp.MustCompile(`^([2-5][0-9]{2})[\s\-](.+)$`)
-					if checkErrFormat.MatchString(err.Error()) {
-						s.writef(err.Error())
-					} else {
-						s.writef("451 4.3.5 Unable to process mail")
-					}
-					break
+			// Reset for next mail.
+			from = ""
+			gotFrom = false
+			to = nil
+			chunking = false
+		case "BDAT":
+			size, last, ok := parseBDATArgs(args)
+			if !ok {
+				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid BDAT parameters)")
+				break
+			}
+
+			// The chunk follows the command in any case, so it is read (and discarded) even if the command is refused.
+			var refusal error
+			switch {
+			case s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls:
+				refusal = errors.New("530 5.7.0 Must issue a STARTTLS command first")
+			case s.srv.authHandler() != nil && s.srv.AuthRequired && !s.authenticated:
+				refusal = errors.New("530 5.7.0 Authentication required")
+			case !gotFrom || len(to) == 0:
+				refusal = errors.New("503 5.5.1 Bad sequence of commands (MAIL & RCPT required before BDAT)")
+			case s.srv.MaxSize > 0 && body.Len()+size > int64(s.srv.MaxSize):
+				refusal = maxSizeExceeded(s.srv.MaxSize)
+			}
+
+			err := s.readChunk(body, size, refusal != nil)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
 				}
+				break loop
+			}
 
-				if msgID != "" {
-					s.writef("250 2.0.0 Ok: queued as " + msgID)
-				} else {
-					s.writef("250 2.0.0 Ok: queued")
+			if refusal != nil {
+				s.writef("%s", refusal.Error())
+				if _, ok := refusal.(maxSizeExceededError); ok {
+					// The chunks received so far are useless now, the client has to start over with MAIL.
+					from = ""
+					gotFrom = false
+					to = nil
+					body.Reset()
+					chunking = false
 				}
-			} else {
-				s.writef("250 2.0.0 Ok: queued")
+				break
+			}
+
+			chunking = true
+			if !last {
+				s.writef("250 2.0.0 %d octets received", size)
+				break
+			}
+
+			chunking = false
+			delivered := s.deliver(from, to, body)
+			body.Reset()
+			if !delivered {
+				break
 			}
 
 			// Reset for next mail.
 			from = ""
 			gotFrom = false
 			to = nil
-			buffer.Reset()
 		case "QUIT":
 			s.writef("221 2.0.0 %s %s ESMTP Service closing transmission channel", s.srv.Hostname, s.srv.Appname)
 			break loop
@@ -547,7 +773,8 @@ loop:
 			from = ""
 			gotFrom = false
 			to = nil
-			buffer.Reset()
+			body.Reset()
+			chunking = false
 		case "NOOP":
 			s.writef("250 2.0.0 Ok")
 		case "XCLIENT":
@@ -603,8 +830,10 @@ loop:
 			}
 
 			s.writef("220 2.0.0 Ready to start TLS")
+			s.bw.Flush()
 
 			// Establish a TLS connection with the client.
+			// Anything the client pipelined after STARTTLS is discarded with the old reader (RFC 3207 section 4.2).
 			tlsConn := tls.Server(s.conn, s.srv.TLSConfig)
 			err := tlsConn.Handshake()
 			if err != nil {
@@ -623,14 +852,15 @@ loop:
 			from = ""
 			gotFrom = false
 			to = nil
-			buffer.Reset()
+			body.Reset()
+			chunking = false
 		case "AUTH":
 			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
 				break
 			}
 			// Handle case where AUTH is requested but not configured (and therefore not listed as a service extension).
-			if s.srv.AuthHandler == nil {
+			if s.srv.authHandler() == nil {
 				s.writef("502 5.5.1 Command not implemented")
 				break
 			}
@@ -678,8 +908,16 @@ loop:
 					s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
 					break loop
 				}
-
-				s.writef(err.Error())
+			}
+			if !s.authenticated && rejectsCredentials(err) {
+				s.authFailures++
+				if s.srv.Limits.MaxAuthFailures > 0 && s.authFailures >= s.srv.Limits.MaxAuthFailures {
+					s.writef("421 4.7.0 %s Too many failed authentication attempts, closing transmission channel", s.srv.Hostname)
+					break loop
+				}
+			}
+			if err != nil {
+				s.writeError(err, "454 4.7.0 Temporary authentication failure")
 				break
 			}
 
@@ -695,6 +933,13 @@ loop:
 	}
 }
 
+// Let the LogoutHandler know that an authenticated session has ended.
+func (s *session) logout() {
+	if h := s.srv.logoutHandler(); s.authenticated && h != nil {
+		h.HandleLogout(s.ctx, s.info())
+	}
+}
+
 // Wrapper function for writing a complete line to the socket.
 func (s *session) writef(format string, args ...interface{}) error {
 	if s.srv.Timeout > 0 {
@@ -702,8 +947,14 @@ func (s *session) writef(format string, args ...interface{}) error {
 	}
 
 	line := fmt.Sprintf(format, args...)
-	fmt.Fprintf(s.bw, line+"\r\n")
-	err := s.bw.Flush()
+	fmt.Fprint(s.bw, line+"\r\n")
+
+	// PIPELINING (RFC 2920): while more pipelined commands are waiting in the input buffer,
+	// keep the replies buffered and send them as one group once the input buffer is empty.
+	var err error
+	if s.br == nil || s.br.Buffered() == 0 {
+		err = s.bw.Flush()
+	}
 
 	if Debug {
 		verb := "WROTE"
@@ -717,12 +968,117 @@ func (s *session) writef(format string, args ...interface{}) error {
 	return err
 }
 
+// Pass the sender of MAIL to the handler, if any, and reply. Returns the sender and whether it was accepted.
+func (s *session) acceptMailFrom(from string) (string, bool) {
+	if h := s.srv.mailFromHandler(); h != nil {
+		if err := h.HandleMailFrom(s.ctx, s.info(), from); err != nil {
+			s.mailParams = nil
+			s.writeError(err, "451 4.3.0 Requested action aborted: local error in processing")
+			return "", false
+		}
+	}
+	s.writef("250 2.1.0 Ok")
+	return from, true
+}
+
+// Add the Received header to the message, pass it on to the handler, if any, and reply.
+// Returns whether the message was accepted.
+// A SessionStreamHandler reads the message from the spool, other handlers get it as a byte slice.
+func (s *session) deliver(from string, to []string, body *spool) bool {
+	h := s.srv.mailHandler()
+	if h == nil {
+		s.messages++
+		s.srv.recordRecipients(s.identity, len(to))
+		s.writef("250 2.0.0 Ok: queued")
+		return true
+	}
+	data := body.Message(s.makeHeaders(to))
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	stop := s.watchDisconnect(cancel)
+	var msgID string
+	var err error
+	if sh := s.srv.streamHandler(); sh != nil {
+		msgID, err = sh.HandleMailStream(ctx, s.info(), from, to, data)
+	} else {
+		buf := make([]byte, data.Size())
+		if _, err = data.ReadAt(buf, 0); err == nil {
+			msgID, err = h.HandleMail(ctx, s.info(), from, to, buf)
+		}
+	}
+	stop()
+	cancel()
+	if err != nil {
+		s.writeError(err, "451 4.3.5 Unable to process mail")
+		return false
+	}
+
+	s.messages++
+	s.srv.recordRecipients(s.identity, len(to))
+	if msgID != "" {
+		s.writef("250 2.0.0 Ok: queued as %s", msgID)
+	} else {
+		s.writef("250 2.0.0 Ok: queued")
+	}
+	return true
+}
+
+// Pass a recipient with its parameters to the handler, if any, and reply. Returns whether it was accepted.
+// The parameters are visible to the handler, and dropped again if the recipient is refused.
+func (s *session) acceptRcpt(from string, to string, params map[string]string) bool {
+	if params != nil {
+		if s.rcptParams == nil {
+			s.rcptParams = make(map[string]map[string]string)
+		}
+		s.rcptParams[to] = params
+	}
+	if h := s.srv.rcptHandler(); h != nil {
+		if err := h.HandleRcpt(s.ctx, s.info(), from, to); err != nil {
+			delete(s.rcptParams, to)
+			s.writeError(err, "451 4.3.0 Requested action aborted: local error in processing")
+			return false
+		}
+	}
+	s.writef("250 2.1.5 Ok")
+	return true
+}
+
+// Wait for the next command. While waiting, the session is idle: Shutdown interrupts the wait and
+// errShuttingDown is returned. Pipelined commands already received are still returned.
+func (s *session) readCommand() (string, error) {
+	s.srv.mu.Lock()
+	if s.srv.shuttingDown() {
+		s.srv.mu.Unlock()
+		return "", errShuttingDown
+	}
+	// The deadline is set with mu held, so that it can not override the one set by Shutdown.
+	if s.srv.Timeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
+	}
+	s.idle = true
+	s.srv.mu.Unlock()
+
+	line, err := s.readLineWithinDeadline()
+
+	s.srv.mu.Lock()
+	s.idle = false
+	if err != nil && s.srv.shuttingDown() {
+		err = errShuttingDown
+	}
+	s.srv.mu.Unlock()
+	return line, err
+}
+
 // Read a complete line from the socket.
 func (s *session) readLine() (string, error) {
 	if s.srv.Timeout > 0 {
 		s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
 	}
+	return s.readLineWithinDeadline()
+}
 
+// Read a complete line from the socket, within the read deadline already set.
+func (s *session) readLineWithinDeadline() (string, error) {
 	line, err := s.br.ReadString('\n')
 	if err != nil {
 		return "", err
@@ -753,38 +1109,224 @@ func (s *session) parseLine(line string) (verb string, args string) {
 	return verb, args
 }
 
-// Read the message data following a DATA command.
-func (s *session) readData() ([]byte, error) {
-	var data []byte
+// Parse ESMTP parameters such as "SIZE=1000 BODY=8BITMIME" into a map with upper case keys.
+// Used for the parameters of both MAIL and RCPT.
+func parseMailParams(params string) map[string]string {
+	fields := strings.Fields(params)
+	if len(fields) == 0 {
+		return nil
+	}
+	parsed := make(map[string]string, len(fields))
+	for _, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		parsed[strings.ToUpper(key)] = value
+	}
+	return parsed
+}
+
+// Check the ESMTP parameters of a MAIL command. Returns the reply for the first unacceptable one.
+func (s *session) checkMailParams(params map[string]string) error {
+	for _, key := range slices.Sorted(maps.Keys(params)) {
+		value := params[key]
+		switch key {
+		case "SIZE":
+			// Enforce the maximum message size if one is set.
+			size, err := strconv.ParseUint(value, 10, 63)
+			if err != nil {
+				return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
+			}
+			if s.srv.MaxSize > 0 && size > uint64(s.srv.MaxSize) {
+				return maxSizeExceeded(s.srv.MaxSize)
+			}
+		case "BODY":
+			value = strings.ToUpper(value)
+			if value != "7BIT" && value != "8BITMIME" && value != "BINARYMIME" {
+				return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid BODY parameter)")
+			}
+			params[key] = value
+		case "SMTPUTF8":
+			// RFC 6531 section 3.4: the parameter has no value.
+			if value != "" {
+				return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid SMTPUTF8 parameter)")
+			}
+		case "RET":
+			value = strings.ToUpper(value)
+			if value != "FULL" && value != "HDRS" {
+				return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid RET parameter)")
+			}
+			params[key] = value
+		case "ENVID":
+			// RFC 3461 section 4.4: xtext of at most 100 characters.
+			if value == "" || len(value) > 100 || !validXtext(value) {
+				return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid ENVID parameter)")
+			}
+		default:
+			return fmt.Errorf("555 5.5.4 MAIL parameter %s not recognized or not implemented", key)
+		}
+	}
+	return nil
+}
+
+// Parse and check the ESMTP parameters of a RCPT command (RFC 3461). Returns the reply for the first unacceptable one.
+func parseRcptParams(args string) (map[string]string, error) {
+	params := parseMailParams(args)
+	for _, key := range slices.Sorted(maps.Keys(params)) {
+		value := params[key]
+		switch key {
+		case "NOTIFY":
+			// RFC 3461 section 4.1: NEVER, or a list of SUCCESS, FAILURE and DELAY.
+			value = strings.ToUpper(value)
+			keywords := strings.Split(value, ",")
+			for _, keyword := range keywords {
+				if (keyword != "NEVER" || len(keywords) > 1) && keyword != "SUCCESS" && keyword != "FAILURE" && keyword != "DELAY" {
+					return nil, errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid NOTIFY parameter)")
+				}
+			}
+			params[key] = value
+		case "ORCPT":
+			// RFC 3461 section 4.2: addr-type ";" xtext
+			addrType, addr, ok := strings.Cut(value, ";")
+			if !ok || addrType == "" || addr == "" || !validXtext(addr) {
+				return nil, errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid ORCPT parameter)")
+			}
+		default:
+			return nil, fmt.Errorf("555 5.5.4 RCPT parameter %s not recognized or not implemented", key)
+		}
+	}
+	return params, nil
+}
+
+// Check that s is xtext (RFC 3461 section 4): printable ASCII except "+" and "=", which are encoded as "+" and two upper case hex digits.
+// An escape must also stand for printable ASCII, so that the decoded value cannot carry e.g. CR LF into a DSN.
+func validXtext(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '+':
+			if i+2 >= len(s) || !isUpperHex(s[i+1]) || !isUpperHex(s[i+2]) {
+				return false
+			}
+			if c, _ := strconv.ParseUint(s[i+1:i+3], 16, 8); c < 33 || c > 126 {
+				return false
+			}
+			i += 2
+		case c < 33 || c > 126 || c == '=':
+			return false
+		}
+	}
+	return true
+}
+
+func isUpperHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('A' <= c && c <= 'F')
+}
+
+// Check a MAIL or RCPT address. Non-ASCII addresses are only allowed in transactions started with
+// the SMTPUTF8 parameter (RFC 6531 section 3.7.4.1).
+func checkAddress(address string, params map[string]string) error {
+	if !utf8.ValidString(address) {
+		return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid UTF-8 in address)")
+	}
+	if _, ok := params["SMTPUTF8"]; ok {
+		return nil
+	}
+	for i := 0; i < len(address); i++ {
+		if address[i] >= utf8.RuneSelf {
+			return errors.New("553 5.6.7 Non-ASCII addresses require the SMTPUTF8 parameter")
+		}
+	}
+	return nil
+}
+
+// Parse the arguments of a BDAT command: the chunk size and the optional LAST keyword.
+func parseBDATArgs(args string) (size int64, last bool, ok bool) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, false, false
+	}
+	if len(fields) == 2 {
+		if !strings.EqualFold(fields[1], "LAST") {
+			return 0, false, false
+		}
+		last = true
+	}
+	n, err := strconv.ParseUint(fields[0], 10, 63)
+	if err != nil {
+		return 0, false, false
+	}
+	return int64(n), last, true
+}
+
+// Create a random session ID.
+func newSessionID() string {
+	buf := make([]byte, 6)
+	_, _ = rand.Read(buf)
+	return strings.ToUpper(hex.EncodeToString(buf))
+}
+
+// Read the message data following a DATA command into w, line by line without holding the message in memory.
+// If w fails, the rest of the message is read and discarded before the error is returned.
+func (s *session) readData(w io.Writer) error {
+	var size int
+	var writeErr error
+	lineStart := true
 	for {
 		if s.srv.Timeout > 0 {
 			s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
 		}
 
-		line, err := s.br.ReadBytes('\n')
-		if err != nil {
-			return nil, err
-		}
-		// Handle end of data denoted by lone period (\r\n.\r\n)
-		if bytes.Equal(line, []byte(".\r\n")) {
-			break
+		// Lines longer than the read buffer are returned in pieces.
+		line, err := s.br.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
 		}
-		// Remove leading period (RFC 5321 section 4.5.2)
-		if line[0] == '.' {
-			line = line[1:]
+		if lineStart {
+			// Handle end of data denoted by lone period (\r\n.\r\n)
+			if bytes.Equal(line, []byte(".\r\n")) {
+				break
+			}
+			// Remove leading period (RFC 5321 section 4.5.2)
+			if line[0] == '.' {
+				line = line[1:]
+			}
 		}
+		lineStart = err == nil
 
 		// Enforce the maximum message size limit.
 		if s.srv.MaxSize > 0 {
-			if len(data)+len(line) > s.srv.MaxSize {
+			if size+len(line) > s.srv.MaxSize {
 				_, _ = s.br.Discard(s.br.Buffered()) // Discard the buffer remnants.
-				return nil, maxSizeExceeded(s.srv.MaxSize)
+				return maxSizeExceeded(s.srv.MaxSize)
 			}
 		}
+		size += len(line)
+
+		if writeErr == nil {
+			_, writeErr = w.Write(line)
+		}
+	}
+	return writeErr
+}
 
-		data = append(data, line...)
+// Read the size octets of a BDAT chunk into w, or discard them.
+// The read deadline is renewed for every block, so large chunks are not limited by the timeout.
+func (s *session) readChunk(w io.Writer, size int64, discard bool) error {
+	if discard {
+		w = io.Discard
+	}
+	for size > 0 {
+		if s.srv.Timeout > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
+		}
+		n, err := io.CopyN(w, s.br, min(size, 64*1024))
+		size -= n
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
 	}
-	return data, nil
+	return nil
 }
 
 // Create the Received header to comply with RFC 2821 section 3.8.2.
@@ -793,7 +1335,11 @@ func (s *session) makeHeaders(to []string) []byte {
 	var buffer bytes.Buffer
 	now := time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700 (MST)")
 	buffer.WriteString(fmt.Sprintf("Received: from %s (%s [%s])\r\n", s.remoteName, s.remoteHost, s.remoteIP))
-	buffer.WriteString(fmt.Sprintf("        by %s (%s) with SMTP\r\n", s.srv.Hostname, s.srv.Appname))
+	protocol := "SMTP"
+	if _, ok := s.mailParams["SMTPUTF8"]; ok {
+		protocol = "UTF8SMTP" // RFC 6531 section 4.3
+	}
+	buffer.WriteString(fmt.Sprintf("        by %s (%s) with %s\r\n", s.srv.Hostname, s.srv.Appname, protocol))
 	buffer.WriteString(fmt.Sprintf("        for <%s>; %s\r\n", to[0], now))
 	return buffer.Bytes()
 }
@@ -827,7 +1373,7 @@ func (s *session) makeEHLOResponse() (response string) {
 	}
 
 	// Only list AUTH if an AuthHandler is configured and at least one mechanism is allowed.
-	if s.srv.AuthHandler != nil {
+	if s.srv.authHandler() != nil {
 		var mechs []string
 		for mech, allowed := range s.authMechs() {
 			if allowed {
@@ -839,6 +1385,12 @@ func (s *session) makeEHLOResponse() (response string) {
 		}
 	}
 
+	response += "250-PIPELINING\r\n"
+	response += "250-8BITMIME\r\n"
+	response += "250-SMTPUTF8\r\n"
+	response += "250-CHUNKING\r\n"
+	response += "250-BINARYMIME\r\n"
+	response += "250-DSN\r\n"
 	response += "250 ENHANCEDSTATUSCODES"
 	return
 }
@@ -847,7 +1399,7 @@ func (s *session) handleAuthLogin(arg string) (bool, error) {
 	var err error
 
 	if arg == "" {
-		s.writef("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+		s.writef("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
 		arg, err = s.readLine()
 		if err != nil {
 			return false, err
@@ -859,7 +1411,7 @@ func (s *session) handleAuthLogin(arg string) (bool, error) {
 		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
 	}
 
-	s.writef("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+	s.writef("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
 	line, err := s.readLine()
 	if err != nil {
 		return false, err
@@ -871,7 +1423,10 @@ func (s *session) handleAuthLogin(arg string) (bool, error) {
 	}
 
 	// Validate credentials.
-	authenticated, err := s.srv.AuthHandler(s.conn.RemoteAddr(), "LOGIN", username, password, nil)
+	authenticated, err := s.srv.authHandler().HandleAuth(s.ctx, s.info(), "LOGIN", username, password, nil)
+	if authenticated {
+		s.identity = &Identity{Username: string(username), Mechanism: "LOGIN"}
+	}
 
 	return authenticated, err
 }
@@ -899,7 +1454,10 @@ func (s *session) handleAuthPlain(arg string) (bool, error) {
 	}
 
 	// Validate credentials.
-	authenticated, err := s.srv.AuthHandler(s.conn.RemoteAddr(), "PLAIN", parts[1], parts[2], nil)
+	authenticated, err := s.srv.authHandler().HandleAuth(s.ctx, s.info(), "PLAIN", parts[1], parts[2], nil)
+	if authenticated {
+		s.identity = &Identity{Username: string(parts[1]), Mechanism: "PLAIN"}
+	}
 
 	return authenticated, err
 }
@@ -907,7 +1465,7 @@ func (s *session) handleAuthPlain(arg string) (bool, error) {
 func (s *session) handleAuthCramMD5() (bool, error) {
 	shared := "<" + strconv.Itoa(os.Getpid()) + "." + strconv.Itoa(time.Now().Nanosecond()) + "@" + s.srv.Hostname + ">"
 
-	s.writef("334 " + base64.StdEncoding.EncodeToString([]byte(shared)))
+	s.writef("334 %s", base64.StdEncoding.EncodeToString([]byte(shared)))
 
 	data, err := s.readLine()
 	if err != nil {
@@ -929,7 +1487,10 @@ func (s *session) handleAuthCramMD5() (bool, error) {
 	}
 
 	// Validate credentials.
-	authenticated, err := s.srv.AuthHandler(s.conn.RemoteAddr(), "CRAM-MD5", []byte(fields[0]), []byte(fields[1]), []byte(shared))
+	authenticated, err := s.srv.authHandler().HandleAuth(s.ctx, s.info(), "CRAM-MD5", []byte(fields[0]), []byte(fields[1]), []byte(shared))
+	if authenticated {
+		s.identity = &Identity{Username: fields[0], Mechanism: "CRAM-MD5"}
+	}
 
 	return authenticated, err
 }
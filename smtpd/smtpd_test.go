@@ -153,6 +153,36 @@ func TestCmdMAIL(t *testing.T) {
 	cmdCode(t, conn, "MAIL FROM:<sender@example.com> SIZE= ", "501")
 	cmdCode(t, conn, "MAIL FROM:<sender@example.com> SIZE=foo", "501")
 
+	// MAIL with valid BODY parameter should return 250 Ok
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> BODY=7BIT", "250")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> BODY=8BITMIME", "250")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> SIZE=1000 BODY=binarymime", "250")
+
+	// MAIL with bad BODY parameter should return 501 syntax error
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> BODY=foo", "501")
+
+	// MAIL with SMTPUTF8 parameter should return 250 Ok, the parameter has no value
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> SMTPUTF8", "250")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> SMTPUTF8=yes", "501")
+
+	// MAIL with non-ASCII address requires SMTPUTF8
+	cmdCode(t, conn, "MAIL FROM:<用户@例子.中国>", "553")
+	cmdCode(t, conn, "MAIL FROM:<用户@例子.中国> BODY=8BITMIME SMTPUTF8", "250")
+	cmdCode(t, conn, "MAIL FROM:<\xff@example.com> SMTPUTF8", "501")
+
+	// MAIL with valid DSN parameters should return 250 Ok
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> RET=FULL ENVID=QQ314159", "250")
+
+	// MAIL with bad DSN parameters should return 501 syntax error
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> RET=ALL", "501")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> ENVID=a=b", "501")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> ENVID=a+2g", "501")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> ENVID=+0D+0ABcc:x", "501")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> ENVID="+strings.Repeat("x", 101), "501")
+
+	// MAIL with unknown parameter should return 555
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> FOO=bar", "555")
+
 	// TODO: MAIL with valid AUTH parameter should return 250 Ok
 
 	// TODO: MAIL with invalid AUTH parameter must return 501 syntax error
@@ -192,6 +222,33 @@ func TestCmdMAILMaxSize(t *testing.T) {
 	conn.Close()
 }
 
+func TestCmdMAILWithHandler(t *testing.T) {
+	handler := func(remoteAddr net.Addr, from string) error {
+		switch from {
+		case "spoofed@example.com":
+			return errors.New("553 5.7.1 Sender address not allowed")
+		case "broken@example.com":
+			return errors.New("lookup failed")
+		}
+		return nil
+	}
+	conn := newConn(t, &Server{HandlerMail: handler})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+
+	// A sender refused by the handler returns the handler's reply and RCPT remains out of sequence
+	cmdCode(t, conn, "MAIL FROM:<spoofed@example.com> SIZE=1000", "553")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "503")
+
+	// Errors not formatted as an SMTP reply should return 451
+	cmdCode(t, conn, "MAIL FROM:<broken@example.com>", "451")
+
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+}
+
 func TestCmdRCPT(t *testing.T) {
 	conn := newConn(t, &Server{})
 	cmdCode(t, conn, "EHLO host.example.com", "250")
@@ -235,6 +292,19 @@ func TestCmdRCPT(t *testing.T) {
 	cmdCode(t, conn, "MAIL FROM:<>", "250")
 	cmdCode(t, conn, "RCPT TO:  <recipient@example.com>", "501")
 
+	// RCPT with valid DSN parameters should return 250 Ok
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com> NOTIFY=NEVER", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com> NOTIFY=SUCCESS,DELAY ORCPT=rfc822;recipient@example.com", "250")
+
+	// RCPT with bad DSN parameters should return 501 syntax error
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com> NOTIFY=NEVER,FAILURE", "501")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com> NOTIFY=", "501")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com> ORCPT=recipient@example.com", "501")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com> ORCPT=rfc822;a+0D+0ABcc:x", "501")
+
+	// RCPT with unknown parameter should return 555
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com> FOO=bar", "555")
+
 	cmdCode(t, conn, "QUIT", "221")
 	conn.Close()
 }
@@ -351,6 +421,150 @@ func TestCmdDATAWithHandlerError(t *testing.T) {
 	}
 }
 
+// Send a BDAT command with its chunk and verify the 3 digit code from the response.
+func bdatCode(t *testing.T, conn net.Conn, chunk string, last bool, code string) string {
+	cmd := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+	return cmdCode(t, conn, cmd+"\r\n"+chunk, code)
+}
+
+func TestCmdSMTPUTF8(t *testing.T) {
+	var gotFrom string
+	var gotTo []string
+	var gotData []byte
+	handler := func(remoteAddr net.Addr, from string, to []string, data []byte) error {
+		gotFrom, gotTo, gotData = from, to, data
+		return nil
+	}
+	conn := newConn(t, &Server{Handler: handler})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+
+	// Non-ASCII recipients are refused without SMTPUTF8
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<张三@example.com>", "553")
+	cmdCode(t, conn, "RSET", "250")
+
+	cmdCode(t, conn, "MAIL FROM:<李四@例子.中国> SMTPUTF8 BODY=8BITMIME", "250")
+	cmdCode(t, conn, "RCPT TO:<张三@example.com>", "250")
+	cmdCode(t, conn, "DATA", "354")
+	cmdCode(t, conn, "From: 李四 <李四@例子.中国>\r\nSubject: 你好\r\n\r\n正文\r\n.", "250")
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+
+	if gotFrom != "李四@例子.中国" || len(gotTo) != 1 || gotTo[0] != "张三@example.com" {
+		t.Errorf("Handler got from %q to %q, want the UTF-8 addresses", gotFrom, gotTo)
+	}
+	if !bytes.Contains(gotData, []byte(" with UTF8SMTP\r\n")) || !bytes.HasSuffix(gotData, []byte("Subject: 你好\r\n\r\n正文\r\n")) {
+		t.Errorf("Handler got data %q", gotData)
+	}
+}
+
+func TestCmdBDAT(t *testing.T) {
+	var received []byte
+	handler := func(remoteAddr net.Addr, from string, to []string, data []byte) error {
+		received = data
+		return nil
+	}
+	conn := newConn(t, &Server{Handler: handler})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+
+	// BDAT without arguments or with bad arguments should return 501 syntax error
+	cmdCode(t, conn, "BDAT", "501")
+	cmdCode(t, conn, "BDAT foo", "501")
+	cmdCode(t, conn, "BDAT 10 FIRST", "501")
+
+	// BDAT without MAIL & RCPT should return 503, the chunk is read anyway
+	bdatCode(t, conn, "Test message.\r\n", true, "503")
+
+	// A message in several chunks, including binary data and lines that look like the end of DATA
+	chunks := []string{"Subject: chunks\r\n\r\n", ".\r\n\x00\xff", "\r\nend\r\n"}
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> BODY=BINARYMIME", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	bdatCode(t, conn, chunks[0], false, "250")
+	bdatCode(t, conn, chunks[1], false, "250")
+
+	// DATA is not allowed once BDAT has been used
+	cmdCode(t, conn, "DATA", "503")
+
+	bdatCode(t, conn, chunks[2], true, "250")
+	if !bytes.HasSuffix(received, []byte(strings.Join(chunks, ""))) || !bytes.HasPrefix(received, []byte("Received: ")) {
+		t.Errorf("Handler received %q, want the Received header and the chunks", received)
+	}
+
+	// An empty last chunk ends the message
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	bdatCode(t, conn, "Test message.\r\n", false, "250")
+	bdatCode(t, conn, "", true, "250")
+	if !bytes.HasSuffix(received, []byte("\r\nTest message.\r\n")) {
+		t.Errorf("Handler received %q, want the chunk", received)
+	}
+
+	// BINARYMIME messages can't be sent with DATA
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> BODY=BINARYMIME", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, conn, "DATA", "503")
+
+	// Pipelined BDAT commands get their replies as a single group (each chunk ends with the CRLF added by pipeline)
+	pipeline(t, conn,
+		[]string{"RSET", "MAIL FROM:<sender@example.com>", "RCPT TO:<recipient@example.com>", "BDAT 7\r\nchunk", "BDAT 7 LAST\r\nchunk", "NOOP"},
+		[]string{"250", "250", "250", "250", "250", "250"})
+
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+}
+
+func TestCmdBDATWithMaxSize(t *testing.T) {
+	m := mockHandler{}
+	conn := newConn(t, &Server{Handler: m.handler(nil), MaxSize: 15})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+
+	// Messages matching the maximum size should return 250 Ok
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	bdatCode(t, conn, "Test message.\r\n", true, "250")
+
+	// Messages above the maximum size should return a maximum size exceeded error,
+	// even if every chunk is below the maximum size, and end the transaction.
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	bdatCode(t, conn, "Test message.\r\n", false, "250")
+	bdatCode(t, conn, "Too long.\r\n", false, "552")
+	bdatCode(t, conn, "Last chunk.\r\n", true, "503")
+
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+
+	if m.handlerCalled != 1 {
+		t.Errorf("MailHandler called %d times, want one call", m.handlerCalled)
+	}
+}
+
+func TestListen(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0"}
+	ln, err := srv.Listen()
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	if srv.Appname != "smtpd" || srv.Hostname == "" || srv.Timeout != 5*time.Minute {
+		t.Errorf("Listen left the defaults unset: appname %q, hostname %q, timeout %s", srv.Appname, srv.Hostname, srv.Timeout)
+	}
+
+	// An address in use is reported before serving.
+	if ln2, err := (&Server{Addr: ln.Addr().String()}).Listen(); err == nil {
+		ln2.Close()
+		t.Errorf("Listen on %s succeeded twice", ln.Addr())
+	}
+
+	srv.Close()
+	if _, err := srv.Listen(); err != ErrServerClosed {
+		t.Errorf("Listen after Close returned %v, want ErrServerClosed", err)
+	}
+}
+
 func TestCmdSTARTTLS(t *testing.T) {
 	conn := newConn(t, &Server{})
 	cmdCode(t, conn, "EHLO host.example.com", "250")
@@ -480,6 +694,59 @@ func TestCmdSTARTTLSSuccess(t *testing.T) {
 	tlsConn.Close()
 }
 
+func TestCmdSTARTTLSPipelined(t *testing.T) {
+	server := &Server{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+
+	// Commands pipelined after STARTTLS must be discarded, not executed inside the TLS session (RFC 3207 section 4.2).
+	cmdCode(t, conn, "STARTTLS\r\nMAIL FROM:<injected@example.com>", "220")
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("Failed to perform TLS handshake: %v", err)
+	}
+
+	cmdCode(t, tlsConn, "EHLO host.example.com", "250")
+	cmdCode(t, tlsConn, "RCPT TO:<recipient@example.com>", "503")
+	cmdCode(t, tlsConn, "QUIT", "221")
+	tlsConn.Close()
+}
+
+func TestTLSListener(t *testing.T) {
+	m := &mockSessionHandler{}
+	server := &Server{
+		Name:           "submissions",
+		TLSConfig:      &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSListener:    true,
+		TLSRequired:    true,
+		SessionHandler: m,
+	}
+	clientConn, serverConn := net.Pipe()
+	go server.newSession(serverConn).serve()
+
+	// The client starts TLS right away, before the banner.
+	tlsConn := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("Failed to perform TLS handshake: %v", err)
+	}
+	defer tlsConn.Close()
+	if banner, _ := bufio.NewReader(tlsConn).ReadString('\n'); !strings.HasPrefix(banner, "220") {
+		t.Fatalf("Banner is %q, want 220", banner)
+	}
+
+	cmdCode(t, tlsConn, "STARTTLS", "503")
+	cmdCode(t, tlsConn, "HELO host.example.com", "250")
+	cmdCode(t, tlsConn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, tlsConn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, tlsConn, "DATA", "354")
+	cmdCode(t, tlsConn, "Test message.\r\n.", "250")
+	cmdCode(t, tlsConn, "QUIT", "221")
+
+	if len(m.infos) != 1 || m.infos[0].Listener != "submissions" || m.infos[0].TLS == nil {
+		t.Errorf("SessionInfo is %+v, want the submissions listener over TLS", m.infos)
+	}
+}
+
 func TestCmdSTARTTLSRequired(t *testing.T) {
 	tests := []struct {
 		cmd        string
@@ -531,6 +798,59 @@ func TestCmdSTARTTLSRequired(t *testing.T) {
 	tlsConn.Close()
 }
 
+// Send a batch of pipelined commands in a single write and verify the reply codes, which
+// must arrive as a single group once the server has read the whole batch.
+func pipeline(t *testing.T, conn net.Conn, cmds []string, codes []string) {
+	fmt.Fprintf(conn, "%s\r\n", strings.Join(cmds, "\r\n"))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read replies from test server: %v", err)
+	}
+	replies := strings.Split(strings.TrimSuffix(string(buf[:n]), "\r\n"), "\r\n")
+	if len(replies) != len(codes) {
+		t.Fatalf("Pipelined %q got replies %q in one group, want %d replies", cmds, replies, len(codes))
+	}
+	for i, reply := range replies {
+		if reply[0:3] != codes[i] {
+			t.Errorf("Pipelined command \"%s\" response code is %s, want %s", cmds[i], reply[0:3], codes[i])
+		}
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	m := mockHandler{}
+	rcpt := func(remoteAddr net.Addr, from string, to string) bool {
+		return to != "refused@example.com"
+	}
+	conn := newConn(t, &Server{Handler: m.handler(nil), HandlerRcpt: rcpt})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+
+	// A complete transaction, with a refused recipient in the middle of the batch.
+	pipeline(t, conn,
+		[]string{"MAIL FROM:<sender@example.com>", "RCPT TO:<recipient@example.com>", "RCPT TO:<refused@example.com>", "RCPT TO:<other@example.com>", "DATA"},
+		[]string{"250", "250", "550", "250", "354"})
+	cmdCode(t, conn, "Test message.\r\n.", "250")
+
+	// A syntax error in MAIL makes the rest of the batch fail with bad sequence.
+	pipeline(t, conn,
+		[]string{"RSET", "MAIL FROM:sender@example.com", "RCPT TO:<recipient@example.com>", "DATA"},
+		[]string{"250", "501", "503", "503"})
+
+	// Message data followed by pipelined commands.
+	pipeline(t, conn,
+		[]string{"MAIL FROM:<sender@example.com>", "RCPT TO:<recipient@example.com>", "DATA"},
+		[]string{"250", "250", "354"})
+	pipeline(t, conn,
+		[]string{"Test message.", ".", "NOOP", "QUIT"},
+		[]string{"250", "250", "221"})
+	conn.Close()
+
+	if m.handlerCalled != 2 {
+		t.Errorf("MailHandler called %d times, want two calls", m.handlerCalled)
+	}
+}
+
 func TestMakeHeaders(t *testing.T) {
 	now := time.Now().Format("Mon, _2 Jan 2006 15:04:05 -0700 (MST)")
 	valid := "Received: from clientName (clientHost [clientIP])\r\n" +
@@ -612,6 +932,9 @@ func TestReadData(t *testing.T) {
 
 		// Multiple line message with one leading period removed.
 		{"Line 1.\r\n..Line 2.\r\nLine 3.\r\n.\r\n", "Line 1.\r\n.Line 2.\r\nLine 3.\r\n"},
+
+		// Line longer than the read buffer, read in pieces: only its leading period is removed.
+		{"." + strings.Repeat(".x", 4096) + "\r\n.\r\n", strings.Repeat(".x", 4096) + "\r\n"},
 	}
 	var buf bytes.Buffer
 	s := &session{}
@@ -619,18 +942,19 @@ func TestReadData(t *testing.T) {
 	s.br = bufio.NewReader(&buf)
 
 	// Ensure readData() returns an EOF error on an empty buffer.
-	_, err := s.readData()
+	err := s.readData(io.Discard)
 	if err != io.EOF {
 		t.Errorf("readData() on empty buffer returned err: %v, want EOF", err)
 	}
 
 	for _, tt := range tests {
 		buf.Write([]byte(tt.lines))
-		data, err := s.readData()
+		var data bytes.Buffer
+		err := s.readData(&data)
 		if err != nil {
 			t.Errorf("readData(%v) returned err: %v", tt.lines, err)
-		} else if string(data) != tt.data {
-			t.Errorf("readData(%v) returned %v, want %v", tt.lines, string(data), tt.data)
+		} else if data.String() != tt.data {
+			t.Errorf("readData(%v) returned %v, want %v", tt.lines, data.String(), tt.data)
 		}
 	}
 }
@@ -661,7 +985,7 @@ func TestReadDataWithMaxSize(t *testing.T) {
 	for _, tt := range tests {
 		s.srv = &Server{MaxSize: tt.maxSize}
 		buf.Write([]byte(tt.lines))
-		_, err := s.readData()
+		err := s.readData(io.Discard)
 		if err != tt.err {
 			t.Errorf("readData(%v) returned err: %v", tt.lines, tt.err)
 		}
@@ -764,6 +1088,18 @@ func TestMakeEHLOResponse(t *testing.T) {
 		t.Errorf("SIZE appears in the extension list with incorrect parameter %s, want %s", extensions["SIZE"], maxSizeStr)
 	}
 
+	// PIPELINING should always be advertised.
+	if _, ok := extensions["PIPELINING"]; !ok {
+		t.Errorf("PIPELINING does not appear in the extension list")
+	}
+
+	// 8BITMIME, SMTPUTF8, CHUNKING, BINARYMIME and DSN should always be advertised.
+	for _, ext := range []string{"8BITMIME", "SMTPUTF8", "CHUNKING", "BINARYMIME", "DSN"} {
+		if _, ok := extensions[ext]; !ok {
+			t.Errorf("%s does not appear in the extension list", ext)
+		}
+	}
+
 	// With no authentication handler configured, AUTH should not be advertised.
 	s.srv = &Server{}
 	extensions = parseExtensions(t, s.makeEHLOResponse())
@@ -1531,6 +1867,86 @@ func TestCmdAUTHCRAMMD5WithTLS(t *testing.T) {
 	tlsConn.Close()
 }
 
+func TestLogoutHandler(t *testing.T) {
+	logouts := make(chan string, 1)
+	server := &Server{
+		AuthHandler: authHandler,
+		AuthMechs:   map[string]bool{"PLAIN": true},
+		LogoutHandler: func(remoteAddr net.Addr, identity *Identity) {
+			logouts <- identity.Username
+		},
+	}
+
+	// Sessions that never authenticated must not trigger the LogoutHandler.
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+
+	conn = newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	cmdCode(t, conn, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00valid\x00password")), "235")
+	conn.Close() // Client goes away without QUIT.
+
+	select {
+	case username := <-logouts:
+		if username != "valid" {
+			t.Errorf("LogoutHandler called with username %q, want %q", username, "valid")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("LogoutHandler was not called after the session ended")
+	}
+
+	select {
+	case username := <-logouts:
+		t.Errorf("LogoutHandler called again with username %q", username)
+	default:
+	}
+}
+
+func TestIdentityMsgIDHandler(t *testing.T) {
+	var got []*Identity
+	server := &Server{
+		AuthHandler: authHandler,
+		AuthMechs:   map[string]bool{"PLAIN": true},
+		IdentityMsgIDHandler: func(remoteAddr net.Addr, identity *Identity, from string, to []string, data []byte) (string, error) {
+			got = append(got, identity)
+			return "ABC123", nil
+		},
+	}
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+
+	// Without AUTH the handler receives no identity.
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, conn, "DATA", "354")
+	cmdCode(t, conn, "Test message.\r\n.", "250")
+
+	// After AUTH the handler receives the authenticated username, whatever the sender address is.
+	cmdCode(t, conn, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00valid\x00password")), "235")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, conn, "DATA", "354")
+	if resp := cmdCode(t, conn, "Test message.\r\n.", "250"); !strings.HasSuffix(resp, "queued as ABC123") {
+		t.Errorf("DATA response is %q, want the message ID", resp)
+	}
+
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+
+	if len(got) != 2 {
+		t.Fatalf("IdentityMsgIDHandler called %d times, want 2 calls", len(got))
+	}
+	if got[0] != nil {
+		t.Errorf("Identity without AUTH is %+v, want nil", got[0])
+	}
+	want := &Identity{Username: "valid", Mechanism: "PLAIN"}
+	if !reflect.DeepEqual(got[1], want) {
+		t.Errorf("Identity after AUTH is %+v, want %+v", got[1], want)
+	}
+}
+
 // Benchmark the mail handling without the network stack introducing latency.
 func BenchmarkReceive(b *testing.B) {
 	server := &Server{} // Default server configuration.
@@ -1560,45 +1976,188 @@ func BenchmarkReceive(b *testing.B) {
 	}
 }
 
-func TestCmdShutdown(t *testing.T) {
+// Stream handler that reads the message and drops it.
+type discardStreamHandler struct{}
 
-	srv := &Server{}
+func (discardStreamHandler) HandleMail(ctx context.Context, info *SessionInfo, from string, to []string, data []byte) (string, error) {
+	return "", nil
+}
 
-	conn := newConn(t, srv)
+func (discardStreamHandler) HandleMailStream(ctx context.Context, info *SessionInfo, from string, to []string, data *io.SectionReader) (string, error) {
+	_, err := io.Copy(io.Discard, data)
+	return "", err
+}
 
-	// Send HELO, expect greeting.
+// Benchmark receiving a 10 MB message, handled as a byte slice and as a stream.
+// Memory is the point: streamed messages larger than the spool threshold are not held in memory.
+func BenchmarkReceiveLarge(b *testing.B) {
+	line := strings.Repeat("x", 76) + "\r\n"
+	message := []byte(strings.Repeat(line, 10<<20/len(line)) + ".\r\n")
+	handlers := []struct {
+		name    string
+		handler SessionHandler
+	}{
+		{"Handler", Handler(func(net.Addr, string, []string, []byte) error { return nil })},
+		{"StreamHandler", discardStreamHandler{}},
+	}
+
+	for _, h := range handlers {
+		b.Run(h.name, func(b *testing.B) {
+			server := &Server{SessionHandler: h.handler, SpoolDir: b.TempDir()}
+			clientConn, serverConn := net.Pipe()
+			session := server.newSession(serverConn)
+			go session.serve()
+
+			reader := bufio.NewReader(clientConn)
+			_, _ = reader.ReadString('\n') // Read greeting message first.
+			fmt.Fprintf(clientConn, "%s\r\n", "HELO host.example.com")
+			_, _ = reader.ReadString('\n')
+
+			b.SetBytes(int64(len(message)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				fmt.Fprintf(clientConn, "%s\r\n", "MAIL FROM:<sender@example.com>")
+				_, _ = reader.ReadString('\n')
+				fmt.Fprintf(clientConn, "%s\r\n", "RCPT TO:<recipient@example.com>")
+				_, _ = reader.ReadString('\n')
+				fmt.Fprintf(clientConn, "%s\r\n", "DATA")
+				_, _ = reader.ReadString('\n')
+				clientConn.Write(message)
+				if reply, _ := reader.ReadString('\n'); !strings.HasPrefix(reply, "250") {
+					b.Fatalf("Message refused: %s", reply)
+				}
+			}
+			b.StopTimer()
+			fmt.Fprintf(clientConn, "%s\r\n", "QUIT")
+			_, _ = reader.ReadString('\n')
+		})
+	}
+}
+
+func TestCmdShutdown(t *testing.T) {
+	srv := &Server{}
+	conn := newConn(t, srv)
 	cmdCode(t, conn, "HELO host.example.com", "250")
 	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
-	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
-	cmdCode(t, conn, "HELO host.example.com", "250")
-	cmdCode(t, conn, "DATA", "503")
 
+	done := make(chan error, 1)
 	go func() {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
 
-		if err := srv.Shutdown(ctx); err != nil {
-			t.Errorf("Error shutting down server: %v\n", err)
-		}
+	// A session waiting for a command is closed at once, even in the middle of a transaction.
+	reader := bufio.NewReader(conn)
+	if resp, _ := reader.ReadString('\n'); !strings.HasPrefix(resp, "421 4.3.2 ") {
+		t.Errorf("Idle session got %q on shutdown, want 421 4.3.2", resp)
+	}
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("Expected connection to be closed")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Error shutting down server: %v", err)
+	}
+}
+
+func TestShutdownFinishesCommand(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := &Server{SessionHandler: &mockSessionHandler{mail: func(ctx context.Context) (string, error) {
+		close(started)
+		<-release
+		return "ID", nil
+	}}}
+	addr := newProxyServer(t, srv)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	for _, cmd := range []string{"HELO host.example.com", "MAIL FROM:<sender@example.com>", "RCPT TO:<recipient@example.com>", "DATA"} {
+		fmt.Fprintf(conn, "%s\r\n", cmd)
+		reader.ReadString('\n')
+	}
+	fmt.Fprint(conn, "Test message.\r\n.\r\n")
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- srv.Shutdown(ctx)
 	}()
 
-	// give the shutdown time to act
-	time.Sleep(200 * time.Millisecond)
+	// The listener is closed at once.
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if i == 50 {
+			t.Fatal("Still accepting connections after Shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v while an email was being relayed", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The email is relayed and acknowledged before the session is closed.
+	close(release)
+	if resp, _ := reader.ReadString('\n'); !strings.HasPrefix(resp, "250 ") {
+		t.Errorf("In-flight email got %q, want 250", resp)
+	}
+	if resp, _ := reader.ReadString('\n'); !strings.HasPrefix(resp, "421 4.3.2 ") {
+		t.Errorf("Session got %q after the email, want 421 4.3.2", resp)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Error shutting down server: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	if err := srv.Serve(ln); err != ErrServerClosed {
+		t.Errorf("Serve after Shutdown returned %v, want ErrServerClosed", err)
+	}
+}
 
-	// shutdown will wait until the end of the session
+func TestShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	srv := &Server{SessionHandler: &mockSessionHandler{mail: func(ctx context.Context) (string, error) {
+		close(started)
+		<-ctx.Done()
+		return "", errors.New("451 4.3.0 Relay aborted")
+	}}}
+	conn := newConn(t, srv)
+	defer conn.Close()
 	cmdCode(t, conn, "HELO host.example.com", "250")
 	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
 	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, conn, "DATA", "354")
+	fmt.Fprint(conn, "Test message.\r\n.\r\n")
+	<-started
 
-	// this will trigger the close
-	cmdCode(t, conn, "QUIT", "221")
-
-	// connection should now be closed
-	fmt.Fprintf(conn, "%s\r\n", "HELO host.example.com")
-	_, err := bufio.NewReader(conn).ReadString('\n')
-	if err != io.EOF {
-		t.Errorf("Expected connection to be closed\n")
+	// When the deadline passes, the handlers are cancelled and Shutdown returns.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	go func() {
+		if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Errorf("Shutdown returned %v, want context.DeadlineExceeded", err)
+		}
+	}()
+	reader := bufio.NewReader(conn)
+	if resp, _ := reader.ReadString('\n'); !strings.HasPrefix(resp, "451 ") {
+		t.Errorf("Cancelled relay got %q, want 451", resp)
+	}
+	if resp, _ := reader.ReadString('\n'); !strings.HasPrefix(resp, "421 4.3.2 ") {
+		t.Errorf("Session got %q after the cancelled relay, want 421 4.3.2", resp)
 	}
-
-	conn.Close()
 }
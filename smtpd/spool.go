@@ -0,0 +1,109 @@
+package smtpd
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Default size up to which a message is held in memory while it is received.
+const defaultSpoolThreshold = 1 << 20
+
+// spool holds the message data of a transaction while it is received and handled: in memory up to threshold bytes,
+// in a temporary file in dir beyond, so that large messages do not have to fit in memory.
+type spool struct {
+	dir       string
+	threshold int
+	buf       bytes.Buffer
+	file      *os.File
+	size      int64
+}
+
+func (srv *Server) newSpool() *spool {
+	threshold := srv.SpoolThreshold
+	if threshold <= 0 {
+		threshold = defaultSpoolThreshold
+	}
+	return &spool{dir: srv.SpoolDir, threshold: threshold}
+}
+
+// Write appends p, moving the data to a temporary file once it grows beyond the threshold.
+func (sp *spool) Write(p []byte) (int, error) {
+	if sp.file == nil && sp.buf.Len()+len(p) > sp.threshold {
+		file, err := os.CreateTemp(sp.dir, "smtpd-*.eml")
+		if err != nil {
+			return 0, err
+		}
+		// Unlinked at once where the OS allows it, so that no message is left behind after a crash.
+		os.Remove(file.Name())
+		if _, err = file.Write(sp.buf.Bytes()); err != nil {
+			file.Close()
+			return 0, err
+		}
+		sp.file = file
+		sp.buf = bytes.Buffer{} // Release the memory, the buffer is not needed again before Reset.
+	}
+	var n int
+	var err error
+	if sp.file != nil {
+		n, err = sp.file.Write(p)
+	} else {
+		n, err = sp.buf.Write(p)
+	}
+	sp.size += int64(n)
+	return n, err
+}
+
+// ReadAt reads the data written so far.
+func (sp *spool) ReadAt(p []byte, off int64) (int, error) {
+	if sp.file != nil {
+		return sp.file.ReadAt(p, off)
+	}
+	return bytes.NewReader(sp.buf.Bytes()).ReadAt(p, off)
+}
+
+// Len returns the number of bytes written.
+func (sp *spool) Len() int64 {
+	return sp.size
+}
+
+// Reset discards the data and the temporary file, if any.
+func (sp *spool) Reset() {
+	if sp.file != nil {
+		sp.file.Close()
+		os.Remove(sp.file.Name())
+		sp.file = nil
+	}
+	sp.buf.Reset()
+	sp.size = 0
+}
+
+// Message returns a reader of the spooled data preceded by header, as passed on to the handler.
+// It is valid until the spool is reset.
+func (sp *spool) Message(header []byte) *io.SectionReader {
+	return PrefixedReader(header, sp, sp.size)
+}
+
+// PrefixedReader returns a reader of prefix followed by the size bytes of r, e.g. header fields added to a
+// message, without copying r.
+func PrefixedReader(prefix []byte, r io.ReaderAt, size int64) *io.SectionReader {
+	return io.NewSectionReader(prefixedReaderAt{prefix, r}, 0, int64(len(prefix))+size)
+}
+
+// prefixedReaderAt reads prefix followed by the data of r.
+type prefixedReaderAt struct {
+	prefix []byte
+	r      io.ReaderAt
+}
+
+func (p prefixedReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	var n int
+	if off < int64(len(p.prefix)) {
+		n = copy(b, p.prefix[off:])
+		if n == len(b) {
+			return n, nil
+		}
+	}
+	m, err := p.r.ReadAt(b[n:], off+int64(n)-int64(len(p.prefix)))
+	return n + m, err
+}
@@ -0,0 +1,43 @@
+package smtpd
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	sp := (&Server{SpoolDir: dir, SpoolThreshold: 8}).newSpool()
+
+	io.WriteString(sp, "Hello")
+	if sp.file != nil {
+		t.Errorf("Spool of %d bytes uses a file, want memory below the threshold", sp.Len())
+	}
+	io.WriteString(sp, ", world!\r\n")
+	if sp.file == nil {
+		t.Fatalf("Spool of %d bytes uses memory, want a file above the threshold", sp.Len())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Spool file is still linked in %s, want it removed", dir)
+	}
+
+	data, err := io.ReadAll(sp.Message([]byte("Received: test\r\n")))
+	if err != nil || string(data) != "Received: test\r\nHello, world!\r\n" {
+		t.Errorf("Message() read %q, %v", data, err)
+	}
+	// Reads may start in the header and end in the data.
+	buf := make([]byte, 6)
+	if n, err := sp.Message([]byte("Received: test\r\n")).ReadAt(buf, 14); n != 6 || string(buf) != "\r\nHell" {
+		t.Errorf("ReadAt() across the header read %q, %v", buf[:n], err)
+	}
+
+	sp.Reset()
+	if sp.file != nil || sp.Len() != 0 {
+		t.Errorf("Reset() left %d bytes, file %v", sp.Len(), sp.file)
+	}
+	io.WriteString(sp, "Next")
+	if data, _ := io.ReadAll(sp.Message(nil)); string(data) != "Next" || sp.file != nil {
+		t.Errorf("Spool after Reset() read %q from file %v, want %q from memory", data, sp.file, "Next")
+	}
+}
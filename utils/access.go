@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/naive9527/mitmsmtpd/smtpd"
+)
+
+// Client access list actions.
+const (
+	AccessAllow = "allow"
+	AccessDeny  = "deny"
+)
+
+// AccessRule allows or denies the clients it lists when they connect. The first matching entry of access.rules
+// decides; clients no rule matches get access.default.
+type AccessRule struct {
+	Name    string   `yaml:"name"`
+	Action  string   `yaml:"action"`  // allow or deny
+	Clients []string `yaml:"clients"` // IP addresses, CIDR ranges and names of access.groups
+	Message string   `yaml:"message"` // deny: text of the 554 greeting, "Access denied" by default
+
+	nets []*net.IPNet
+}
+
+// accessHits counts the connections decided by each access rule, by rule name. It is kept across reloads.
+var accessHits sync.Map
+
+// compileAccess checks access and resolves the clients of its rules.
+func (cfg *Config) compileAccess() error {
+	var errs []error
+	groups := make(map[string][]*net.IPNet, len(cfg.Access.Groups))
+	for name, addrs := range cfg.Access.Groups {
+		for _, addr := range addrs {
+			ipNet, err := parseIPNet(addr)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("access.groups.%s: %w", name, err))
+				continue
+			}
+			groups[name] = append(groups[name], ipNet)
+		}
+	}
+
+	for i := range cfg.Access.Rules {
+		rule := &cfg.Access.Rules[i]
+		name := fmt.Sprintf("access.rules[%d]", i)
+		if rule.Name == "" {
+			rule.Name = name
+		} else {
+			name = fmt.Sprintf("access.rules[%d] (%s)", i, rule.Name)
+		}
+
+		switch rule.Action {
+		case AccessAllow:
+		case AccessDeny:
+			if rule.Message == "" {
+				rule.Message = "Access denied"
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s.action: unknown action %q (use allow or deny)", name, rule.Action))
+		}
+
+		rule.nets = nil
+		for _, client := range rule.Clients {
+			if group, ok := groups[client]; ok {
+				rule.nets = append(rule.nets, group...)
+				continue
+			}
+			ipNet, err := parseIPNet(client)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s.clients: %q is neither an IP address, a CIDR range nor a group", name, client))
+				continue
+			}
+			rule.nets = append(rule.nets, ipNet)
+		}
+	}
+
+	switch cfg.Access.Default {
+	case "", AccessAllow, AccessDeny:
+	default:
+		errs = append(errs, fmt.Errorf("access.default: unknown action %q (use allow or deny)", cfg.Access.Default))
+	}
+	return errors.Join(errs...)
+}
+
+// checkAccess returns the access rule that matches ip, nil if none does and the default applies.
+func (cfg *Config) checkAccess(ip net.IP) *AccessRule {
+	if ip == nil {
+		return nil
+	}
+	for i := range cfg.Access.Rules {
+		rule := &cfg.Access.Rules[i]
+		for _, ipNet := range rule.nets {
+			if ipNet.Contains(ip) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// countAccessHit increments and returns the hit counter of an access rule.
+func countAccessHit(name string) uint64 {
+	counter, _ := accessHits.LoadOrStore(name, new(atomic.Uint64))
+	return counter.(*atomic.Uint64).Add(1)
+}
+
+// AccessHits returns the number of connections decided by each access rule since the start,
+// "default" for the ones no rule matched.
+func AccessHits() map[string]uint64 {
+	hits := make(map[string]uint64)
+	accessHits.Range(func(name, counter any) bool {
+		hits[name.(string)] = counter.(*atomic.Uint64).Load()
+		return true
+	})
+	return hits
+}
+
+// LogAccessHits logs the hit counters, e.g. on shutdown.
+func LogAccessHits() {
+	hits := AccessHits()
+	for _, name := range slices.Sorted(maps.Keys(hits)) {
+		slog.Info("Access rule hits", "Rule", name, "Hits", hits[name])
+	}
+}
+
+// HandleConnect checks the client against the access list before the greeting, the TLS handshake and the
+// reverse DNS lookup. Denied clients get a 554 greeting and are disconnected before they can try to authenticate.
+// Banned clients get a 421 greeting until their ban ends.
+func (Gateway) HandleConnect(ctx context.Context, info *smtpd.SessionInfo) error {
+	if ban := BanListIns.Banned(BanIP, info.RemoteIP); ban != nil {
+		slog.Warn("Connection refused, client is banned", "SessionID", info.ID, "ClientIP", info.RemoteIP, "Until", ban.Until)
+		return smtpd.NewReply(421, "4.7.0", fmt.Sprintf("Too many failed authentication attempts, try again after %s", ban.Until.UTC().Format(time.RFC3339)))
+	}
+
+	cfg := Cfg()
+	if len(cfg.Access.Rules) == 0 && cfg.Access.Default != AccessDeny {
+		return nil
+	}
+
+	name, action, message := "default", cfg.Access.Default, "Access denied"
+	if rule := cfg.checkAccess(net.ParseIP(info.RemoteIP)); rule != nil {
+		name, action, message = rule.Name, rule.Action, rule.Message
+	}
+	hits := countAccessHit(name)
+	if action != AccessDeny {
+		return nil
+	}
+
+	reply := smtpd.NewReply(554, "5.7.1", message)
+	slog.Warn("Connection refused by access list", "SessionID", info.ID, "ClientIP", info.RemoteIP, "Rule", name, "Hits", hits)
+	return reply
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// AdminStats is the answer to GET /stats.
+type AdminStats struct {
+	Bans            int                  `json:"bans"`
+	AccessHits      map[string]uint64    `json:"accessHits"`
+	CredentialCache CredentialCacheStats `json:"credentialCache"`
+	QueuedEmails    int                  `json:"queuedEmails"`
+	UpstreamPool    *UpstreamPoolStats   `json:"upstreamPool,omitempty"` // Only if upstreamPool is enabled
+}
+
+// banRequest is the body of POST /bans.
+type banRequest struct {
+	Kind     string `json:"kind"`     // ip or user
+	Value    string `json:"value"`    // IP address or username
+	Duration int    `json:"duration"` // In seconds, 0 for the next duration of the progression
+	Reason   string `json:"reason"`
+}
+
+// ServeAdmin serves the admin interface on ln until it fails. Every request needs the header
+// "Authorization: Bearer <admin.token>".
+//
+//	GET    /bans                list the bans in force
+//	POST   /bans                ban an IP address or a username, e.g. {"kind":"ip","value":"192.0.2.1","duration":3600}
+//	DELETE /bans/{kind}/{value} lift a ban
+//	GET    /upstreams           health of the email server addresses, if smtpProbe is enabled
+//	GET    /stats               ban count, access rule hits, credential cache, queue and upstream pool statistics
+func ServeAdmin(ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /bans", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, BanListIns.List())
+	})
+	mux.HandleFunc("POST /bans", adminBan)
+	mux.HandleFunc("DELETE /bans/{kind}/{value}", func(w http.ResponseWriter, r *http.Request) {
+		if !BanListIns.Unban(r.PathValue("kind"), r.PathValue("value")) {
+			http.Error(w, "no such ban", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /upstreams", func(w http.ResponseWriter, r *http.Request) {
+		if UpstreamHealthIns == nil {
+			http.Error(w, "smtpProbe is not enabled", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, UpstreamHealthIns.List())
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := AdminStats{
+			Bans:            len(BanListIns.List()),
+			AccessHits:      AccessHits(),
+			CredentialCache: MailInfoCacheIns.Stats(),
+		}
+		if QueueIns != nil {
+			stats.QueuedEmails = QueueIns.Len()
+		}
+		if UpstreamPoolIns != nil {
+			pool := UpstreamPoolIns.Stats()
+			stats.UpstreamPool = &pool
+		}
+		writeJSON(w, http.StatusOK, stats)
+	})
+
+	srv := &http.Server{Handler: requireToken(mux), ReadHeaderTimeout: 10 * time.Second}
+	slog.Info(fmt.Sprintf("Starting admin interface on %s", ln.Addr()))
+	return srv.Serve(ln)
+}
+
+func adminBan(w http.ResponseWriter, r *http.Request) {
+	var req banRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Kind == BanIP && net.ParseIP(req.Value) == nil:
+		http.Error(w, fmt.Sprintf("invalid IP address %q", req.Value), http.StatusBadRequest)
+		return
+	case req.Kind != BanIP && req.Kind != BanUser:
+		http.Error(w, fmt.Sprintf("unknown kind %q (use ip or user)", req.Kind), http.StatusBadRequest)
+		return
+	case req.Value == "" || req.Duration < 0:
+		http.Error(w, "value is required and duration must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "banned by an administrator"
+	}
+	writeJSON(w, http.StatusCreated, BanListIns.Ban(req.Kind, req.Value, req.Reason, time.Duration(req.Duration)*time.Second))
+}
+
+// requireToken refuses requests without the admin token. The token is read on every request, so that it can be
+// changed by a reload.
+func requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := Cfg().Admin.Token
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			slog.Warn("Admin request refused", "RemoteAddr", r.RemoteAddr, "Method", r.Method, "Path", r.URL.Path)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,283 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var BanListIns *BanList
+
+// Kinds of ban.
+const (
+	BanIP   = "ip"
+	BanUser = "user"
+)
+
+// Ban keeps a client IP address from connecting, or a username from authenticating, until it expires.
+type Ban struct {
+	Kind    string    `json:"kind"`  // ip or user
+	Value   string    `json:"value"` // IP address or username
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+	Until   time.Time `json:"until"`
+	Strikes int       `json:"strikes"` // Bans so far, each one twice as long as the previous
+}
+
+// BanList is a fail2ban-like protection against password guessing. Failed AUTH attempts are counted per client
+// IP address and per username over a sliding window. Every failure delays the answer a little more (tarpitting),
+// and too many failures ban the IP address or the username for a while, longer for every further ban.
+// Bans are saved to a file, so that they survive restarts. The settings are read from bruteForce on every use.
+type BanList struct {
+	mu       sync.Mutex
+	path     string
+	failures map[string][]time.Time // Failed attempts by ban key, e.g. "ip:192.0.2.1"
+	bans     map[string]*Ban        // Bans by key; expired ones are kept for maxBanTime to remember the strikes
+	stop     chan struct{}
+}
+
+func banKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+// NewBanList creates an empty ban list saved to path, not saved if path is empty.
+func NewBanList(path string) *BanList {
+	return &BanList{
+		path:     path,
+		failures: make(map[string][]time.Time),
+		bans:     make(map[string]*Ban),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Load reads the bans saved by a previous run. A missing file is not an error.
+func (bl *BanList) Load() error {
+	if bl.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(bl.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("load bans %s failed: %w", bl.path, err)
+	}
+	var bans []*Ban
+	if err = json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("load bans %s failed: %w", bl.path, err)
+	}
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	for _, ban := range bans {
+		bl.bans[banKey(ban.Kind, ban.Value)] = ban
+	}
+	return nil
+}
+
+// save writes all bans to the file. Callers must hold mu.
+func (bl *BanList) save() {
+	if bl.path == "" {
+		return
+	}
+	bans := make([]*Ban, 0, len(bl.bans))
+	for _, ban := range bl.bans {
+		bans = append(bans, ban)
+	}
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err == nil {
+		err = writeFileSync(bl.path, data)
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("save bans %s failed: %s", bl.path, err.Error()))
+	}
+}
+
+// Banned returns the ban in force for the IP address or username, nil if there is none.
+func (bl *BanList) Banned(kind, value string) *Ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	ban := bl.bans[banKey(kind, value)]
+	if ban == nil || !ban.Until.After(time.Now()) {
+		return nil
+	}
+	copied := *ban
+	return &copied
+}
+
+// Fail records a failed AUTH attempt of user from ip, bans them if they failed too often,
+// and returns how long the answer to the client should be delayed.
+func (bl *BanList) Fail(ip, user string) time.Duration {
+	cfg := Cfg().BruteForce
+	if !cfg.Enabled {
+		return 0
+	}
+	now := time.Now()
+	window := time.Duration(cfg.Window) * time.Second
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	failures := 0
+	for _, limit := range []struct {
+		kind, value string
+		max         int
+	}{{BanIP, ip, cfg.MaxFailuresPerIP}, {BanUser, user, cfg.MaxFailuresPerUser}} {
+		if limit.value == "" {
+			continue
+		}
+		key := banKey(limit.kind, limit.value)
+		times := append(recentTimes(bl.failures[key], now.Add(-window)), now)
+		bl.failures[key] = times
+		failures = max(failures, len(times))
+		if limit.max > 0 && len(times) >= limit.max {
+			bl.ban(limit.kind, limit.value, fmt.Sprintf("%d failed AUTH attempts within %s", len(times), window), now, 0)
+		}
+	}
+
+	if cfg.TarpitDelay <= 0 {
+		return 0
+	}
+	delay := time.Duration(cfg.TarpitDelay) * time.Millisecond
+	maxDelay := time.Duration(cfg.MaxTarpitDelay) * time.Millisecond
+	for i := 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+// Succeed forgets the failed attempts of user and ip after a successful AUTH.
+func (bl *BanList) Succeed(ip, user string) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	delete(bl.failures, banKey(BanIP, ip))
+	delete(bl.failures, banKey(BanUser, user))
+}
+
+// Ban bans the IP address or username for d, or for the next duration of the progression if d is 0.
+func (bl *BanList) Ban(kind, value, reason string, d time.Duration) Ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	return *bl.ban(kind, value, reason, time.Now(), d)
+}
+
+// ban creates or extends a ban and saves the list. Callers must hold mu.
+func (bl *BanList) ban(kind, value, reason string, now time.Time, d time.Duration) *Ban {
+	key := banKey(kind, value)
+	ban := &Ban{Kind: kind, Value: value, Reason: reason, Created: now, Strikes: 1}
+	if prev := bl.bans[key]; prev != nil {
+		ban.Strikes = prev.Strikes + 1
+	}
+	if d <= 0 {
+		cfg := Cfg().BruteForce
+		d = time.Duration(cfg.BanTime) * time.Second
+		maxBan := time.Duration(cfg.MaxBanTime) * time.Second
+		for i := 1; i < ban.Strikes && d < maxBan; i++ {
+			d *= 2
+		}
+		d = min(d, maxBan)
+	}
+	ban.Until = now.Add(d)
+	bl.bans[key] = ban
+	delete(bl.failures, key)
+	bl.save()
+
+	slog.Warn("Banned", "Kind", kind, "Value", value, "Until", ban.Until, "Strikes", ban.Strikes, "Reason", reason)
+	return ban
+}
+
+// Unban lifts the ban of the IP address or username and forgets its strikes and failed attempts.
+// It reports whether there was a ban.
+func (bl *BanList) Unban(kind, value string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	key := banKey(kind, value)
+	delete(bl.failures, key)
+	if _, ok := bl.bans[key]; !ok {
+		return false
+	}
+	delete(bl.bans, key)
+	bl.save()
+	slog.Info("Unbanned", "Kind", kind, "Value", value)
+	return true
+}
+
+// List returns the bans in force, the ones ending first first.
+func (bl *BanList) List() []Ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	now := time.Now()
+	bans := []Ban{}
+	for _, ban := range bl.bans {
+		if ban.Until.After(now) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// StartJanitor periodically drops the failed attempts outside the window and the bans whose strikes
+// no longer count, until Close is called.
+func (bl *BanList) StartJanitor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-bl.stop:
+				return
+			case now := <-ticker.C:
+				bl.expire(now)
+			}
+		}
+	}()
+}
+
+// Close stops the janitor.
+func (bl *BanList) Close() {
+	select {
+	case <-bl.stop:
+	default:
+		close(bl.stop)
+	}
+}
+
+func (bl *BanList) expire(now time.Time) {
+	cfg := Cfg().BruteForce
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	for key, times := range bl.failures {
+		if times = recentTimes(times, now.Add(-time.Duration(cfg.Window)*time.Second)); len(times) == 0 {
+			delete(bl.failures, key)
+		} else {
+			bl.failures[key] = times
+		}
+	}
+
+	// 过期的封禁保留 maxBanTime，期间再次被封禁时封禁时间加倍
+	changed := false
+	for key, ban := range bl.bans {
+		if now.Sub(ban.Until) > time.Duration(cfg.MaxBanTime)*time.Second {
+			delete(bl.bans, key)
+			changed = true
+		}
+	}
+	if changed {
+		bl.save()
+	}
+}
+
+// recentTimes drops the times before cutoff from the sorted list.
+func recentTimes(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func useBruteForceConfig(t *testing.T) {
+	t.Helper()
+	cfg := &Config{}
+	cfg.BruteForce.Enabled = true
+	cfg.BruteForce.Window = 600
+	cfg.BruteForce.MaxFailuresPerIP = 3
+	cfg.BruteForce.MaxFailuresPerUser = 20
+	cfg.BruteForce.BanTime = 60
+	cfg.BruteForce.MaxBanTime = 240
+	cfg.BruteForce.TarpitDelay = 100
+	cfg.BruteForce.MaxTarpitDelay = 300
+	useConfig(t, cfg)
+}
+
+// failUntilBanned fails AUTH from ip until it is banned and returns the ban.
+func failUntilBanned(t *testing.T, bl *BanList, ip string) *Ban {
+	t.Helper()
+	for i := 0; i < 3; i++ {
+		bl.Fail(ip, "user@example.com")
+	}
+	ban := bl.Banned(BanIP, ip)
+	if ban == nil {
+		t.Fatalf("%s not banned after 3 failures", ip)
+	}
+	return ban
+}
+
+// liftBan makes the ban of ip end now, as if its time had passed.
+func liftBan(bl *BanList, ip string) {
+	bl.mu.Lock()
+	bl.bans[banKey(BanIP, ip)].Until = time.Now().Add(-time.Second)
+	bl.mu.Unlock()
+}
+
+func TestBanListEscalation(t *testing.T) {
+	useBruteForceConfig(t)
+	bl := NewBanList("")
+
+	// Every failure is answered later, up to maxTarpitDelay.
+	for i, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		if delay := bl.Fail("192.0.2.1", "user@example.com"); delay != want {
+			t.Errorf("failure %d delayed %s, want %s", i+1, delay, want)
+		}
+		if bl.Banned(BanIP, "192.0.2.1") != nil {
+			t.Fatalf("banned after %d failures", i+1)
+		}
+	}
+	if delay := bl.Fail("192.0.2.1", "user@example.com"); delay != 300*time.Millisecond {
+		t.Errorf("third failure delayed %s, want 300ms", delay)
+	}
+
+	// Every further ban lasts twice as long, up to maxBanTime.
+	ban := bl.Banned(BanIP, "192.0.2.1")
+	for strike, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		if strike > 0 {
+			liftBan(bl, "192.0.2.1")
+			if bl.Banned(BanIP, "192.0.2.1") != nil {
+				t.Fatal("ban still in force after its end")
+			}
+			ban = failUntilBanned(t, bl, "192.0.2.1")
+		}
+		if ban == nil || ban.Strikes != strike+1 || ban.Until.Sub(ban.Created) != want {
+			t.Errorf("ban %d is %+v, want it for %s", strike+1, ban, want)
+		}
+	}
+	if bl.Banned(BanUser, "user@example.com") != nil {
+		t.Error("user banned below maxFailuresPerUser")
+	}
+
+	// A successful AUTH forgets the failures.
+	bl.Fail("192.0.2.2", "other@example.com")
+	bl.Fail("192.0.2.2", "other@example.com")
+	bl.Succeed("192.0.2.2", "other@example.com")
+	bl.Fail("192.0.2.2", "other@example.com")
+	if bl.Banned(BanIP, "192.0.2.2") != nil {
+		t.Error("banned for failures before a successful AUTH")
+	}
+}
+
+func TestBanListExpiry(t *testing.T) {
+	useBruteForceConfig(t)
+	path := filepath.Join(t.TempDir(), "bans.json")
+	bl := NewBanList(path)
+
+	// Failures outside the window no longer count.
+	bl.Fail("192.0.2.2", "user@example.com")
+	bl.Fail("192.0.2.2", "user@example.com")
+	bl.expire(time.Now().Add(11 * time.Minute))
+	bl.Fail("192.0.2.2", "user@example.com")
+	if bl.Banned(BanIP, "192.0.2.2") != nil {
+		t.Error("banned for failures outside the window")
+	}
+
+	// Bans survive a restart.
+	failUntilBanned(t, bl, "192.0.2.1")
+	restarted := NewBanList(path)
+	if err := restarted.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Banned(BanIP, "192.0.2.1") == nil {
+		t.Fatal("ban lost on restart")
+	}
+
+	// The strikes of an ended ban are kept for maxBanTime, then forgotten.
+	liftBan(restarted, "192.0.2.1")
+	restarted.expire(time.Now())
+	if ban := failUntilBanned(t, restarted, "192.0.2.1"); ban.Strikes != 2 {
+		t.Errorf("ban after a recent one has %d strikes, want 2", ban.Strikes)
+	}
+	liftBan(restarted, "192.0.2.1")
+	restarted.expire(time.Now().Add(5 * time.Minute))
+	if len(restarted.List()) != 0 {
+		t.Errorf("List() = %v after the bans ended", restarted.List())
+	}
+	if ban := failUntilBanned(t, restarted, "192.0.2.1"); ban.Strikes != 1 {
+		t.Errorf("ban long after the previous one has %d strikes, want 1", ban.Strikes)
+	}
+}
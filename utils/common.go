@@ -10,8 +10,11 @@ import (
 	"strings"
 )
 
-func Xlog(logPath string, logName string) *slog.Logger {
-	file, _ := os.OpenFile(filepath.Join(logPath, logName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+func Xlog(logPath string, logName string) (*slog.Logger, error) {
+	file, err := os.OpenFile(filepath.Join(logPath, logName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open log file failed: %w", err)
+	}
 	// defer file.Close()
 
 	// 创建组合输出流（文件 + 控制台）
@@ -27,7 +30,7 @@ func Xlog(logPath string, logName string) *slog.Logger {
 	//      slog.Info("日志轮转测试", "count", i)
 	// }
 
-	return logger
+	return logger, nil
 }
 
 func GetIPFromAddr(addr net.Addr) (string, error) {
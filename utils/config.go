@@ -1,17 +1,21 @@
 package utils
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"log/slog"
+	"io"
+	"net"
 	"os"
-	"regexp"
-	"sync"
+	"slices"
+	"sync/atomic"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
-var CFG Config // Global configuration instance
+var cfgPtr atomic.Pointer[Config] // Global configuration instance, swapped atomically on reload
 
 type User struct {
 	Username string `yaml:"username"`
@@ -26,28 +30,125 @@ type EmailServerItem struct {
 	Server         string `yaml:"server"`
 	Port           int    `yaml:"port"`
 	AuthMechanisms string `yaml:"authMechanisms"`
+	AddressFamily  string `yaml:"addressFamily"` // Addresses of server to use: ipv4-only, ipv6-only, prefer-v4 (default) or prefer-v6
+
+	TLS               string   `yaml:"tls"`               // none, starttls (default), required or implicit, see upstreamtls.go
+	TLSMinVersion     string   `yaml:"tlsMinVersion"`     // 1.0, 1.1, 1.2 (default) or 1.3
+	CAFile            string   `yaml:"caFile"`            // PEM bundle of the CAs that verify the server certificate instead of the system ones
+	PinnedCerts       []string `yaml:"pinnedCerts"`       // SHA-256 fingerprints (hex) of certificates, one of which the server must present
+	PinnedKeys        []string `yaml:"pinnedKeys"`        // Base64 SHA-256 digests of public keys (SPKI), one of which the server must present
+	AllowInsecureAuth bool     `yaml:"allowInsecureAuth"` // Send AUTH over an unencrypted connection, refused by default
+
+	tlsConfig *tls.Config // Compiled from the settings above
 }
 
+// Address family preferences of an emailServer entry. With prefer-v4 and prefer-v6 the addresses of both families
+// are tried, alternating and starting with the preferred one.
+const (
+	AddressFamilyIPv4Only = "ipv4-only"
+	AddressFamilyIPv6Only = "ipv6-only"
+	AddressFamilyPreferV4 = "prefer-v4"
+	AddressFamilyPreferV6 = "prefer-v6"
+)
+
 type Config struct {
 	SmptdServer struct {
-		Address  string `yaml:"address"`  // Service listening address
-		Debug    bool   `yaml:"debug"`    // Enable debug mode
+		Address  string `yaml:"address"`  // Service listening address, unless listeners are configured
+		Debug    bool   `yaml:"debug"`    // Enable debug mode, logs the SMTP conversation of every session without the AUTH credentials
 		Appname  string `yaml:"appname"`  // Server application name
 		Hostname string `yaml:"hostname"` // Server hostname (empty for auto-detection)
+
+		MaxSize           int      `yaml:"maxSize"`           // Largest email accepted, in bytes, advertised with SIZE (0 = no limit)
+		MaxRecipients     int      `yaml:"maxRecipients"`     // Recipients per email, 100 by default
+		Timeout           int      `yaml:"timeout"`           // Close sessions idle for this long, in seconds, 300 by default
+		ShutdownTimeout   int      `yaml:"shutdownTimeout"`   // On SIGTERM, wait this long for sessions and deliveries to finish, in seconds, 30 by default
+		DisableReverseDNS bool     `yaml:"disableReverseDNS"` // Do not look up the client hostname, the Received header shows "unknown"
+		XClientAllowed    []string `yaml:"xclientAllowed"`    // IP addresses of proxies allowed to send XCLIENT
+		SpoolDir          string   `yaml:"spoolDir"`          // Directory of the temporary files holding large emails while they are received and relayed, the system temporary directory by default
+		SpoolThreshold    int      `yaml:"spoolThreshold"`    // Emails larger than this, in bytes, are held in a temporary file instead of memory, 1 MiB by default
+
+		ProxyProtocol []string `yaml:"proxyProtocol"` // IP addresses or CIDR ranges of load balancers that send a PROXY protocol header
 	} `yaml:"smptdServer"`
 
+	// Listeners accept SMTP connections, each with its own TLS and AUTH requirements, see listener.go.
+	// Without any, a single listener is derived from smptdServer.address, smtpdTLS.enabled and smtpdAuth.required.
+	Listeners []Listener `yaml:"listeners"`
+
+	// Limits are converted into smtpd.Limits, so the fields must stay the same. 0 means no limit.
+	Limits struct {
+		MaxConnections       int `yaml:"maxConnections"`       // Concurrent connections in total
+		MaxConnectionsPerIP  int `yaml:"maxConnectionsPerIP"`  // Concurrent connections per client IP address
+		MaxMessages          int `yaml:"maxMessages"`          // Messages per session
+		MaxRecipientsPerHour int `yaml:"maxRecipientsPerHour"` // Recipients per authenticated user over the last hour
+		MaxAuthFailures      int `yaml:"maxAuthFailures"`      // Rejected AUTH credentials before the session is closed
+		MaxCommands          int `yaml:"maxCommands"`          // Commands per session
+	} `yaml:"limits"`
+
+	BruteForce struct {
+		Enabled            bool   `yaml:"enabled"`            // Ban clients that fail AUTH too often
+		Path               string `yaml:"path"`               // File the bans are saved to, so that they survive restarts
+		Window             int    `yaml:"window"`             // Failed AUTH attempts are counted over this sliding window, in seconds
+		MaxFailuresPerIP   int    `yaml:"maxFailuresPerIP"`   // Failures from one IP address in the window before it is banned (0 = never)
+		MaxFailuresPerUser int    `yaml:"maxFailuresPerUser"` // Failures for one username in the window before it is banned (0 = never)
+		BanTime            int    `yaml:"banTime"`            // Duration of the first ban, doubled for every further ban, in seconds
+		MaxBanTime         int    `yaml:"maxBanTime"`         // Upper limit of the ban duration, in seconds; strikes are forgotten this long after a ban ends
+		TarpitDelay        int    `yaml:"tarpitDelay"`        // Delay of the answer to a failed AUTH, doubled for every further failure, in milliseconds
+		MaxTarpitDelay     int    `yaml:"maxTarpitDelay"`     // Upper limit of the delay, in milliseconds
+	} `yaml:"bruteForce"`
+
+	Admin struct {
+		Address string `yaml:"address"` // Listening address of the admin HTTP interface, e.g. "127.0.0.1:8026" (empty = disabled)
+		Token   string `yaml:"token"`   // Bearer token required by the admin interface
+	} `yaml:"admin"`
+
 	SmtpProbe struct {
-		Enable        bool `yaml:"enable"`        // 是否开启探测
-		RetryInterval int  `yaml:"retryInterval"` // 探测失败重试间隔，单位：秒
-		MaxRetry      int  `yaml:"maxRetry"`      // 最大重试次数
+		Enable        bool `yaml:"enable"`        // 是否开启探测，在后台定期探测 emailServer 的所有地址
+		Interval      int  `yaml:"interval"`      // 探测间隔，单位：秒，默认 30
+		Timeout       int  `yaml:"timeout"`       // 单次 DNS 解析和探测的超时，单位：秒，默认 5
+		EHLO          bool `yaml:"ehlo"`          // 除 TCP 连接外，还要求服务器返回 220 问候并响应 EHLO
+		RetryInterval int  `yaml:"retryInterval"` // Deprecated: 未设置 interval 时用作探测间隔
+		MaxRetry      int  `yaml:"maxRetry"`      // Deprecated: 不再使用，发送邮件时不再等待探测
 	} `yaml:"smtpProbe"`
 
+	Queue struct {
+		Enabled        bool   `yaml:"enabled"`        // Spool accepted emails and deliver them in the background
+		Path           string `yaml:"path"`           // Spool directory
+		KeyFile        string `yaml:"keyFile"`        // Key sealing the passwords stored with queued emails, queue.key in path by default
+		Workers        int    `yaml:"workers"`        // Number of delivery workers
+		ScanInterval   int    `yaml:"scanInterval"`   // Spool scan interval, in seconds
+		InitialBackoff int    `yaml:"initialBackoff"` // Delay before the first retry, doubled after every failure, in seconds
+		MaxBackoff     int    `yaml:"maxBackoff"`     // Upper limit of the retry delay, in seconds
+		MaxAge         int    `yaml:"maxAge"`         // Give up and notify administrators after this long, in seconds
+		DSN            bool   `yaml:"dsn"`            // Send delivery status notifications to the sender when delivery fails or is delayed, also for the recipients refused when relaying synchronously
+		DelayWarning   int    `yaml:"delayWarning"`   // Send a delay DSN once an email has been queued this long, in seconds (0 = never)
+	} `yaml:"queue"`
+
+	UpstreamPool struct {
+		Enabled     bool `yaml:"enabled"`     // Keep authenticated upstream connections open and reuse them, per emailServer and account
+		MaxIdle     int  `yaml:"maxIdle"`     // Idle connections kept per account, 2 by default
+		MaxActive   int  `yaml:"maxActive"`   // Emails relayed at the same time per account, the others wait (0 = no limit)
+		MaxMessages int  `yaml:"maxMessages"` // Emails per connection, then it is closed, 100 by default
+		IdleTimeout int  `yaml:"idleTimeout"` // Close connections idle for this long, in seconds, 60 by default
+		HealthCheck int  `yaml:"healthCheck"` // Check connections idle for this long with NOOP before reusing them, in seconds, 10 by default
+	} `yaml:"upstreamPool"`
+
 	SmtpdAuth struct {
 		Mechanisms   map[string]bool `yaml:"mechanisms"`   // Supported authentication mechanisms
 		Required     bool            `yaml:"required"`     // Authentication required
 		AllowAnyAuth bool            `yaml:"allowAnyAuth"` // Authentication required
+
+		VerifyUpstream bool `yaml:"verifyUpstream"` // Verify credentials against the upstream server during AUTH
+		VerifyCacheTTL int  `yaml:"verifyCacheTTL"` // How long a successful upstream verification is trusted, in seconds
+
+		SenderPolicy  string              `yaml:"senderPolicy"`  // How MAIL FROM must relate to the authenticated user: exact, domain or any
+		SenderAliases map[string][]string `yaml:"senderAliases"` // Extra sender addresses (or @domain) allowed per username
 	} `yaml:"smtpdAuth"`
 
+	CredentialCache struct {
+		IdleTTL     int `yaml:"idleTTL"`     // Drop cached credentials not used for this long, in seconds (0 = never)
+		AbsoluteTTL int `yaml:"absoluteTTL"` // Drop cached credentials this long after login, in seconds (0 = never)
+	} `yaml:"credentialCache"`
+
 	SmtpdTLS struct {
 		TLSEnabled bool   `yaml:"enabled"` // Enable TLS
 		Cert       string `yaml:"cert"`    // Path to TLS certificate
@@ -62,84 +163,258 @@ type Config struct {
 	UserDB      map[string]string          `yaml:"userDB"` // User database (username/password pairs)
 	EmailServer map[string]EmailServerItem `yaml:"emailServer"`
 
-	VerificationRules struct {
-		Sender          string         `yaml:"sender"`
-		Recipient       string         `yaml:"recipient"`
-		SenderIP        string         `yaml:"senderIP"`
-		EmailBodySize   int            `yaml:"emailBodySize"`
-		Attachment      AttachmentRule `yaml:"attachment"`
-		EmbeddedContent AttachmentRule `yaml:"embeddedContent"`
+	Rules      []Rule `yaml:"rules"` // Ordered policy rules, see rules.go
+	Quarantine struct {
+		Path string `yaml:"path"` // Directory for emails quarantined by rules
+	} `yaml:"quarantine"`
+
+	VerificationRules *VerificationRules `yaml:"verificationRules"` // Legacy global policy, converted into rules; nil if absent
 
-		SenderRegexp    *regexp.Regexp `yaml:"-"`
-		RecipientRegexp *regexp.Regexp `yaml:"-"`
-		SenderIPRegexp  *regexp.Regexp `yaml:"-"`
-	} `yaml:"verificationRules"`
+	Access struct {
+		Groups  map[string][]string `yaml:"groups"`  // Named lists of IP addresses and CIDR ranges
+		Rules   []AccessRule        `yaml:"rules"`   // Checked in order when a client connects, the first match decides
+		Default string              `yaml:"default"` // allow (default) or deny, for clients no rule matches
+	} `yaml:"access"`
 
 	Notification struct {
 		// Other  *NotificationOtherStruct `yaml:"other"`
 		Email *NotificationEmailStruct `yaml:"email"`
 	} `yaml:"notification"`
+
+	rules []Rule // Rules followed by the converted verificationRules
+}
+
+type VerificationRules struct {
+	Sender          string         `yaml:"sender"`
+	Recipient       string         `yaml:"recipient"`
+	SenderIP        string         `yaml:"senderIP"` // Deprecated: regexp over the textual IP, use access or the clientIP rule condition
+	EmailBodySize   int            `yaml:"emailBodySize"`
+	Attachment      AttachmentRule `yaml:"attachment"`
+	EmbeddedContent AttachmentRule `yaml:"embeddedContent"`
+}
+
+// Cfg returns the configuration currently in force.
+// Callers should take one snapshot per unit of work, so that a reload never mixes old and new settings.
+func Cfg() *Config {
+	return cfgPtr.Load()
 }
 
-func InitConfig() {
-	data, err := os.ReadFile("config.yaml")
+// InitConfig loads and validates the configuration file and initializes the package state that depends on it.
+func InitConfig(path string) error {
+	cfg, err := LoadConfig(path)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	if err = CertStoreIns.Load(cfg); err != nil {
+		return err
+	}
+	cfgPtr.Store(cfg)
+
+	MailInfoCacheIns = NewMailInfoCache(
+		time.Duration(cfg.CredentialCache.IdleTTL)*time.Second,
+		time.Duration(cfg.CredentialCache.AbsoluteTTL)*time.Second)
+	BanListIns = NewBanList(cfg.BruteForce.Path)
+	return BanListIns.Load()
+}
 
-	err = yaml.Unmarshal(data, &CFG)
+// LoadConfig reads the configuration file strictly: unknown keys, invalid regular expressions,
+// unreadable TLS files and incomplete emailServer routes are all reported as errors.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	CFG.VerificationRules.SenderRegexp, _ = regexp.Compile(CFG.VerificationRules.Sender)
-	CFG.VerificationRules.RecipientRegexp, _ = regexp.Compile(CFG.VerificationRules.Recipient)
-	CFG.VerificationRules.SenderIPRegexp, _ = regexp.Compile(CFG.VerificationRules.SenderIP)
+	cfg := new(Config)
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err = dec.Decode(cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parse %s failed: %w", path, err)
+	}
 
+	if err = cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration %s:\n%w", path, err)
+	}
+	return cfg, nil
 }
 
-func init() {
-	InitConfig()
-	MailInfoCacheIns = NewMailInfoCache()
-}
+// validate checks the configuration and compiles its regular expressions. All problems are reported at once.
+func (cfg *Config) validate() error {
+	var errs []error
 
-// It is used to store the username and password for client login, so as to forward the email after verification is passed.
-type MailInfoCache struct {
-	mu       sync.RWMutex
-	UserInfo map[string]string
-}
+	if err := cfg.compileListeners(); err != nil {
+		errs = append(errs, err)
+	}
 
-func NewMailInfoCache() *MailInfoCache {
-	return &MailInfoCache{
-		UserInfo: make(map[string]string),
+	cfg.rules = append(slices.Clone(cfg.Rules), cfg.legacyRules()...)
+	for i := range cfg.rules {
+		rule := &cfg.rules[i]
+		name := fmt.Sprintf("rules[%d]", i)
+		if i >= len(cfg.Rules) {
+			name = rule.Name
+		} else if rule.Name != "" {
+			name = fmt.Sprintf("rules[%d] (%s)", i, rule.Name)
+		}
+		if err := rule.compile(name, cfg); err != nil {
+			errs = append(errs, err)
+		}
+		if rule.Action == ActionQuarantine && cfg.Quarantine.Path == "" {
+			errs = append(errs, fmt.Errorf("%s.action: quarantine needs quarantine.path", name))
+		}
 	}
-}
 
-func (mailInfo *MailInfoCache) GetUserPass(username string) (string, error) {
-	mailInfo.mu.RLock()
-	defer mailInfo.mu.RUnlock()
+	if cfg.SmtpdTLS.TLSEnabled {
+		if _, err := tls.LoadX509KeyPair(cfg.SmtpdTLS.Cert, cfg.SmtpdTLS.Key); err != nil {
+			errs = append(errs, fmt.Errorf("smtpdTLS: cannot load cert %q and key %q: %w", cfg.SmtpdTLS.Cert, cfg.SmtpdTLS.Key, err))
+		}
+	}
 
-	if passwd, ok := mailInfo.UserInfo[username]; ok {
-		return passwd, nil
+	for mech := range cfg.SmtpdAuth.Mechanisms {
+		if !isAuthMechanism(mech) {
+			errs = append(errs, fmt.Errorf("smtpdAuth.mechanisms: unsupported mechanism %q (use LOGIN, PLAIN or CRAM-MD5)", mech))
+		}
+	}
+	switch cfg.SmtpdAuth.SenderPolicy {
+	case "", "exact", "domain", "any":
+	default:
+		errs = append(errs, fmt.Errorf("smtpdAuth.senderPolicy: unknown policy %q (use exact, domain or any)", cfg.SmtpdAuth.SenderPolicy))
 	}
-	info := fmt.Sprintf("user %s password cannot be obtained", username)
-	slog.Error(info)
-	return "", errors.New(info)
-}
 
-func (mailInfo *MailInfoCache) SetUserPass(username, passwd string) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			info := fmt.Sprintf("panic in SetUserPass: %s %v", username, r)
-			slog.Error(info)
-			err = errors.New(info)
+	for domain, item := range cfg.EmailServer {
+		if item.Server == "" {
+			errs = append(errs, fmt.Errorf("emailServer.%s.server: missing", domain))
+		}
+		if item.Port <= 0 || item.Port > 65535 {
+			errs = append(errs, fmt.Errorf("emailServer.%s.port: invalid port %d", domain, item.Port))
+		}
+		if !isAuthMechanism(item.AuthMechanisms) {
+			errs = append(errs, fmt.Errorf("emailServer.%s.authMechanisms: unsupported mechanism %q (use LOGIN, PLAIN or CRAM-MD5)", domain, item.AuthMechanisms))
+		}
+		switch item.AddressFamily {
+		case "":
+			item.AddressFamily = AddressFamilyPreferV4
+		case AddressFamilyIPv4Only, AddressFamilyIPv6Only, AddressFamilyPreferV4, AddressFamilyPreferV6:
+		default:
+			errs = append(errs, fmt.Errorf("emailServer.%s.addressFamily: unknown preference %q (use ipv4-only, ipv6-only, prefer-v4 or prefer-v6)", domain, item.AddressFamily))
 		}
-	}()
+		if err := item.compileTLS(domain); err != nil {
+			errs = append(errs, err)
+		}
+		cfg.EmailServer[domain] = item
+	}
+
+	server := &cfg.SmptdServer
+	if server.MaxRecipients == 0 {
+		server.MaxRecipients = 100
+	}
+	if server.Timeout == 0 {
+		server.Timeout = 300
+	}
+	if server.ShutdownTimeout == 0 {
+		server.ShutdownTimeout = 30
+	}
+	if server.MaxSize < 0 || server.MaxRecipients < 0 || server.Timeout < 0 || server.ShutdownTimeout < 0 || server.SpoolThreshold < 0 {
+		errs = append(errs, errors.New("smptdServer: maxSize, maxRecipients, timeout, shutdownTimeout and spoolThreshold must not be negative"))
+	}
+	if server.SpoolDir != "" {
+		if info, err := os.Stat(server.SpoolDir); err != nil {
+			errs = append(errs, fmt.Errorf("smptdServer.spoolDir: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("smptdServer.spoolDir: %s is not a directory", server.SpoolDir))
+		}
+	}
+	for _, addr := range server.XClientAllowed {
+		if net.ParseIP(addr) == nil {
+			errs = append(errs, fmt.Errorf("smptdServer.xclientAllowed: invalid IP address %q", addr))
+		}
+	}
+
+	limits := cfg.Limits
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"maxConnections", limits.MaxConnections}, {"maxConnectionsPerIP", limits.MaxConnectionsPerIP},
+		{"maxMessages", limits.MaxMessages}, {"maxRecipientsPerHour", limits.MaxRecipientsPerHour},
+		{"maxAuthFailures", limits.MaxAuthFailures}, {"maxCommands", limits.MaxCommands},
+	} {
+		if limit.value < 0 {
+			errs = append(errs, fmt.Errorf("limits.%s: %d is negative (use 0 for no limit)", limit.name, limit.value))
+		}
+	}
+
+	bf := &cfg.BruteForce
+	if bf.Window == 0 {
+		bf.Window = 600
+	}
+	if bf.BanTime == 0 {
+		bf.BanTime = 900
+	}
+	if bf.MaxBanTime == 0 {
+		bf.MaxBanTime = 86400
+	}
+	if bf.MaxTarpitDelay == 0 {
+		bf.MaxTarpitDelay = 8000
+	}
+	if bf.Window < 0 || bf.MaxFailuresPerIP < 0 || bf.MaxFailuresPerUser < 0 || bf.BanTime < 0 || bf.MaxBanTime < bf.BanTime || bf.TarpitDelay < 0 || bf.MaxTarpitDelay < 0 {
+		errs = append(errs, errors.New("bruteForce: durations and limits must not be negative, and maxBanTime must not be less than banTime"))
+	}
+	if cfg.Admin.Address != "" && len(cfg.Admin.Token) < 16 {
+		errs = append(errs, errors.New("admin.token: at least 16 characters are required when admin.address is set"))
+	}
+
+	if err := cfg.compileAccess(); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, addr := range cfg.SmptdServer.ProxyProtocol {
+		if _, err := parseIPNet(addr); err != nil {
+			errs = append(errs, fmt.Errorf("smptdServer.proxyProtocol: %w", err))
+		}
+	}
+	if cfg.Queue.Enabled && cfg.Queue.Path == "" {
+		errs = append(errs, errors.New("queue.path: missing"))
+	}
+	probe := &cfg.SmtpProbe
+	if probe.Interval == 0 {
+		probe.Interval = 30
+		if probe.RetryInterval > 0 {
+			probe.Interval = probe.RetryInterval
+		}
+	}
+	if probe.Timeout == 0 {
+		probe.Timeout = 5
+	}
+	if probe.Interval < 0 || probe.Timeout < 0 {
+		errs = append(errs, errors.New("smtpProbe: interval and timeout must not be negative"))
+	}
 
-	if curPasswd, err := mailInfo.GetUserPass(username); err != nil || curPasswd != passwd {
-		mailInfo.mu.Lock()
-		defer mailInfo.mu.Unlock()
-		mailInfo.UserInfo[username] = passwd
+	pool := &cfg.UpstreamPool
+	if pool.MaxIdle == 0 {
+		pool.MaxIdle = 2
+	}
+	if pool.MaxMessages == 0 {
+		pool.MaxMessages = 100
+	}
+	if pool.IdleTimeout == 0 {
+		pool.IdleTimeout = 60
+	}
+	if pool.HealthCheck == 0 {
+		pool.HealthCheck = 10
+	}
+	if pool.MaxIdle < 0 || pool.MaxActive < 0 || pool.MaxMessages < 0 || pool.IdleTimeout < 0 || pool.HealthCheck < 0 {
+		errs = append(errs, errors.New("upstreamPool: maxIdle, maxActive, maxMessages, idleTimeout and healthCheck must not be negative"))
 	}
-	return nil
+	if email := cfg.Notification.Email; email != nil && email.Enabled && (email.Server == "" || email.From == "") {
+		errs = append(errs, errors.New("notification.email: server and from are required when enabled"))
+	}
+	if cfg.Queue.DSN && (cfg.Notification.Email == nil || !cfg.Notification.Email.Enabled) {
+		errs = append(errs, errors.New("queue.dsn: DSNs are sent through notification.email, which is not enabled"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func isAuthMechanism(mech string) bool {
+	return mech == "LOGIN" || mech == "PLAIN" || mech == "CRAM-MD5"
 }
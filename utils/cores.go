@@ -1,30 +1,62 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"log/slog"
-	"net"
+	"mime"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/emersion/go-message"
+	"github.com/naive9527/mitmsmtpd/smtpd"
+
 	gomsgmail "github.com/emersion/go-message/mail"
 )
 
 var MailInfoCacheIns *MailInfoCache
 
-func hashSubject(data []byte) uint64 {
-	h := fnv.New64a()
-	h.Write(data)
-	return h.Sum64()
+var errMalformedMessage = smtpd.NewReply(554, "5.6.0", "The email could not be parsed")
+
+var errAuthRequired = smtpd.NewReply(530, "5.7.0", "Authentication required to relay email")
+
+// Gateway is the smtpd.SessionHandler of mitmsmtpd: it authenticates users, validates their emails and relays them.
+type Gateway struct{}
+
+func (Gateway) HandleAuth(ctx context.Context, info *smtpd.SessionInfo, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
+	return AuthHandler(ctx, info, mechanism, username, password, shared)
+}
+
+func (Gateway) HandleMailFrom(ctx context.Context, info *smtpd.SessionInfo, from string) error {
+	return MailFromHandler(ctx, info, from)
+}
+
+func (Gateway) HandleRcpt(ctx context.Context, info *smtpd.SessionInfo, from string, to string) error {
+	return RcptHandler(ctx, info, from, to)
+}
+
+func (Gateway) HandleMail(ctx context.Context, info *smtpd.SessionInfo, from string, to []string, data []byte) (string, error) {
+	return MailHandler(ctx, info, from, to, bytes.NewReader(data))
+}
+
+// HandleMailStream is called instead of HandleMail: the email is read from the spool of the session,
+// so that large emails are never held in memory.
+func (Gateway) HandleMailStream(ctx context.Context, info *smtpd.SessionInfo, from string, to []string, data *io.SectionReader) (string, error) {
+	return MailHandler(ctx, info, from, to, data)
+}
+
+func (Gateway) HandleLogout(ctx context.Context, info *smtpd.SessionInfo) {
+	LogoutHandler(ctx, info)
 }
 
-func AuthHandler(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (ok bool, err error) { // 使用命名返回值
+func AuthHandler(ctx context.Context, info *smtpd.SessionInfo, mechanism string, username []byte, password []byte, shared []byte) (ok bool, err error) { // 使用命名返回值
 	defer func() {
 		if r := recover(); r != nil {
 			info := fmt.Sprintf("AuthHandler panic: %v", r)
@@ -33,22 +65,50 @@ func AuthHandler(remoteAddr net.Addr, mechanism string, username []byte, passwor
 		}
 	}()
 
+	cfg := Cfg()
 	// mechanism = strings.ToLower(mechanism)
-	value, ok := CFG.SmtpdAuth.Mechanisms[mechanism]
+	value, ok := cfg.SmtpdAuth.Mechanisms[mechanism]
 	if !(ok && value) {
-		slog.Warn(fmt.Sprintf("Unsupported authentication method %s", mechanism))
+		slog.Warn(fmt.Sprintf("Unsupported authentication method %s", mechanism), "SessionID", info.ID, "ClientIP", info.RemoteIP)
 		return false, nil
 	}
 	user := string(username)
 	pass := string(password)
 
+	if ban := BanListIns.Banned(BanUser, user); ban != nil {
+		slog.Warn("Authentication refused, user is banned", "SessionID", info.ID, "ClientIP", info.RemoteIP, "Username", user, "Until", ban.Until)
+		tarpit(ctx, BanListIns.Fail(info.RemoteIP, ""))
+		return false, nil
+	}
+	defer func() {
+		if ok {
+			BanListIns.Succeed(info.RemoteIP, user)
+		} else if err == nil {
+			tarpit(ctx, BanListIns.Fail(info.RemoteIP, user))
+		}
+	}()
+
 	// check username and password
-	if CFG.SmtpdAuth.AllowAnyAuth {
+	if cfg.SmtpdAuth.VerifyUpstream {
+		// CRAM-MD5 only yields a digest, which cannot be replayed to the upstream server.
+		if mechanism == "CRAM-MD5" {
+			slog.Error("CRAM-MD5 cannot be verified upstream", "Username", user)
+			return false, nil
+		}
+		ok, err = VerifyUpstreamAuth(user, pass)
+		if err != nil || !ok {
+			slog.Error(fmt.Sprintf("Upstream authentication failed method %s", mechanism), "Username", user)
+			return false, err
+		}
+		MailInfoCacheIns.SetUserPass(user, pass)
+		return true, nil
+	}
+	if cfg.SmtpdAuth.AllowAnyAuth {
 		slog.Warn(fmt.Sprintf("AllowAnyAuth Authentication successful method %s", mechanism), "Username", user)
 		MailInfoCacheIns.SetUserPass(user, pass)
 		return true, nil
 	}
-	if storedPass, ok := CFG.UserDB[user]; ok && storedPass == pass {
+	if storedPass, ok := cfg.UserDB[user]; ok && storedPass == pass {
 		slog.Info(fmt.Sprintf("Authentication successful method %s", mechanism), "Username", user)
 		MailInfoCacheIns.SetUserPass(user, pass)
 		return true, nil
@@ -57,67 +117,130 @@ func AuthHandler(remoteAddr net.Addr, mechanism string, username []byte, passwor
 	return false, nil
 }
 
-func MailHandler(remoteAddr net.Addr, from string, to []string, data []byte) (err error) {
+// tarpit delays the answer to a failed AUTH, unless the client goes away.
+func tarpit(ctx context.Context, delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// LogoutHandler releases the cached credentials of a session that has ended.
+// Queued emails of the user carry their own sealed copy.
+func LogoutHandler(ctx context.Context, info *smtpd.SessionInfo) {
+	MailInfoCacheIns.Logout(info.Identity.Username)
+}
+
+// MailFromHandler checks the sender at MAIL time, so that emails which are going to be refused are never uploaded:
+// the session must be authenticated, unless the listener does not require it, the user must own the sender
+// address and no envelope rule may reject it.
+func MailFromHandler(ctx context.Context, info *smtpd.SessionInfo, from string) error {
+	if info.Identity == nil && !anonymousAllowed(info) {
+		slog.Error(errAuthRequired.Error(), "ClientIP", info.RemoteIP, "From", from)
+		return errAuthRequired
+	}
+
+	email := NewValidateEmail(info.RemoteIP, sessionUser(info), from, nil, 0, 0, 0)
+	email.listener = info.Listener
+	if info.Identity != nil {
+		if err := email.ValidateSenderIdentity(info.Identity.Username); err != nil {
+			return err
+		}
+	}
+	return envelopeReject(email, "", info)
+}
+
+// anonymousAllowed reports whether the listener of the session relays emails without AUTH (authRequired: false).
+// Such emails are routed by the domain of the sender and relayed without logging in upstream.
+func anonymousAllowed(info *smtpd.SessionInfo) bool {
+	l := Cfg().listener(info.Listener)
+	return l != nil && !*l.AuthRequired
+}
+
+// sessionUser returns the username that authenticated on the session, empty if none did.
+func sessionUser(info *smtpd.SessionInfo) string {
+	if info.Identity == nil {
+		return ""
+	}
+	return info.Identity.Username
+}
+
+// RcptHandler applies the envelope rules to one recipient. A refused recipient gets its own 5xx reply,
+// the other recipients of the email are still accepted.
+func RcptHandler(ctx context.Context, info *smtpd.SessionInfo, from string, to string) error {
+	email := NewValidateEmail(info.RemoteIP, sessionUser(info), from, []string{to}, 0, 0, 0)
+	email.listener = info.Listener
+	return envelopeReject(email, to, info)
+}
+
+func envelopeReject(email *ValidateEmail, recipient string, info *smtpd.SessionInfo) error {
+	verdict := email.EnvelopeVerdict(recipient, time.Now())
+	if verdict == nil || verdict.Action != ActionReject {
+		return nil
+	}
+	slog.Error(verdict.Reply.Error(), "SessionID", info.ID, "Rule", verdict.Rule, "ClientIP", info.RemoteIP, "From", email.Sender, "Recipient", recipient)
+	for _, content := range verdict.Notify {
+		TriggerErrNotification(content, info.RemoteIP, email.Sender, email.Recipient, nil)
+	}
+	return verdict.Reply
+}
+
+// MailHandler validates the email and then either spools it for background delivery,
+// returning the queue ID, or relays it synchronously when the queue is disabled.
+// The email is always relayed with the credentials of the identity that authenticated on the session,
+// or without credentials on a listener that does not require AUTH.
+// It is read as a stream: once to parse the MIME parts, once more to queue or relay it.
+func MailHandler(ctx context.Context, info *smtpd.SessionInfo, from string, to []string, msg Message) (queueID string, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			info := fmt.Sprintf("MailHandler panic: %v", r)
 			slog.Error(info)
-			err = errors.New(info)
+			queueID, err = "", smtpd.NewReply(451, "4.3.0", "Requested action aborted: local error in processing")
 		}
 	}()
 
-	ip, err := GetIPFromAddr(remoteAddr)
-	if err != nil {
-		slog.Error(err.Error())
-		TriggerErrNotification(err.Error(), ip, from, to, data)
-		return err
+	ip := info.RemoteIP
+	if info.Identity == nil && !anonymousAllowed(info) {
+		slog.Error(errAuthRequired.Error(), "ClientIP", ip, "From", from)
+		return "", errAuthRequired
 	}
+	username := sessionUser(info)
 
-	r := strings.NewReader(string(data))
-	msg, err := message.Read(r)
+	// The header is parsed first, the parts are read one after the other from the same reader.
+	body, err := gomsgmail.CreateReader(messageReader(msg))
 	if err != nil {
 		slog.Error(err.Error())
-		TriggerErrNotification(err.Error(), ip, from, to, data)
-		return err
+		TriggerErrNotification(err.Error(), ip, from, to, messageReader(msg))
+		return "", errMalformedMessage
 	}
 
 	// get mail header
-	mailHeader := gomsgmail.Header{Header: msg.Header}
+	mailHeader := body.Header
 	// fromList, _ := mailHeader.Text("From")
 	// to = mailHeader.Text("To") + mailHeader.Text("Cc")
 	toList, _ := mailHeader.Text("To")
 	ccList, _ := mailHeader.Text("Cc")
 	subject, _ := mailHeader.Subject()
 
-	slog.Info("Received an email", "ClientIP", ip, "From", from, "To", strings.Join(to, "; "), "email header To", toList, "email header Cc", ccList, "Subject", subject)
-	slog.Info(fmt.Sprintf("Email size is %d bytes", len(data)))
-
-	ValidateEmail := NewValidateEmail(ip, from, to, 0, 0, 0)
-	// validate email sender client ip
-	if err = ValidateEmail.ValidateEmailClientIP(); err != nil {
-		TriggerErrNotification(err.Error(), ip, from, to, data)
-		return err
-	}
-
-	// validate email sender
-	if err = ValidateEmail.ValidateEmailSender(); err != nil {
-		TriggerErrNotification(err.Error(), ip, from, to, data)
-		return err
-	}
-
-	// validate email recipient
-	if err = ValidateEmail.ValidateEmailRecipient(); err != nil {
-		TriggerErrNotification(err.Error(), ip, from, to, data)
-		return err
-	}
-
-	// Handle the content of the email.
-	r = strings.NewReader(string(data))
-	body, err := gomsgmail.CreateReader(r)
-	if err != nil {
-		TriggerErrNotification(err.Error(), ip, from, to, data)
-		slog.Error(err.Error())
-		return err
+	slog.Info("Received an email", "SessionID", info.ID, "Listener", info.Listener, "ClientIP", ip, "Helo", info.HeloName, "TLS", info.TLS != nil, "AuthUser", username, "From", from, "To", strings.Join(to, "; "), "email header To", toList, "email header Cc", ccList, "Subject", subject)
+	slog.Info(fmt.Sprintf("Email size is %d bytes", msg.Size()))
+
+	ValidateEmail := NewValidateEmail(ip, username, from, to, 0, 0, 0)
+	ValidateEmail.listener = info.Listener
+	ValidateEmail.Header = mailHeader.Header
+	ValidateEmail.Subject = subject
+	ValidateEmail.Size = msg.Size()
+	// validate that the authenticated user may send as this sender
+	if info.Identity != nil {
+		if err = ValidateEmail.ValidateSenderIdentity(username); err != nil {
+			TriggerErrNotification(err.Error(), ip, from, to, messageReader(msg))
+			return "", err
+		}
 	}
 
 	// Loop through reading each part of the body.
@@ -130,8 +253,8 @@ func MailHandler(remoteAddr net.Addr, from string, to []string, data []byte) (er
 		}
 		if err != nil {
 			slog.Error(err.Error())
-			TriggerErrNotification(err.Error(), ip, from, to, data)
-			return err
+			TriggerErrNotification(err.Error(), ip, from, to, messageReader(msg))
+			return "", errMalformedMessage
 		}
 
 		contentType := p.Header.Get("Content-Type")
@@ -139,16 +262,16 @@ func MailHandler(remoteAddr net.Addr, from string, to []string, data []byte) (er
 		if err != nil {
 			info := fmt.Sprintf("Failed to calculate the size of contentType: %s, error: %s", contentType, err.Error())
 			slog.Error(info)
-			TriggerErrNotification(err.Error(), ip, from, to, data)
-			return errors.New(info)
+			TriggerErrNotification(err.Error(), ip, from, to, messageReader(msg))
+			return "", errMalformedMessage
 		}
 
 		currentPartType, err := mailPartType.CheckMailPartType(p)
 		if err != nil {
 			info := fmt.Sprintf("from user %s(%s) failed to check mail part type: %s, error: %s", from, ip, contentType, err.Error())
 			slog.Error(info)
-			TriggerErrNotification(err.Error(), ip, from, to, data)
-			return errors.New(info)
+			TriggerErrNotification(err.Error(), ip, from, to, messageReader(msg))
+			return "", smtpd.NewReply(451, "4.3.0", "Requested action aborted: local error in processing")
 		}
 		if currentPartType == mailPartType.Body {
 			// This is the message's text (can be plain-text or HTML)
@@ -156,46 +279,125 @@ func MailHandler(remoteAddr net.Addr, from string, to []string, data []byte) (er
 			if mailBodyCount > 1 {
 				info := "the email has more than one body, please check it"
 				slog.Error(info)
-				TriggerErrNotification(info, ip, from, to, data)
-				return errors.New(info)
+				TriggerErrNotification(info, ip, from, to, messageReader(msg))
+				return "", smtpd.NewReply(554, "5.6.0", "The email has more than one body")
 			}
 
 			ValidateEmail.BodySize = mailPartSize
 		} else if currentPartType == mailPartType.EmbeddedContent {
 			ValidateEmail.EmbeddedContentSize += mailPartSize
+			ValidateEmail.EmbeddedContents++
 		} else if currentPartType == mailPartType.Attachment {
 			ValidateEmail.AttachmentSize += mailPartSize
+			filename, _ := p.Header.(*gomsgmail.AttachmentHeader).Filename()
+			mediaType, _, _ := mime.ParseMediaType(contentType)
+			ValidateEmail.Attachments = append(ValidateEmail.Attachments, Attachment{Name: filename, Type: mediaType, Size: mailPartSize})
 		} else {
 			info := "unknown header type"
 			slog.Error(info)
-			TriggerErrNotification(info, ip, from, to, data)
-			return errors.New(info)
+			TriggerErrNotification(info, ip, from, to, messageReader(msg))
+			return "", smtpd.NewReply(554, "5.6.0", "The email contains a MIME part of unknown type")
 		}
 	}
 
-	// Validate the email body size
-	if err = ValidateEmail.ValidateBodySize(); err != nil {
-		TriggerErrNotification(err.Error(), ip, from, to, data)
-		return err
+	// Apply the rules
+	verdict := ValidateEmail.ApplyRules(time.Now())
+	for _, content := range verdict.Notify {
+		TriggerErrNotification(content, ip, from, to, messageReader(msg))
 	}
-	// Validate the email attachment size
-	if err = ValidateEmail.ValidateAttachments(); err != nil {
-		TriggerErrNotification(err.Error(), ip, from, to, data)
-		return err
+	switch verdict.Action {
+	case ActionReject:
+		slog.Error(verdict.Reply.Error(), "SessionID", info.ID, "Rule", verdict.Rule)
+		return "", verdict.Reply
+	case ActionQuarantine:
+		queueID, err = Quarantine(verdict.Rule, ip, username, from, to, msg)
+		if err != nil {
+			return "", smtpd.NewReply(451, "4.3.0", "Requested action aborted: local error in processing")
+		}
+		return queueID, nil
 	}
-	// Validate the email embedded content size
-	if err = ValidateEmail.ValidateEmbeddedContent(); err != nil {
-		TriggerErrNotification(err.Error(), ip, from, to, data)
-		return err
+	if len(verdict.Headers) > 0 {
+		msg = withHeaders(verdict.Headers, msg)
 	}
 
-	// After all the verifications have been passed, the email will be sent out.
-	err = SendMailData(from, to, data)
+	// After all the verifications have been passed, the email will be queued or sent out.
+	if QueueIns != nil {
+		var password string
+		if username != "" {
+			password, err = MailInfoCacheIns.GetUserPass(username)
+		}
+		if err == nil {
+			queueID, err = QueueIns.Enqueue(ip, username, password, verdict.Route, from, to, MailOptionsFor(info), msg)
+		}
+		if err != nil {
+			slog.Error(err.Error())
+			TriggerErrNotification(err.Error(), ip, from, to, messageReader(msg))
+			return "", smtpd.NewReply(451, "4.3.0", "Unable to queue the email, try again later")
+		}
+		return queueID, nil
+	}
+
+	err = SendMailData(ctx, username, verdict.Route, from, to, MailOptionsFor(info), msg)
+	var refused *recipientErrors
+	if errors.As(err, &refused) && len(refused.Recipients) < len(to) {
+		// Sent to the other recipients already, the client must not send it again: the sender gets a DSN instead.
+		TriggerErrNotification(err.Error(), ip, from, refused.Recipients, messageReader(msg))
+		sendRefusedDSN(info, username, from, refused, msg)
+		return "", nil
+	}
 	if err != nil {
-		TriggerErrNotification(err.Error(), ip, from, to, data)
-		return err
+		TriggerErrNotification(err.Error(), ip, from, to, messageReader(msg))
+		return "", deliveryReply(err)
 	}
-	return nil
+	return "", nil
+}
+
+// sendRefusedDSN tells the sender, if queue.dsn is enabled, that the upstream server refused some of the recipients
+// of an email relayed synchronously to the others, since the client got 250 for all of them.
+func sendRefusedDSN(info *smtpd.SessionInfo, username, from string, refused *recipientErrors, msg Message) {
+	if !Cfg().Queue.DSN {
+		return
+	}
+	mail := &QueuedMail{
+		ID:        info.ID,
+		ClientIP:  info.RemoteIP,
+		AuthUser:  username,
+		From:      from,
+		To:        refused.Recipients,
+		Options:   MailOptionsFor(info),
+		CreatedAt: time.Now(),
+	}
+	data, err := io.ReadAll(messageReader(msg))
+	if err == nil {
+		err = SendDSN(mail, data, DSNFailed, refused.Errors)
+	}
+	if err != nil {
+		slog.Error(err.Error(), "SessionID", info.ID)
+	}
+}
+
+// withHeaders returns msg preceded by the header fields added by the rules, without copying it.
+func withHeaders(headers []string, msg Message) Message {
+	return smtpd.PrefixedReader([]byte(strings.Join(headers, "\r\n")+"\r\n"), msg, msg.Size())
+}
+
+// deliveryReply maps a failed synchronous relay to the reply for the client: a permanent rejection by the
+// upstream server is passed on, anything else is a temporary failure the client should retry.
+func deliveryReply(err error) *smtpd.Reply {
+	var protoErr *textproto.Error
+	switch {
+	case errors.As(err, &protoErr) && protoErr.Code >= 500:
+		return smtpd.NewReply(protoErr.Code, "", strings.Split(protoErr.Msg, "\n")...)
+	case errors.Is(err, errRouteNotConfigured):
+		return smtpd.NewReply(550, "5.7.1", "Relaying is not configured for this sender")
+	default:
+		return smtpd.NewReply(451, "4.4.1", "Upstream server unavailable, try again later")
+	}
+}
+
+// DeliverQueuedMail relays a spooled email with the credentials of the user that submitted it.
+func DeliverQueuedMail(mail *QueuedMail, password string, msg Message) error {
+	return SendMailAs(context.Background(), mail.AuthUser, password, mail.Route, mail.From, mail.To, mail.Options, msg)
 }
 
 type mailPartType struct {
@@ -253,11 +455,10 @@ func (mailPT *mailPartType) CheckMailPartType(p *gomsgmail.Part) (ret string, er
 
 }
 
-func SaveMail(data []byte) (file string, err error) {
+// SaveMail copies the email read from r to the emails directory, named after the time and the hash of its content.
+func SaveMail(r io.Reader) (file string, err error) {
 	const EmailPath string = "emails"
 	timestamp := time.Now().Format("20060102_150405")
-	subjectHash := hashSubject(data)
-	filename := fmt.Sprintf("%s_%d.eml", timestamp, subjectHash)
 
 	err = os.MkdirAll(EmailPath, 0755)
 	if err != nil {
@@ -266,8 +467,25 @@ func SaveMail(data []byte) (file string, err error) {
 		return "", errors.New(info)
 	}
 
-	file = filepath.Join(EmailPath, filename)
-	err = os.WriteFile(file, data, 0644)
+	// 先写入临时文件，同时计算哈希，得到文件名后再改名
+	f, err := os.CreateTemp(EmailPath, timestamp+"_*.tmp")
+	if err == nil {
+		h := fnv.New64a()
+		_, err = io.Copy(io.MultiWriter(f, h), r)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		file = filepath.Join(EmailPath, fmt.Sprintf("%s_%d.eml", timestamp, h.Sum64()))
+		if err == nil {
+			err = os.Chmod(f.Name(), 0644)
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), file)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
 	if err != nil {
 		info := fmt.Sprintf("saveMail failed: %s", err.Error())
 		slog.Error(info)
@@ -275,3 +493,31 @@ func SaveMail(data []byte) (file string, err error) {
 	}
 	return file, nil
 }
+
+// Quarantine keeps an email held by a rule in quarantine.path instead of relaying it,
+// as <id>.eml plus <id>.json with the envelope. The client is told the email was accepted.
+func Quarantine(rule, clientIP, authUser, from string, to []string, msg Message) (string, error) {
+	dir := Cfg().Quarantine.Path
+	id, err := newQueueID()
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err != nil {
+		info := fmt.Sprintf("quarantine email from %s failed: %s", from, err.Error())
+		slog.Error(info)
+		return "", errors.New(info)
+	}
+
+	mail := &QueuedMail{ID: id, ClientIP: clientIP, AuthUser: authUser, From: from, To: to, Size: int(msg.Size()), CreatedAt: time.Now(), LastError: "quarantined by rule " + rule}
+	envelope, _ := json.MarshalIndent(mail, "", "  ")
+	if err = copyFileSync(filepath.Join(dir, id+".eml"), messageReader(msg)); err == nil {
+		err = writeFileSync(filepath.Join(dir, id+".json"), envelope)
+	}
+	if err != nil {
+		info := fmt.Sprintf("quarantine email %s failed: %s", id, err.Error())
+		slog.Error(info)
+		return "", errors.New(info)
+	}
+	slog.Warn("Email quarantined", "QueueID", id, "Rule", rule, "ClientIP", clientIP, "AuthUser", authUser, "From", from, "To", strings.Join(to, "; "))
+	return id, nil
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/naive9527/mitmsmtpd/smtpd"
+)
+
+func TestAnonymousRelay(t *testing.T) {
+	f := newFakeUpstream(t)
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+smptdServer:
+  address: ":2525"
+listeners:
+  - name: "mx"
+    address: ":2525"
+    authRequired: false
+emailServer:
+  "example.com":
+    server: "127.0.0.1"
+    port: %d
+    authMechanisms: "PLAIN"
+`, f.port()))
+	info := &smtpd.SessionInfo{ID: "test", Listener: "mx", RemoteIP: "192.0.2.1"}
+	msg := bytes.NewReader([]byte("Subject: test\r\n\r\nbody\r\n"))
+
+	// Without AUTH, the email is routed by the domain of the sender and relayed without logging in.
+	if err := MailFromHandler(context.Background(), info, "user@example.com"); err != nil {
+		t.Fatalf("MailFromHandler() = %v", err)
+	}
+	if _, err := MailHandler(context.Background(), info, "user@example.com", []string{"rcpt@example.org"}, msg); err != nil {
+		t.Fatalf("MailHandler() = %v", err)
+	}
+	if n := f.received(); n != 1 {
+		t.Errorf("upstream received %d emails, want 1", n)
+	}
+
+	// A listener that requires AUTH refuses the sender.
+	*cfg.Listeners[0].AuthRequired = true
+	if err := MailFromHandler(context.Background(), info, "user@example.com"); !errors.Is(err, errAuthRequired) {
+		t.Errorf("MailFromHandler() = %v, want %v", err, errAuthRequired)
+	}
+	if _, err := MailHandler(context.Background(), info, "user@example.com", []string{"rcpt@example.org"}, msg); !errors.Is(err, errAuthRequired) {
+		t.Errorf("MailHandler() = %v, want %v", err, errAuthRequired)
+	}
+}
+
+func TestRefusedRecipientsDSN(t *testing.T) {
+	f := newFakeUpstream(t)
+	f.rcpt["unknown@example.org"] = "550 5.1.1 no such user"
+	notify := newFakeUpstream(t)
+	loadTestConfig(t, fmt.Sprintf(`
+smptdServer:
+  address: ":2525"
+  hostname: "mx.example.com"
+listeners:
+  - name: "mx"
+    address: ":2525"
+    authRequired: false
+emailServer:
+  "example.com":
+    server: "127.0.0.1"
+    port: %d
+    authMechanisms: "PLAIN"
+queue:
+  dsn: true
+notification:
+  email:
+    enabled: true
+    from: "postmaster@example.com"
+    server: "127.0.0.1"
+    port: %d
+    to: ["admin@example.com"]
+`, f.port(), notify.port()))
+	info := &smtpd.SessionInfo{ID: "ABCDEF123456", Listener: "mx", RemoteIP: "192.0.2.1"}
+	msg := bytes.NewReader([]byte("Subject: test\r\n\r\nbody\r\n"))
+
+	// The client gets 250 since the email went to rcpt@example.org, the sender a DSN for unknown@example.org.
+	if _, err := MailHandler(context.Background(), info, "user@example.com", []string{"rcpt@example.org", "unknown@example.org"}, msg); err != nil {
+		t.Fatalf("MailHandler() = %v", err)
+	}
+	if n := f.received(); n != 1 {
+		t.Errorf("upstream received %d emails, want 1", n)
+	}
+	var dsn string
+	notify.mu.Lock()
+	for _, m := range notify.messages {
+		if strings.Contains(m, "report-type=delivery-status") {
+			dsn = m
+		}
+	}
+	notify.mu.Unlock()
+	if !strings.Contains(dsn, "Final-Recipient: rfc822; unknown@example.org\nAction: failed\nStatus: 5.1.1\n") {
+		t.Errorf("no DSN for the refused recipient:\n%s", dsn)
+	}
+	if strings.Contains(dsn, "Final-Recipient: rfc822; rcpt@example.org") {
+		t.Errorf("DSN reports the accepted recipient:\n%s", dsn)
+	}
+}
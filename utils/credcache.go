@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// MailInfoCache stores the username and password used for client login, so as to forward the email after verification is passed.
+// Passwords are sealed with AES-GCM under a random key generated at start-up and never written anywhere,
+// so a core dump or heap inspection does not reveal them in plaintext. Entries expire after an idle or
+// absolute TTL, are dropped when the last session of the user logs out, and are wiped on shutdown.
+type MailInfoCache struct {
+	mu          sync.Mutex
+	aead        cipher.AEAD
+	entries     map[string]*credentialEntry
+	idleTTL     time.Duration
+	absoluteTTL time.Duration
+	stats       CredentialCacheStats
+	stop        chan struct{}
+}
+
+type credentialEntry struct {
+	nonce    []byte
+	sealed   []byte
+	created  time.Time
+	lastUsed time.Time
+	sessions int // number of open SMTP sessions authenticated as this user
+}
+
+// CredentialCacheStats counts the entries of the credential cache and why they were evicted.
+type CredentialCacheStats struct {
+	Entries           int    `json:"entries"`
+	IdleEvictions     uint64 `json:"idleEvictions"`
+	AbsoluteEvictions uint64 `json:"absoluteEvictions"`
+	LogoutEvictions   uint64 `json:"logoutEvictions"`
+	Wiped             uint64 `json:"wiped"`
+}
+
+// NewMailInfoCache creates a cache with a fresh per-process key.
+// A zero idleTTL or absoluteTTL disables that expiry.
+func NewMailInfoCache(idleTTL, absoluteTTL time.Duration) *MailInfoCache {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("generate credential cache key failed: %v", err))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		panic(fmt.Sprintf("create credential cache cipher failed: %v", err))
+	}
+	clear(key)
+
+	return &MailInfoCache{
+		aead:        aead,
+		entries:     make(map[string]*credentialEntry),
+		idleTTL:     idleTTL,
+		absoluteTTL: absoluteTTL,
+		stop:        make(chan struct{}),
+	}
+}
+
+// newAEAD returns AES-GCM with key, which is 32 bytes long for AES-256.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (mailInfo *MailInfoCache) GetUserPass(username string) (string, error) {
+	mailInfo.mu.Lock()
+	defer mailInfo.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := mailInfo.entries[username]
+	if ok && mailInfo.expired(entry, now) {
+		mailInfo.evict(username, entry, now)
+		ok = false
+	}
+	if !ok {
+		info := fmt.Sprintf("user %s password cannot be obtained", username)
+		slog.Error(info)
+		return "", errors.New(info)
+	}
+
+	passwd, err := mailInfo.aead.Open(nil, entry.nonce, entry.sealed, []byte(username))
+	if err != nil {
+		info := fmt.Sprintf("user %s password cannot be decrypted", username)
+		slog.Error(info)
+		return "", errors.New(info)
+	}
+	entry.lastUsed = now
+	defer clear(passwd)
+	return string(passwd), nil
+}
+
+// SetUserPass stores the password of a user that just authenticated and counts the session as open.
+func (mailInfo *MailInfoCache) SetUserPass(username, passwd string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			info := fmt.Sprintf("panic in SetUserPass: %s %v", username, r)
+			slog.Error(info)
+			err = errors.New(info)
+		}
+	}()
+
+	nonce := make([]byte, mailInfo.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := mailInfo.aead.Seal(nil, nonce, []byte(passwd), []byte(username))
+
+	mailInfo.mu.Lock()
+	defer mailInfo.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := mailInfo.entries[username]
+	if !ok {
+		entry = &credentialEntry{}
+		mailInfo.entries[username] = entry
+	}
+	clear(entry.sealed)
+	entry.nonce = nonce
+	entry.sealed = sealed
+	entry.created = now
+	entry.lastUsed = now
+	entry.sessions++
+	return nil
+}
+
+// Logout ends one session of username. When no session is left the credentials are dropped.
+func (mailInfo *MailInfoCache) Logout(username string) {
+	mailInfo.mu.Lock()
+	defer mailInfo.mu.Unlock()
+
+	entry, ok := mailInfo.entries[username]
+	if !ok {
+		return
+	}
+	if entry.sessions > 0 {
+		entry.sessions--
+	}
+	if entry.sessions == 0 {
+		mailInfo.remove(username, entry)
+		mailInfo.stats.LogoutEvictions++
+	}
+}
+
+// Wipe drops every cached credential, e.g. on shutdown.
+func (mailInfo *MailInfoCache) Wipe() {
+	mailInfo.mu.Lock()
+	defer mailInfo.mu.Unlock()
+
+	for username, entry := range mailInfo.entries {
+		mailInfo.remove(username, entry)
+		mailInfo.stats.Wiped++
+	}
+}
+
+// Stats returns the number of cached entries and the eviction counters.
+func (mailInfo *MailInfoCache) Stats() CredentialCacheStats {
+	mailInfo.mu.Lock()
+	defer mailInfo.mu.Unlock()
+
+	stats := mailInfo.stats
+	stats.Entries = len(mailInfo.entries)
+	return stats
+}
+
+// StartJanitor periodically evicts expired entries until Close is called.
+func (mailInfo *MailInfoCache) StartJanitor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-mailInfo.stop:
+				return
+			case now := <-ticker.C:
+				mailInfo.evictExpired(now)
+			}
+		}
+	}()
+}
+
+// Close stops the janitor and wipes the cache.
+func (mailInfo *MailInfoCache) Close() {
+	select {
+	case <-mailInfo.stop:
+	default:
+		close(mailInfo.stop)
+	}
+	mailInfo.Wipe()
+}
+
+func (mailInfo *MailInfoCache) evictExpired(now time.Time) {
+	mailInfo.mu.Lock()
+	defer mailInfo.mu.Unlock()
+
+	for username, entry := range mailInfo.entries {
+		if mailInfo.expired(entry, now) {
+			mailInfo.evict(username, entry, now)
+		}
+	}
+}
+
+func (mailInfo *MailInfoCache) expired(entry *credentialEntry, now time.Time) bool {
+	if mailInfo.absoluteTTL > 0 && now.Sub(entry.created) > mailInfo.absoluteTTL {
+		return true
+	}
+	return mailInfo.idleTTL > 0 && now.Sub(entry.lastUsed) > mailInfo.idleTTL
+}
+
+// evict removes an expired entry and records why it expired. Callers must hold mu.
+func (mailInfo *MailInfoCache) evict(username string, entry *credentialEntry, now time.Time) {
+	if mailInfo.absoluteTTL > 0 && now.Sub(entry.created) > mailInfo.absoluteTTL {
+		mailInfo.stats.AbsoluteEvictions++
+	} else {
+		mailInfo.stats.IdleEvictions++
+	}
+	mailInfo.remove(username, entry)
+	slog.Info("Cached credentials expired", "Username", username)
+}
+
+// remove zeroes the sealed password and deletes the entry. Callers must hold mu.
+func (mailInfo *MailInfoCache) remove(username string, entry *credentialEntry) {
+	clear(entry.sealed)
+	clear(entry.nonce)
+	delete(mailInfo.entries, username)
+}
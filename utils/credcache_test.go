@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMailInfoCacheExpiry(t *testing.T) {
+	cache := NewMailInfoCache(time.Hour, 24*time.Hour)
+	cache.SetUserPass("idle@example.com", "secret")
+	cache.SetUserPass("busy@example.com", "secret")
+	if password, err := cache.GetUserPass("idle@example.com"); err != nil || password != "secret" {
+		t.Fatalf("GetUserPass() = %q, %v", password, err)
+	}
+	if bytes.Contains(cache.entries["idle@example.com"].sealed, []byte("secret")) {
+		t.Error("password stored in clear")
+	}
+
+	// Used again after 50 minutes, the busy entry survives the idle TTL, but not the absolute one.
+	now := time.Now()
+	cache.entries["busy@example.com"].lastUsed = now.Add(50 * time.Minute)
+	cache.evictExpired(now.Add(90 * time.Minute))
+	if _, err := cache.GetUserPass("idle@example.com"); err == nil {
+		t.Error("idle entry not evicted")
+	}
+	if _, ok := cache.entries["busy@example.com"]; !ok {
+		t.Error("entry in use evicted")
+	}
+	cache.evictExpired(now.Add(25 * time.Hour))
+	if _, ok := cache.entries["busy@example.com"]; ok {
+		t.Error("entry older than the absolute TTL not evicted")
+	}
+
+	stats := cache.Stats()
+	if stats.Entries != 0 || stats.IdleEvictions != 1 || stats.AbsoluteEvictions != 1 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestMailInfoCacheLogoutAndWipe(t *testing.T) {
+	cache := NewMailInfoCache(0, 0)
+	cache.SetUserPass("user@example.com", "secret")
+	cache.SetUserPass("user@example.com", "secret") // Second session
+	cache.SetUserPass("other@example.com", "secret")
+
+	cache.Logout("user@example.com")
+	if _, err := cache.GetUserPass("user@example.com"); err != nil {
+		t.Error("dropped while a session is still open")
+	}
+	cache.Logout("user@example.com")
+	if _, err := cache.GetUserPass("user@example.com"); err == nil {
+		t.Error("kept after the last session ended")
+	}
+
+	entry := cache.entries["other@example.com"]
+	cache.Close()
+	if _, err := cache.GetUserPass("other@example.com"); err == nil {
+		t.Error("kept after Close")
+	}
+	for _, b := range entry.sealed {
+		if b != 0 {
+			t.Fatal("sealed password not zeroed")
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.LogoutEvictions != 1 || stats.Wiped != 1 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/textproto"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Actions of a delivery status notification (RFC 3464 section 2.3.3).
+const (
+	DSNFailed  = "failed"
+	DSNDelayed = "delayed"
+)
+
+var enhancedCodeRE = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+
+// SendDSN tells the sender of a queued email, or of one relayed synchronously to only some of its recipients, that
+// its delivery failed or is delayed, with a multipart/report delivery status notification (RFC 3464) listing the
+// recipients of causes that asked for it (NOTIFY, RFC 3461), each with its own status.
+// Emails with a null sender, i.e. notifications themselves, never get one.
+// DSNs are sent through the notification.email account, since no user authenticated for them.
+func SendDSN(mail *QueuedMail, data []byte, action string, causes map[string]error) error {
+	if mail.From == "" {
+		return nil
+	}
+	var rcpts []string
+	for _, rcpt := range mail.To {
+		if _, ok := causes[rcpt]; ok && mail.Options.notifies(rcpt, action) {
+			rcpts = append(rcpts, rcpt)
+		}
+	}
+	if len(rcpts) == 0 {
+		return nil
+	}
+
+	cfg := Cfg()
+	account := cfg.Notification.Email
+	if account == nil || !account.Enabled {
+		return errors.New("the DSN can not be sent, notification.email is not enabled")
+	}
+	hostname := cfg.SmptdServer.Hostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	msg := buildDSN(mail, rcpts, data, action, causes, hostname, account.From, time.Now())
+
+	d := gomail.NewDialer(account.Server, account.Port, account.From, account.Password)
+	sender, err := d.Dial()
+	if err != nil {
+		return fmt.Errorf("send DSN for email %s to %s failed: %w", mail.ID, mail.From, err)
+	}
+	defer sender.Close()
+	if err = sender.Send(account.From, []string{mail.From}, bytes.NewReader(msg)); err != nil {
+		return fmt.Errorf("send DSN for email %s to %s failed: %w", mail.ID, mail.From, err)
+	}
+	slog.Info("DSN sent", "QueueID", mail.ID, "Action", action, "To", mail.From, "Recipients", strings.Join(rcpts, "; "))
+	return nil
+}
+
+// notifies reports whether rcpt asked for a DSN with the given action.
+// Without NOTIFY, failures and delays are reported (RFC 3461 section 4.1).
+func (opts MailOptions) notifies(rcpt, action string) bool {
+	notify := opts.Rcpt[rcpt].Notify
+	if notify == "" {
+		notify = "FAILURE,DELAY"
+	}
+	keyword := "FAILURE"
+	if action == DSNDelayed {
+		keyword = "DELAY"
+	}
+	return slices.Contains(strings.Split(notify, ","), keyword)
+}
+
+// buildDSN composes the notification: a human readable part, the message/delivery-status part and the
+// returned email, in full for RET=FULL and its header otherwise.
+func buildDSN(mail *QueuedMail, rcpts []string, data []byte, action string, causes map[string]error, hostname, from string, now time.Time) []byte {
+	boundary := "=_dsn_" + mail.ID
+
+	var b bytes.Buffer
+	subject := "Delivery Status Notification (Failure)"
+	if action == DSNDelayed {
+		subject = "Delivery Status Notification (Delay)"
+	}
+	fmt.Fprintf(&b, "From: Mail Delivery System <%s>\r\n", from)
+	fmt.Fprintf(&b, "To: <%s>\r\n", mail.From)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s.%s.dsn@%s>\r\n", mail.ID, action, hostname)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n\r\n", boundary)
+
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", boundary)
+	if action == DSNDelayed {
+		b.WriteString("Your email has not been delivered yet to the recipients below. Delivery will be retried, you do not need to send it again.\r\n\r\n")
+	} else {
+		b.WriteString("Your email could not be delivered to the recipients below.\r\n\r\n")
+	}
+	for _, rcpt := range rcpts {
+		_, diagnostic := dsnStatus(action, causes[rcpt])
+		fmt.Fprintf(&b, "    %s\r\n        Reason: %s\r\n", rcpt, strings.TrimPrefix(diagnostic, "smtp; "))
+	}
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: message/delivery-status\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", hostname)
+	if mail.Options.EnvID != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\r\n", decodeXtext(mail.Options.EnvID))
+	}
+	fmt.Fprintf(&b, "Arrival-Date: %s\r\n", mail.CreatedAt.Format(time.RFC1123Z))
+	for _, rcpt := range rcpts {
+		status, diagnostic := dsnStatus(action, causes[rcpt])
+		b.WriteString("\r\n")
+		if orcpt := mail.Options.Rcpt[rcpt].ORcpt; orcpt != "" {
+			fmt.Fprintf(&b, "Original-Recipient: %s\r\n", decodeXtext(orcpt))
+		}
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", rcpt)
+		fmt.Fprintf(&b, "Action: %s\r\n", action)
+		fmt.Fprintf(&b, "Status: %s\r\n", status)
+		fmt.Fprintf(&b, "Diagnostic-Code: %s\r\n", diagnostic)
+		fmt.Fprintf(&b, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+	b.WriteString("\r\n")
+
+	if mail.Options.Ret == "FULL" {
+		fmt.Fprintf(&b, "--%s\r\nContent-Type: message/rfc822\r\n\r\n", boundary)
+		b.Write(data)
+	} else {
+		header, _, _ := bytes.Cut(data, []byte("\r\n\r\n"))
+		fmt.Fprintf(&b, "--%s\r\nContent-Type: text/rfc822-headers\r\n\r\n", boundary)
+		b.Write(header)
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+	return b.Bytes()
+}
+
+// dsnStatus returns the status code (RFC 3463) and the Diagnostic-Code field for a delivery error.
+func dsnStatus(action string, cause error) (status, diagnostic string) {
+	var protoErr *textproto.Error
+	switch {
+	case errors.Is(cause, errDeliveryExpired):
+		status = "4.4.7" // Delivery time expired
+	case errors.As(cause, &protoErr):
+		status = strconv.Itoa(protoErr.Code/100) + ".0.0"
+		if code, _, _ := strings.Cut(protoErr.Msg, " "); enhancedCodeRE.MatchString(code) {
+			status = code
+		}
+	case errors.Is(cause, errRouteNotConfigured):
+		status = "5.7.1"
+	default:
+		status = "4.4.1" // No answer from host
+	}
+	// A failed delivery is reported with a permanent status (RFC 3464 section 2.3.3), e.g. 5.4.7 for an expired one.
+	if action == DSNFailed && status[0] != '5' {
+		status = "5" + status[1:]
+	}
+
+	if errors.As(cause, &protoErr) {
+		diagnostic = fmt.Sprintf("smtp; %d %s", protoErr.Code, strings.ReplaceAll(protoErr.Msg, "\n", " "))
+	} else {
+		diagnostic = "X-Local; " + strings.ReplaceAll(cause.Error(), "\n", " ")
+	}
+	return status, diagnostic
+}
+
+// decodeXtext decodes the "+HH" escapes of xtext (RFC 3461 section 4). Escapes of anything but printable ASCII
+// are left encoded, so that the value cannot add fields to the DSN it is written into.
+func decodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil && c > 32 && c < 127 {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildDSNExpired(t *testing.T) {
+	now := time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC)
+	mail := &QueuedMail{
+		ID:        "20250102150405.0000000000000001",
+		From:      "user@example.com",
+		To:        []string{"rcpt@example.org"},
+		CreatedAt: now.Add(-5 * 24 * time.Hour),
+	}
+	data := []byte("Subject: test\r\n\r\nbody\r\n")
+	dsn := buildDSN(mail, mail.To, data, DSNFailed, causesFor(mail.To, errDeliveryExpired), "mx.example.com", "postmaster@example.com", now)
+
+	for _, field := range []string{
+		"Final-Recipient: rfc822; rcpt@example.org\r\n",
+		"Action: failed\r\n",
+		"Status: 5.4.7\r\n",
+		"Subject: test\r\n",
+	} {
+		if !bytes.Contains(dsn, []byte(field)) {
+			t.Errorf("DSN lacks %q:\n%s", field, dsn)
+		}
+	}
+	if bytes.Contains(dsn, []byte("body")) {
+		t.Error("body returned without RET=FULL")
+	}
+}
+
+func TestDSNStatus(t *testing.T) {
+	tests := []struct {
+		action string
+		cause  error
+		want   string
+	}{
+		{DSNDelayed, errDeliveryExpired, "4.4.7"},
+		{DSNFailed, errDeliveryExpired, "5.4.7"},
+		{DSNFailed, errRouteNotConfigured, "5.7.1"},
+		{DSNDelayed, &textproto.Error{Code: 451, Msg: "4.3.0 try again later"}, "4.3.0"},
+		{DSNFailed, &textproto.Error{Code: 451, Msg: "4.3.0 try again later"}, "5.3.0"},
+		{DSNFailed, &textproto.Error{Code: 550, Msg: "no such user"}, "5.0.0"},
+	}
+	for _, tt := range tests {
+		if got, _ := dsnStatus(tt.action, tt.cause); got != tt.want {
+			t.Errorf("dsnStatus(%s, %v) = %s, want %s", tt.action, tt.cause, got, tt.want)
+		}
+	}
+}
+
+func TestBuildDSNPerRecipient(t *testing.T) {
+	mail := &QueuedMail{ID: "20250102150405.0000000000000001", From: "user@example.com", To: []string{"unknown@example.org", "full@example.org"}}
+	causes := map[string]error{
+		"unknown@example.org": &textproto.Error{Code: 550, Msg: "5.1.1 no such user"},
+		"full@example.org":    fmt.Errorf("%w: %w", errDeliveryExpired, &textproto.Error{Code: 452, Msg: "4.2.2 mailbox full"}),
+	}
+	dsn := string(buildDSN(mail, mail.To, nil, DSNFailed, causes, "mx.example.com", "postmaster@example.com", time.Now()))
+
+	for _, fields := range []string{
+		"Final-Recipient: rfc822; unknown@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 no such user\r\n",
+		"Final-Recipient: rfc822; full@example.org\r\nAction: failed\r\nStatus: 5.4.7\r\nDiagnostic-Code: smtp; 452 4.2.2 mailbox full\r\n",
+	} {
+		if !strings.Contains(dsn, fields) {
+			t.Errorf("DSN lacks %q:\n%s", fields, dsn)
+		}
+	}
+}
+
+func TestBuildDSNEncodedLineBreak(t *testing.T) {
+	mail := &QueuedMail{
+		ID:   "20250102150405.0000000000000001",
+		From: "user@example.com",
+		To:   []string{"rcpt@example.org"},
+		Options: MailOptions{
+			EnvID: "QQ+2B1+0D+0ABcc:x",
+			Rcpt:  map[string]RcptOptions{"rcpt@example.org": {ORcpt: "rfc822;a+0D+0AX-Injected:+20y"}},
+		},
+	}
+	dsn := string(buildDSN(mail, mail.To, nil, DSNFailed, causesFor(mail.To, errDeliveryExpired), "mx.example.com", "postmaster@example.com", time.Now()))
+
+	// Only the escapes of printable characters are decoded.
+	for _, field := range []string{
+		"Original-Envelope-Id: QQ+1+0D+0ABcc:x\r\n",
+		"Original-Recipient: rfc822;a+0D+0AX-Injected:+20y\r\n",
+	} {
+		if !strings.Contains(dsn, field) {
+			t.Errorf("DSN lacks %q:\n%s", field, dsn)
+		}
+	}
+	if strings.Contains(dsn, "\r\nBcc:") || strings.Contains(dsn, "\r\nX-Injected:") {
+		t.Errorf("DSN has a field injected with an encoded line break:\n%s", dsn)
+	}
+}
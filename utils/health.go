@@ -0,0 +1,259 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/naive9527/mitmsmtpd/smtpd"
+)
+
+// UpstreamHealthIns tracks the reachable addresses of the email servers, nil if smtpProbe is not enabled.
+var UpstreamHealthIns *UpstreamHealth
+
+// errNoHealthyAddress is returned when no address of an email server passed the last probe.
+var errNoHealthyAddress = smtpd.NewReply(451, "4.4.1", "Upstream server unavailable, try again later")
+
+// UpstreamHealth probes the email servers of the configuration in the background: every smtpProbe.interval it
+// resolves their names again and connects to every IPv4 and IPv6 address (and exchanges EHLO with smtpProbe.ehlo).
+// Relays get the healthy addresses at once instead of probing while the client waits.
+type UpstreamHealth struct {
+	mu      sync.Mutex
+	servers map[string]*ServerHealth // By "host:port"
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// ServerHealth is the probe state of an email server, listed by GET /upstreams of the admin interface.
+type ServerHealth struct {
+	Server      string          `json:"server"`
+	Port        int             `json:"port"`
+	Addresses   []AddressHealth `json:"addresses"`             // In the order of the DNS answer
+	LookupError string          `json:"lookupError,omitempty"` // Error of the last DNS lookup, the addresses of the previous one are kept
+	CheckedAt   time.Time       `json:"checkedAt"`
+}
+
+// AddressHealth is the probe state of one address of an email server.
+type AddressHealth struct {
+	IP        string    `json:"ip"`
+	Healthy   bool      `json:"healthy"`
+	LastError string    `json:"lastError,omitempty"` // Error of the last failed probe
+	LastSeen  time.Time `json:"lastSeen,omitzero"`   // Time of the last successful probe
+}
+
+func NewUpstreamHealth() *UpstreamHealth {
+	return &UpstreamHealth{servers: make(map[string]*ServerHealth), stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Start probes all email servers at once, then every smtpProbe.interval until Close.
+// The servers are taken from the configuration in force at every round, so reloads are followed.
+func (h *UpstreamHealth) Start() {
+	h.checkAll()
+	go func() {
+		defer close(h.done)
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-time.After(time.Duration(Cfg().SmtpProbe.Interval) * time.Second):
+				h.checkAll()
+			}
+		}
+	}()
+}
+
+// Close stops probing and waits for the running round to finish.
+func (h *UpstreamHealth) Close() {
+	select {
+	case <-h.stop:
+		return
+	default:
+		close(h.stop)
+	}
+	<-h.done
+}
+
+// Addresses returns the healthy addresses of the email server of item, in the order of its addressFamily
+// (see orderAddresses). A server that has not been probed yet, e.g. one added by a reload, is probed first.
+// Without any healthy address, it fails at once with a 451 reply.
+func (h *UpstreamHealth) Addresses(item EmailServerItem) ([]string, error) {
+	key := net.JoinHostPort(item.Server, strconv.Itoa(item.Port))
+	h.mu.Lock()
+	state, ok := h.servers[key]
+	h.mu.Unlock()
+	if !ok {
+		state = h.check(item)
+	}
+	family := item.AddressFamily
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var healthy []string
+	reason := state.LookupError
+	for _, addr := range state.Addresses {
+		if addr.Healthy {
+			healthy = append(healthy, addr.IP)
+		} else if reason == "" {
+			reason = addr.LastError
+		}
+	}
+	if addrs := orderAddresses(healthy, family); len(addrs) > 0 {
+		return addrs, nil
+	}
+	if reason == "" {
+		reason = "no " + family + " address"
+	}
+	slog.Error(fmt.Sprintf("no healthy address of the SMTP server %s: %s", key, reason))
+	return nil, fmt.Errorf("%w (%s: %s)", errNoHealthyAddress, key, reason)
+}
+
+// List returns the probe state of all email servers, sorted by server.
+func (h *UpstreamHealth) List() []ServerHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]ServerHealth, 0, len(h.servers))
+	for _, state := range h.servers {
+		copied := *state
+		copied.Addresses = slices.Clone(state.Addresses)
+		list = append(list, copied)
+	}
+	slices.SortFunc(list, func(a, b ServerHealth) int {
+		if a.Server != b.Server {
+			if a.Server < b.Server {
+				return -1
+			}
+			return 1
+		}
+		return a.Port - b.Port
+	})
+	return list
+}
+
+// checkAll probes the email servers of the configuration in parallel, and forgets the ones no longer configured.
+func (h *UpstreamHealth) checkAll() {
+	configured := make(map[string]EmailServerItem)
+	for _, item := range Cfg().EmailServer {
+		configured[net.JoinHostPort(item.Server, strconv.Itoa(item.Port))] = item
+	}
+
+	h.mu.Lock()
+	for key := range h.servers {
+		if _, ok := configured[key]; !ok {
+			delete(h.servers, key)
+		}
+	}
+	h.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, item := range configured {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.check(item)
+		}()
+	}
+	wg.Wait()
+}
+
+// check resolves the server name, probes every address and records the result.
+func (h *UpstreamHealth) check(item EmailServerItem) *ServerHealth {
+	probe := Cfg().SmtpProbe
+	timeout := time.Duration(probe.Timeout) * time.Second
+	server, port := item.Server, item.Port
+	key := net.JoinHostPort(server, strconv.Itoa(port))
+
+	h.mu.Lock()
+	state, ok := h.servers[key]
+	if !ok {
+		state = &ServerHealth{Server: server, Port: port}
+		h.servers[key] = state
+	}
+	previous := slices.Clone(state.Addresses)
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", server)
+	cancel()
+	lookupError := ""
+	if err != nil {
+		lookupError = err.Error()
+		slog.Error(fmt.Sprintf("DNS lookup failed for SMTP server %s: %s", server, lookupError))
+	}
+
+	// 重新解析失败时继续探测上次解析到的地址
+	addrs := previous
+	if err == nil {
+		addrs = make([]AddressHealth, len(ips))
+		for i, ip := range ips {
+			addrs[i] = AddressHealth{IP: ip.String()}
+			if j := slices.IndexFunc(previous, func(a AddressHealth) bool { return a.IP == ip.String() }); j >= 0 {
+				addrs[i] = previous[j]
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addr := &addrs[i]
+			err := probeSMTP(addr.IP, item, probe.EHLO, timeout)
+			switch {
+			case err == nil:
+				if !addr.Healthy && !addr.LastSeen.IsZero() {
+					slog.Info(fmt.Sprintf("SMTP server %s is reachable again at %s", server, addr.IP))
+				}
+				addr.Healthy, addr.LastError, addr.LastSeen = true, "", time.Now()
+			default:
+				if addr.Healthy {
+					slog.Warn(fmt.Sprintf("SMTP server %s is not reachable at %s: %s", server, addr.IP, err.Error()))
+				}
+				addr.Healthy, addr.LastError = false, err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state.Addresses, state.LookupError, state.CheckedAt = addrs, lookupError, time.Now()
+	if len(addrs) == 0 && lookupError == "" {
+		state.LookupError = "no addresses found"
+	}
+	return state
+}
+
+// probeSMTP connects to the address of the email server of item and, with ehlo, also waits for the 220 greeting,
+// exchanges EHLO and quits, all within timeout. With implicit TLS, the TLS handshake comes first.
+func probeSMTP(ip string, item EmailServerItem, ehlo bool, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(item.Port)), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !ehlo {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if item.TLS == UpstreamTLSImplicit {
+		conn = tls.Client(conn, item.clientTLSConfig())
+	}
+	c, err := smtp.NewClient(conn, item.Server)
+	if err != nil {
+		return err
+	}
+	if err = c.Hello("localhost"); err != nil {
+		return err
+	}
+	c.Quit() // The server has answered EHLO, a missing reply to QUIT does not make it unhealthy
+	return nil
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func useProbeConfig(t *testing.T) {
+	t.Helper()
+	cfg := &Config{}
+	cfg.SmtpProbe.Enable = true
+	cfg.SmtpProbe.Timeout = 5
+	cfg.SmtpProbe.EHLO = true
+	useConfig(t, cfg)
+}
+
+func TestUpstreamHealthProbe(t *testing.T) {
+	useProbeConfig(t)
+	f := newFakeUpstream(t)
+	item := EmailServerItem{Server: "127.0.0.1", Port: f.port()}
+	h := NewUpstreamHealth()
+
+	// A server not probed yet is probed on first use.
+	if addrs, err := h.Addresses(item); err != nil || !slices.Equal(addrs, []string{"127.0.0.1"}) {
+		t.Fatalf("Addresses() = %v, %v", addrs, err)
+	}
+
+	// Once the server is down, relays fail at once with a 451 reply instead of trying to connect.
+	f.ln.Close()
+	h.check(item)
+	if addrs, err := h.Addresses(item); !errors.Is(err, errNoHealthyAddress) {
+		t.Errorf("Addresses() = %v, %v, want %v", addrs, err, errNoHealthyAddress)
+	}
+	if list := h.List(); len(list) != 1 || list[0].Addresses[0].Healthy || list[0].Addresses[0].LastError == "" {
+		t.Errorf("List() = %+v, want the address unhealthy with its error", list)
+	}
+}
+
+func TestUpstreamHealthFailover(t *testing.T) {
+	useProbeConfig(t)
+	f := newFakeUpstream(t)
+	h := NewUpstreamHealth()
+	old := UpstreamHealthIns
+	UpstreamHealthIns = h
+	t.Cleanup(func() { UpstreamHealthIns = old })
+
+	// The addresses that failed their last probe are skipped, the others keep the order of addressFamily.
+	item := EmailServerItem{Server: "mail.example.com", Port: f.port(), AuthMechanisms: "PLAIN"}
+	h.servers[net.JoinHostPort(item.Server, strconv.Itoa(item.Port))] = &ServerHealth{Server: item.Server, Port: item.Port, Addresses: []AddressHealth{
+		{IP: "192.0.2.1", LastError: "connection refused"},
+		{IP: "2001:db8::1", Healthy: true},
+		{IP: "127.0.0.1", Healthy: true},
+	}}
+	for family, want := range map[string][]string{
+		AddressFamilyPreferV4: {"127.0.0.1", "2001:db8::1"},
+		AddressFamilyPreferV6: {"2001:db8::1", "127.0.0.1"},
+		AddressFamilyIPv4Only: {"127.0.0.1"},
+	} {
+		item.AddressFamily = family
+		if addrs, err := h.Addresses(item); err != nil || !slices.Equal(addrs, want) {
+			t.Errorf("Addresses() with %s = %v, %v, want %v", family, addrs, err, want)
+		}
+	}
+
+	item.AddressFamily = AddressFamilyIPv4Only
+	msg := bytes.NewReader([]byte("Subject: test\r\n\r\nbody\r\n"))
+	if err := SendMailExt(context.Background(), item, "", "", "user@example.com", []string{"rcpt@example.org"}, MailOptions{}, msg); err != nil {
+		t.Fatalf("SendMailExt() = %v", err)
+	}
+	if n := f.received(); n != 1 {
+		t.Errorf("upstream received %d emails, want 1 at the healthy address", n)
+	}
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/naive9527/mitmsmtpd/smtpd"
+)
+
+// TLS modes of a listener.
+const (
+	ListenerTLSNone     = "none"     // Plain text only
+	ListenerTLSStartTLS = "starttls" // Plain text, upgraded with STARTTLS
+	ListenerTLSImplicit = "implicit" // TLS from the first byte (SMTPS, port 465)
+)
+
+// Listener is one address the gateway accepts SMTP connections on. Every listener has its own TLS and AUTH
+// requirements, and rules can be restricted to some listeners with the listener condition.
+// The listeners share the queue, the credential cache, the access list, the bans and the hourly recipient quota.
+type Listener struct {
+	Name          string   `yaml:"name"`          // Used in logs and by the listener rule condition, the address by default
+	Address       string   `yaml:"address"`       // Listening address, e.g. ":587"
+	TLS           string   `yaml:"tls"`           // none, starttls or implicit; starttls by default if smtpdTLS is enabled, none otherwise
+	RequireTLS    bool     `yaml:"requireTLS"`    // starttls: refuse AUTH and mail commands until the client has issued STARTTLS
+	AuthRequired  *bool    `yaml:"authRequired"`  // Refuse mail commands until the client has authenticated, smtpdAuth.required by default
+	ProxyProtocol []string `yaml:"proxyProtocol"` // Load balancers that send a PROXY protocol header, smptdServer.proxyProtocol by default
+}
+
+// compileListeners checks the listeners and fills in their defaults. Without any listener, the single one
+// of older configurations is derived from smptdServer.address, smtpdTLS.enabled and smtpdAuth.required.
+func (cfg *Config) compileListeners() error {
+	if len(cfg.Listeners) == 0 {
+		cfg.Listeners = []Listener{{Address: cfg.SmptdServer.Address}}
+	}
+
+	var errs []error
+	var names, addresses []string
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		name := fmt.Sprintf("listeners[%d]", i)
+		if l.Name == "" {
+			l.Name = l.Address
+		} else {
+			name = fmt.Sprintf("listeners[%d] (%s)", i, l.Name)
+		}
+		if l.Address == "" {
+			errs = append(errs, fmt.Errorf("%s.address: missing", name))
+		} else if slices.Contains(addresses, l.Address) {
+			errs = append(errs, fmt.Errorf("%s.address: %q is used by another listener", name, l.Address))
+		}
+		if slices.Contains(names, l.Name) {
+			errs = append(errs, fmt.Errorf("%s.name: %q is used by another listener", name, l.Name))
+		}
+		names, addresses = append(names, l.Name), append(addresses, l.Address)
+
+		if l.TLS == "" {
+			l.TLS = ListenerTLSNone
+			if cfg.SmtpdTLS.TLSEnabled {
+				l.TLS = ListenerTLSStartTLS
+			}
+		}
+		switch l.TLS {
+		case ListenerTLSNone:
+			if l.RequireTLS {
+				errs = append(errs, fmt.Errorf("%s.requireTLS: the listener has no TLS", name))
+			}
+		case ListenerTLSStartTLS, ListenerTLSImplicit:
+			if !cfg.SmtpdTLS.TLSEnabled {
+				errs = append(errs, fmt.Errorf("%s.tls: %s needs the certificate of smtpdTLS, which is not enabled", name, l.TLS))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s.tls: unknown mode %q (use none, starttls or implicit)", name, l.TLS))
+		}
+
+		if l.AuthRequired == nil {
+			required := cfg.SmtpdAuth.Required
+			l.AuthRequired = &required
+		}
+		if *l.AuthRequired && l.TLS == ListenerTLSNone {
+			errs = append(errs, fmt.Errorf("%s: authentication is required but the listener has no TLS, the credentials would be sent in clear", name))
+		}
+
+		for _, addr := range l.ProxyProtocol {
+			if _, err := parseIPNet(addr); err != nil {
+				errs = append(errs, fmt.Errorf("%s.proxyProtocol: %w", name, err))
+			}
+		}
+		if l.ProxyProtocol == nil {
+			l.ProxyProtocol = cfg.SmptdServer.ProxyProtocol
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// listener returns the listener with the given name, nil if there is none.
+func (cfg *Config) listener(name string) *Listener {
+	for i := range cfg.Listeners {
+		if cfg.Listeners[i].Name == name {
+			return &cfg.Listeners[i]
+		}
+	}
+	return nil
+}
+
+// RecipientQuotaIns is the hourly recipient quota of limits.maxRecipientsPerHour, shared by all the listeners.
+var RecipientQuotaIns = smtpd.NewRecipientQuota()
+
+// NewServer creates the SMTP server of a listener. It is the only place where smtpd.Server is configured, every
+// listener gets the settings of smptdServer, smtpdAuth and limits plus its own. The certificate is served from
+// TLSConfig.GetCertificate, so that it can be replaced on reload.
+func (cfg *Config) NewServer(l Listener) *smtpd.Server {
+	server := cfg.SmptdServer
+	srv := &smtpd.Server{
+		Name:              l.Name,
+		Addr:              l.Address,
+		Appname:           server.Appname,
+		Hostname:          server.Hostname,
+		SessionHandler:    Gateway{},
+		AuthMechs:         cfg.SmtpdAuth.Mechanisms,
+		AuthRequired:      *l.AuthRequired,
+		MaxSize:           server.MaxSize,
+		MaxRecipients:     server.MaxRecipients,
+		Timeout:           time.Duration(server.Timeout) * time.Second,
+		DisableReverseDNS: server.DisableReverseDNS,
+		XClientAllowed:    server.XClientAllowed,
+		SpoolDir:          server.SpoolDir,
+		SpoolThreshold:    server.SpoolThreshold,
+		ProxyProtocol:     l.ProxyProtocol,
+		Limits:            smtpd.Limits(cfg.Limits),
+		RecipientQuota:    RecipientQuotaIns,
+	}
+	if l.TLS != ListenerTLSNone {
+		srv.TLSConfig = ServerTLSConfig()
+		srv.TLSListener = l.TLS == ListenerTLSImplicit
+		srv.TLSRequired = l.RequireTLS
+	}
+	if server.Debug {
+		srv.LogRead, srv.LogWrite = logTranscript, logTranscript
+	}
+	return srv
+}
+
+// logTranscript writes the SMTP conversation to the gateway log in debug mode, without the credentials.
+func logTranscript(remoteIP, verb, line string) {
+	if verb == "READ" {
+		line = redactCredentials(line)
+	}
+	slog.Info("SMTP "+verb, "ClientIP", remoteIP, "Line", line)
+}
+
+// smtpCommands are the commands the transcript shows in full.
+var smtpCommands = map[string]bool{
+	"HELO": true, "EHLO": true, "MAIL": true, "RCPT": true, "DATA": true, "BDAT": true, "RSET": true,
+	"NOOP": true, "QUIT": true, "VRFY": true, "EXPN": true, "HELP": true, "STARTTLS": true, "XCLIENT": true,
+}
+
+// redactCredentials hides the initial response of AUTH and, since the message itself is not logged, every other
+// line that is not a command: those are the responses to the 334 challenges of AUTH (RFC 4954), which carry the
+// username and the password in base64.
+func redactCredentials(line string) string {
+	verb, arg, _ := strings.Cut(line, " ")
+	switch {
+	case strings.EqualFold(verb, "AUTH"):
+		if mechanism, response, ok := strings.Cut(arg, " "); ok && response != "" {
+			return verb + " " + mechanism + " [redacted]"
+		}
+		return line
+	case smtpCommands[strings.ToUpper(verb)]:
+		return line
+	default:
+		return "[redacted]"
+	}
+}
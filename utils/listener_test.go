@@ -0,0 +1,23 @@
+package utils
+
+import "testing"
+
+func TestRedactCredentials(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"EHLO client.example.com", "EHLO client.example.com"},
+		{"MAIL FROM:<user@example.com>", "MAIL FROM:<user@example.com>"},
+		{"AUTH LOGIN", "AUTH LOGIN"},
+		{"AUTH PLAIN AHVzZXJAZXhhbXBsZS5jb20Ac2VjcmV0", "AUTH PLAIN [redacted]"},
+		{"auth login dXNlckBleGFtcGxlLmNvbQ==", "auth login [redacted]"},
+		{"dXNlckBleGFtcGxlLmNvbQ==", "[redacted]"}, // Response to a 334 challenge
+		{"c2VjcmV0", "[redacted]"},
+		{"*", "[redacted]"},
+	}
+	for _, tt := range tests {
+		if got := redactCredentials(tt.line); got != tt.want {
+			t.Errorf("redactCredentials(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"reflect"
 	"strings"
@@ -19,15 +20,20 @@ func fieldIsEnabled(fieldType reflect.StructField, field reflect.Value) bool {
 	enabledField := field.Elem().FieldByName("Enabled") // 假设子结构体有 Enabled 字段
 	return enabledField.IsValid() && enabledField.Bool()
 }
-func TriggerErrNotification(content, clientip, from string, to []string, data []byte) error {
+func TriggerErrNotification(content, clientip, from string, to []string, data io.Reader) error {
 	var senderror = strings.Builder{}
-	emailFile, err := SaveMail(data)
-	if err != nil {
-		content = fmt.Sprintf("%s\n%s", content, err.Error())
+	var emailFile string
+	var err error
+	// data is nil if the email was refused before DATA
+	if data != nil {
+		emailFile, err = SaveMail(data)
+		if err != nil {
+			content = fmt.Sprintf("%s\n%s", content, err.Error())
+		}
 	}
 
-	v := reflect.ValueOf(&CFG.Notification).Elem() // 获取结构体的反射值（注意指针解引用）
-	t := v.Type()                                  // 获取结构体类型信息
+	v := reflect.ValueOf(&Cfg().Notification).Elem() // 获取结构体的反射值（注意指针解引用）
+	t := v.Type()                                    // 获取结构体类型信息
 	// 遍历 Notification 结构体并执行 Send 方法
 	for i := 0; i < v.NumField(); i++ {
 		field := v.Field(i)     // 获取字段的反射值
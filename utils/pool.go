@@ -0,0 +1,328 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// UpstreamPoolIns reuses authenticated upstream connections, nil if upstreamPool is not enabled.
+var UpstreamPoolIns *UpstreamPool
+
+// UpstreamPool keeps authenticated SMTP connections to the upstream servers open, per emailServer and account,
+// so that bulk senders do not log in again for every email. After an email the connection is reset with RSET
+// and kept for the next one. It is closed after maxMessages emails, once idle for idleTimeout, or when the NOOP
+// sent to connections idle for longer than healthCheck fails. At most maxActive emails per account are relayed
+// at the same time, the others wait.
+type UpstreamPool struct {
+	maxIdle     int
+	maxActive   int
+	maxMessages int
+	idleTimeout time.Duration
+	healthCheck time.Duration
+
+	mu       sync.Mutex
+	accounts map[poolKey]*poolAccount
+	dials    uint64
+	reuses   uint64
+	stop     chan struct{}
+}
+
+// poolKey identifies the connections of an account on an upstream server.
+type poolKey struct {
+	server   string
+	port     int
+	username string
+}
+
+type poolAccount struct {
+	digest [sha256.Size]byte // passwordDigest of the current password, connections authenticated with another one are not reused
+	idle   []*upstreamConn   // Most recently used last
+	active int               // Emails being relayed
+	slots  chan struct{}     // Holds a token for every email being relayed, nil without maxActive
+}
+
+// UpstreamPoolStats is part of the answer to GET /stats.
+type UpstreamPoolStats struct {
+	Accounts int    `json:"accounts"` // Accounts with open connections
+	Idle     int    `json:"idle"`     // Idle connections
+	Active   int    `json:"active"`   // Emails being relayed or waiting for a slot
+	Dials    uint64 `json:"dials"`    // Connections opened and authenticated
+	Reuses   uint64 `json:"reuses"`   // Emails relayed over an idle connection
+}
+
+// upstreamCommandTimeout bounds RSET, NOOP and QUIT on pooled connections.
+const upstreamCommandTimeout = 30 * time.Second
+
+// NewUpstreamPool returns a pool with the settings of upstreamPool; the durations are in seconds.
+func NewUpstreamPool(maxIdle, maxActive, maxMessages, idleTimeout, healthCheck int) *UpstreamPool {
+	return &UpstreamPool{
+		maxIdle:     maxIdle,
+		maxActive:   maxActive,
+		maxMessages: maxMessages,
+		idleTimeout: time.Duration(idleTimeout) * time.Second,
+		healthCheck: time.Duration(healthCheck) * time.Second,
+		accounts:    make(map[poolKey]*poolAccount),
+		stop:        make(chan struct{}),
+	}
+}
+
+// Send relays an email over an idle connection of the account, or over a new one opened with dial. A reused
+// connection that turns out to be broken at MAIL FROM, see staleConn, is dropped and the email is sent over a new
+// one; nothing has been sent over the old one yet. Unless the connection failed, it is reset and kept for the
+// next email.
+// The connection is closed as soon as ctx is cancelled.
+func (p *UpstreamPool) Send(ctx context.Context, key poolKey, password string, dial func(ctx context.Context) (*upstreamConn, error), from string, to []string, opts MailOptions, msg Message) error {
+	digest := passwordDigest(password)
+	acc, err := p.acquire(ctx, key, digest)
+	if err != nil {
+		return err
+	}
+	defer p.release(key, acc)
+
+	fresh := false // An idle connection turned out to be stale, the others are likely to be too
+	for {
+		var uc *upstreamConn
+		if !fresh {
+			uc = p.takeIdle(key, acc)
+		}
+		reused := uc != nil
+		if !reused {
+			if uc, err = dial(ctx); err != nil {
+				return err
+			}
+			uc.digest = digest
+			p.mu.Lock()
+			p.dials++
+			p.mu.Unlock()
+		}
+
+		stop := context.AfterFunc(ctx, func() { uc.conn.Close() })
+		err = mailFrom(uc.client, from, to, opts, msg)
+		if reused && staleConn(err) && ctx.Err() == nil {
+			stop()
+			uc.client.Close()
+			slog.Warn(fmt.Sprintf("pooled connection to %s for %s is broken, retrying on a new one: %s", key.server, key.username, err.Error()))
+			fresh = true
+			continue
+		}
+		if err == nil {
+			err = rcptData(uc.client, to, opts, msg)
+		}
+		if !stop() {
+			uc.client.Close()
+			if err == nil {
+				err = ctx.Err()
+			}
+			return err
+		}
+
+		if reused {
+			p.mu.Lock()
+			p.reuses++
+			p.mu.Unlock()
+		}
+		uc.messages++
+		// Refused commands leave the connection usable, anything else does not.
+		if err == nil || isUpstreamReply(err) {
+			p.putIdle(key, acc, uc)
+		} else {
+			uc.client.Close()
+		}
+		return err
+	}
+}
+
+// acquire registers an email of the account, waiting for a free slot with maxActive.
+// A new password makes the idle connections of the old one useless, they are closed.
+func (p *UpstreamPool) acquire(ctx context.Context, key poolKey, digest [sha256.Size]byte) (*poolAccount, error) {
+	p.mu.Lock()
+	acc, ok := p.accounts[key]
+	if !ok {
+		acc = &poolAccount{digest: digest}
+		if p.maxActive > 0 {
+			acc.slots = make(chan struct{}, p.maxActive)
+		}
+		p.accounts[key] = acc
+	}
+	var stale []*upstreamConn
+	if acc.digest != digest {
+		acc.digest, stale, acc.idle = digest, acc.idle, nil
+	}
+	acc.active++ // Keeps the janitor from dropping the account while waiting
+	p.mu.Unlock()
+	closeUpstreamConns(stale)
+
+	if acc.slots != nil {
+		select {
+		case acc.slots <- struct{}{}:
+		case <-ctx.Done():
+			p.mu.Lock()
+			acc.active--
+			p.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	return acc, nil
+}
+
+func (p *UpstreamPool) release(key poolKey, acc *poolAccount) {
+	if acc.slots != nil {
+		<-acc.slots
+	}
+	p.mu.Lock()
+	acc.active--
+	p.mu.Unlock()
+}
+
+// takeIdle returns the most recently used idle connection of the account that is still alive, nil if none is left.
+func (p *UpstreamPool) takeIdle(key poolKey, acc *poolAccount) *upstreamConn {
+	for {
+		p.mu.Lock()
+		if len(acc.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		uc := acc.idle[len(acc.idle)-1]
+		acc.idle = acc.idle[:len(acc.idle)-1]
+		p.mu.Unlock()
+
+		idle := time.Since(uc.lastUsed)
+		if idle >= p.idleTimeout {
+			closeUpstreamConns([]*upstreamConn{uc})
+			continue
+		}
+		if idle >= p.healthCheck {
+			uc.conn.SetDeadline(time.Now().Add(upstreamCommandTimeout))
+			err := uc.client.Noop()
+			uc.conn.SetDeadline(time.Time{})
+			if err != nil {
+				slog.Warn(fmt.Sprintf("pooled connection to %s for %s failed the health check: %s", key.server, key.username, err.Error()))
+				uc.client.Close()
+				continue
+			}
+		}
+		return uc
+	}
+}
+
+// putIdle resets the connection with RSET and keeps it, unless it has sent maxMessages emails, the password has
+// changed meanwhile or maxIdle connections are kept already.
+func (p *UpstreamPool) putIdle(key poolKey, acc *poolAccount, uc *upstreamConn) {
+	if uc.messages >= p.maxMessages {
+		closeUpstreamConns([]*upstreamConn{uc})
+		return
+	}
+	uc.conn.SetDeadline(time.Now().Add(upstreamCommandTimeout))
+	err := uc.client.Reset()
+	uc.conn.SetDeadline(time.Time{})
+	if err != nil {
+		slog.Warn(fmt.Sprintf("pooled connection to %s for %s could not be reset: %s", key.server, key.username, err.Error()))
+		uc.client.Close()
+		return
+	}
+	uc.lastUsed = time.Now()
+
+	p.mu.Lock()
+	if uc.digest == acc.digest && len(acc.idle) < p.maxIdle {
+		acc.idle = append(acc.idle, uc)
+		uc = nil
+	}
+	p.mu.Unlock()
+	if uc != nil {
+		closeUpstreamConns([]*upstreamConn{uc})
+	}
+}
+
+// StartJanitor closes the connections idle for longer than idleTimeout every interval.
+func (p *UpstreamPool) StartJanitor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case now := <-ticker.C:
+				p.expire(now)
+			}
+		}
+	}()
+}
+
+func (p *UpstreamPool) expire(now time.Time) {
+	var expired []*upstreamConn
+	p.mu.Lock()
+	for key, acc := range p.accounts {
+		kept := acc.idle[:0]
+		for _, uc := range acc.idle {
+			if now.Sub(uc.lastUsed) >= p.idleTimeout {
+				expired = append(expired, uc)
+			} else {
+				kept = append(kept, uc)
+			}
+		}
+		acc.idle = kept
+		if len(acc.idle) == 0 && acc.active == 0 {
+			delete(p.accounts, key)
+		}
+	}
+	p.mu.Unlock()
+	closeUpstreamConns(expired)
+}
+
+// Close stops the janitor and closes the idle connections with QUIT.
+func (p *UpstreamPool) Close() {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	var idle []*upstreamConn
+	p.mu.Lock()
+	for _, acc := range p.accounts {
+		idle, acc.idle = append(idle, acc.idle...), nil
+	}
+	p.mu.Unlock()
+	closeUpstreamConns(idle)
+}
+
+// Stats returns the current numbers of the pool.
+func (p *UpstreamPool) Stats() UpstreamPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := UpstreamPoolStats{Accounts: len(p.accounts), Dials: p.dials, Reuses: p.reuses}
+	for _, acc := range p.accounts {
+		stats.Idle += len(acc.idle)
+		stats.Active += acc.active
+	}
+	return stats
+}
+
+// closeUpstreamConns ends the sessions politely with QUIT, then closes the connections.
+func closeUpstreamConns(conns []*upstreamConn) {
+	for _, uc := range conns {
+		uc.conn.SetDeadline(time.Now().Add(upstreamCommandTimeout))
+		if err := uc.client.Quit(); err != nil {
+			uc.client.Close()
+		}
+	}
+}
+
+// staleConn reports whether err to the first command over a reused connection means that the connection can no
+// longer be used: a network error, or a 4xx reply such as the 421 of a server that has timed the session out.
+func staleConn(err error) bool {
+	var protoErr *textproto.Error
+	return err != nil && (!errors.As(err, &protoErr) || protoErr.Code < 500)
+}
+
+// isUpstreamReply reports whether err is a reply of the upstream server, i.e. the connection is still in sync.
+func isUpstreamReply(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr)
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func poolSend(t *testing.T, p *UpstreamPool, f *fakeUpstream, password string) error {
+	t.Helper()
+	item := EmailServerItem{Server: "localhost", Port: f.port()}
+	dial := func(ctx context.Context) (*upstreamConn, error) {
+		return dialUpstream(ctx, []string{"127.0.0.1"}, item, nil)
+	}
+	key := poolKey{item.Server, item.Port, "user@example.com"}
+	msg := bytes.NewReader([]byte("Subject: test\r\n\r\nbody\r\n"))
+	return p.Send(context.Background(), key, password, dial, "user@example.com", []string{"rcpt@example.org"}, MailOptions{}, msg)
+}
+
+func TestUpstreamPoolReuse(t *testing.T) {
+	f := newFakeUpstream(t)
+	p := NewUpstreamPool(2, 0, 3, 60, 60)
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := poolSend(t, p, f, "secret"); err != nil {
+			t.Fatalf("Send() = %v", err)
+		}
+	}
+	if stats := p.Stats(); f.connections() != 1 || stats.Dials != 1 || stats.Reuses != 2 || stats.Idle != 0 {
+		t.Errorf("after 3 emails: %d connections, stats %+v, want one closed after maxMessages", f.connections(), stats)
+	}
+
+	// A connection is not reused with another password.
+	if err := poolSend(t, p, f, "secret"); err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+	if err := poolSend(t, p, f, "changed"); err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+	if n := f.connections(); n != 3 {
+		t.Errorf("got %d connections, want a new one for the new password", n)
+	}
+	if n := f.received(); n != 5 {
+		t.Errorf("upstream received %d emails, want 5", n)
+	}
+}
+
+func TestUpstreamPoolStaleConnection(t *testing.T) {
+	f := newFakeUpstream(t)
+	// The first connection times out after its first email, like a server closing idle sessions.
+	f.mailFrom = func(conn, n int) string {
+		if conn == 1 && n > 1 {
+			return "421 4.4.2 idle for too long, closing connection"
+		}
+		return "250 OK"
+	}
+	p := NewUpstreamPool(2, 0, 100, 60, 60)
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := poolSend(t, p, f, "secret"); err != nil {
+			t.Fatalf("Send() %d = %v", i+1, err)
+		}
+	}
+	if n, received := f.connections(), f.received(); n != 2 || received != 2 {
+		t.Errorf("got %d connections and %d emails, want the second email sent over a new connection", n, received)
+	}
+}
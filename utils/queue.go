@@ -0,0 +1,635 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var QueueIns *MailQueue
+
+var errRouteNotConfigured = errors.New("the email server is not configured")
+
+// errCredentialUnavailable is returned for a queued email whose credentials can not be opened, e.g. because
+// the queue key has been replaced. Retrying can not help, the email is given up at once.
+var errCredentialUnavailable = errors.New("the credentials of the sender are not available")
+
+// QueuedMail is the envelope and delivery state stored next to every spooled message.
+type QueuedMail struct {
+	ID          string      `json:"id"`
+	ClientIP    string      `json:"clientIP"`
+	AuthUser    string      `json:"authUser"`
+	Route       string      `json:"route,omitempty"`
+	From        string      `json:"from"`
+	To          []string    `json:"to"`
+	Options     MailOptions `json:"options"`
+	Size        int         `json:"size"`
+	CreatedAt   time.Time   `json:"createdAt"`
+	Attempts    int         `json:"attempts"`
+	NextAttempt time.Time   `json:"nextAttempt"`
+	LastError   string      `json:"lastError,omitempty"`
+	Credential  []byte      `json:"credential,omitempty"` // Password of AuthUser sealed with the queue key, see MailQueue.seal
+
+	DelayNotified bool `json:"delayNotified,omitempty"` // A delay DSN has been sent
+}
+
+// DeliverFunc relays one spooled message upstream with the password of mail.AuthUser, reading it from the spool file.
+type DeliverFunc func(mail *QueuedMail, password string, msg Message) error
+
+// ReportFunc tells the sender of a spooled message that its delivery failed or is delayed, e.g. SendDSN.
+// causes holds the cause for each of the recipients concerned.
+type ReportFunc func(mail *QueuedMail, data []byte, action string, causes map[string]error) error
+
+// errDeliveryExpired wraps the last error of a message given up because it was queued longer than maxAge.
+var errDeliveryExpired = errors.New("delivery time expired")
+
+// MailQueue is a durable outbound spool. Every accepted message is written to disk as
+// <id>.eml (message) plus <id>.json (envelope and metadata) and delivered by background
+// workers, so an upstream outage only delays mail instead of failing it in DATA.
+// The password of the sender is stored in the envelope too, sealed with AES-GCM under the key in keyFile, so that
+// spooled emails can still be delivered after a restart. Whoever can read both the spool and the key file can
+// recover the passwords of the users with emails waiting; they are removed with the envelope once delivered.
+type MailQueue struct {
+	dir            string
+	aead           cipher.AEAD
+	workers        int
+	scanInterval   time.Duration
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxAge         time.Duration
+	delayWarning   time.Duration
+	deliver        DeliverFunc
+	report         ReportFunc
+
+	mu       sync.Mutex
+	inflight map[string]bool
+	jobs     chan string
+	wake     chan struct{}
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewMailQueue creates the spool directory if needed and returns a queue that is not yet running.
+// The key sealing the credentials is read from keyFile, or generated there on first use; by default it is
+// queue.key in the spool directory.
+// report is called when a message is given up, and once when it is still not delivered after delayWarning
+// seconds (0 = never); it may be nil.
+func NewMailQueue(dir, keyFile string, workers, scanInterval, initialBackoff, maxBackoff, maxAge, delayWarning int, deliver DeliverFunc, report ReportFunc) (*MailQueue, error) {
+	if dir == "" {
+		return nil, errors.New("queue path is not configured")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create queue path %s failed: %w", dir, err)
+	}
+	if keyFile == "" {
+		keyFile = filepath.Join(dir, "queue.key")
+	}
+	key, err := loadQueueKey(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("queue key %s: %w", keyFile, err)
+	}
+	aead, err := newAEAD(key)
+	clear(key)
+	if err != nil {
+		return nil, fmt.Errorf("queue key %s: %w", keyFile, err)
+	}
+	if workers <= 0 {
+		workers = 4
+	}
+	if scanInterval <= 0 {
+		scanInterval = 10
+	}
+	if initialBackoff <= 0 {
+		initialBackoff = 60
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = 3600
+	}
+	if maxAge <= 0 {
+		maxAge = 5 * 24 * 3600
+	}
+
+	return &MailQueue{
+		dir:            dir,
+		aead:           aead,
+		workers:        workers,
+		scanInterval:   time.Duration(scanInterval) * time.Second,
+		initialBackoff: time.Duration(initialBackoff) * time.Second,
+		maxBackoff:     time.Duration(maxBackoff) * time.Second,
+		maxAge:         time.Duration(maxAge) * time.Second,
+		delayWarning:   time.Duration(delayWarning) * time.Second,
+		deliver:        deliver,
+		report:         report,
+		inflight:       make(map[string]bool),
+		jobs:           make(chan string),
+		wake:           make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+	}, nil
+}
+
+// Start launches the scheduler and the delivery workers.
+// Messages left in the spool by a previous run are picked up on the first scan, after the leftovers of
+// interrupted writes have been removed.
+func (q *MailQueue) Start() {
+	q.recover()
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	q.wg.Add(1)
+	go q.scheduler()
+	slog.Info(fmt.Sprintf("Mail queue started, path %s, %d workers", q.dir, q.workers))
+}
+
+// Stop stops scheduling new deliveries and waits for the running ones to finish.
+func (q *MailQueue) Stop() {
+	select {
+	case <-q.stop:
+		return
+	default:
+		close(q.stop)
+	}
+	q.wg.Wait()
+	slog.Info("Mail queue stopped")
+}
+
+// Enqueue writes the message durably to the spool and returns its queue ID.
+// The message file is written before the envelope, so a crash in between never
+// leaves an envelope without a message behind. The message is copied to the file as a stream.
+// password is sealed into the envelope. route selects the emailServer entry, empty for the route derived
+// from authUser and from.
+func (q *MailQueue) Enqueue(clientIP, authUser, password, route, from string, to []string, opts MailOptions, msg Message) (string, error) {
+	id, err := newQueueID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	mail := &QueuedMail{
+		ID:          id,
+		ClientIP:    clientIP,
+		AuthUser:    authUser,
+		Route:       route,
+		From:        from,
+		To:          to,
+		Options:     opts,
+		Size:        int(msg.Size()),
+		CreatedAt:   now,
+		NextAttempt: now,
+	}
+	if authUser != "" {
+		if mail.Credential, err = q.seal(mail, password); err != nil {
+			return "", fmt.Errorf("seal credentials of %s failed: %w", id, err)
+		}
+	}
+
+	if err = copyFileSync(q.messagePath(id), messageReader(msg)); err != nil {
+		return "", fmt.Errorf("spool message %s failed: %w", id, err)
+	}
+	if err = q.saveEnvelope(mail); err != nil {
+		os.Remove(q.messagePath(id))
+		return "", fmt.Errorf("spool envelope %s failed: %w", id, err)
+	}
+
+	slog.Info("Email queued", "QueueID", id, "ClientIP", clientIP, "AuthUser", authUser, "From", from, "To", strings.Join(to, "; "), "Size", msg.Size())
+	q.notify()
+	return id, nil
+}
+
+// Len returns the number of messages currently in the spool.
+func (q *MailQueue) Len() int {
+	ids, _ := q.list()
+	return len(ids)
+}
+
+func (q *MailQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *MailQueue) scheduler() {
+	defer q.wg.Done()
+	defer close(q.jobs)
+
+	ticker := time.NewTicker(q.scanInterval)
+	defer ticker.Stop()
+
+	for {
+		q.dispatchDue()
+
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// dispatchDue hands every due message that is not already being delivered to the workers.
+func (q *MailQueue) dispatchDue() {
+	ids, err := q.list()
+	if err != nil {
+		slog.Error(fmt.Sprintf("scan mail queue %s failed: %s", q.dir, err.Error()))
+		return
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		mail, err := q.loadEnvelope(id)
+		if err != nil {
+			slog.Error(fmt.Sprintf("load queued mail %s failed: %s", id, err.Error()))
+			continue
+		}
+		if mail.NextAttempt.After(now) {
+			continue
+		}
+
+		q.mu.Lock()
+		busy := q.inflight[id]
+		if !busy {
+			q.inflight[id] = true
+		}
+		q.mu.Unlock()
+		if busy {
+			continue
+		}
+
+		select {
+		case q.jobs <- id:
+		case <-q.stop:
+			q.release(id)
+			return
+		}
+	}
+}
+
+func (q *MailQueue) release(id string) {
+	q.mu.Lock()
+	delete(q.inflight, id)
+	q.mu.Unlock()
+}
+
+func (q *MailQueue) worker() {
+	defer q.wg.Done()
+	for id := range q.jobs {
+		q.attempt(id)
+		q.release(id)
+	}
+}
+
+// attempt performs one delivery try and then removes, reschedules or expires the message.
+func (q *MailQueue) attempt(id string) {
+	mail, err := q.loadEnvelope(id)
+	if err != nil {
+		slog.Error(fmt.Sprintf("load queued mail %s failed: %s", id, err.Error()))
+		return
+	}
+	f, err := os.Open(q.messagePath(id))
+	var stat os.FileInfo
+	if err == nil {
+		stat, err = f.Stat()
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		slog.Error(fmt.Sprintf("read queued mail %s failed: %s", id, err.Error()))
+		return
+	}
+	msg := io.NewSectionReader(f, 0, stat.Size())
+
+	mail.Attempts++
+	password, err := q.open(mail)
+	if err == nil {
+		err = q.deliver(mail, password, msg)
+	}
+	var refused *recipientErrors
+	if errors.As(err, &refused) {
+		err = q.settleRecipients(mail, msg, refused)
+	}
+	if err == nil {
+		f.Close()
+		slog.Info("Queued email delivered", "QueueID", id, "From", mail.From, "Attempts", mail.Attempts)
+		q.remove(id)
+		return
+	}
+
+	mail.LastError = err.Error()
+	age := time.Since(mail.CreatedAt)
+	if isPermanentDeliveryError(err) || age >= q.maxAge {
+		info := fmt.Sprintf("queued email %s from %s given up after %d attempts (%s): %s", id, mail.From, mail.Attempts, age.Round(time.Second), mail.LastError)
+		slog.Error(info)
+		TriggerErrNotification(info, mail.ClientIP, mail.From, mail.To, messageReader(msg))
+		causes := causesFor(mail.To, err)
+		if !isPermanentDeliveryError(err) {
+			for rcpt, cause := range causes {
+				causes[rcpt] = fmt.Errorf("%w: %w", errDeliveryExpired, cause)
+			}
+		}
+		q.sendReport(mail, msg, DSNFailed, causes)
+		f.Close()
+		q.remove(id)
+		return
+	}
+
+	if q.delayWarning > 0 && age >= q.delayWarning && !mail.DelayNotified {
+		mail.DelayNotified = true
+		q.sendReport(mail, msg, DSNDelayed, causesFor(mail.To, err))
+	}
+	f.Close()
+
+	mail.NextAttempt = time.Now().Add(q.backoff(mail.Attempts))
+	slog.Warn("Queued email delivery deferred", "QueueID", id, "From", mail.From, "Attempts", mail.Attempts, "NextAttempt", mail.NextAttempt, "Error", mail.LastError)
+	if err = q.saveEnvelope(mail); err != nil {
+		slog.Error(fmt.Sprintf("update queued mail %s failed: %s", id, err.Error()))
+	}
+}
+
+// settleRecipients handles an email the upstream server refused some recipients of: those refused permanently
+// are given up and reported, the others are kept in mail.To to be retried. It returns the replies to the
+// recipients left, nil if there are none.
+func (q *MailQueue) settleRecipients(mail *QueuedMail, msg Message, refused *recipientErrors) error {
+	var delivered, failed []string
+	retry := &recipientErrors{}
+	for _, rcpt := range mail.To {
+		err, ok := refused.Errors[rcpt]
+		switch {
+		case !ok:
+			delivered = append(delivered, rcpt)
+		case isPermanentDeliveryError(err):
+			failed = append(failed, rcpt)
+		default:
+			retry.add(rcpt, err)
+		}
+	}
+	if len(delivered) > 0 {
+		slog.Info("Queued email delivered", "QueueID", mail.ID, "From", mail.From, "Recipients", strings.Join(delivered, "; "), "Attempts", mail.Attempts)
+	}
+	if len(failed) > 0 {
+		info := fmt.Sprintf("queued email %s from %s refused for %s: %s", mail.ID, mail.From, strings.Join(failed, "; "), refused.Error())
+		slog.Error(info)
+		TriggerErrNotification(info, mail.ClientIP, mail.From, failed, messageReader(msg))
+		q.sendReport(mail, msg, DSNFailed, causesFor(failed, refused))
+	}
+
+	mail.To = retry.Recipients
+	if len(mail.To) == 0 {
+		return nil
+	}
+	return retry
+}
+
+// causesFor returns the cause of the failure for each of the recipients: the reply to it if the upstream server
+// refused the recipients one by one, err otherwise.
+func causesFor(to []string, err error) map[string]error {
+	var refused *recipientErrors
+	errors.As(err, &refused)
+	causes := make(map[string]error, len(to))
+	for _, rcpt := range to {
+		causes[rcpt] = err
+		if refused != nil && refused.Errors[rcpt] != nil {
+			causes[rcpt] = refused.Errors[rcpt]
+		}
+	}
+	return causes
+}
+
+// sendReport calls the report function, if any, and logs its failure.
+// Reports are rare, the message is read into memory for them.
+func (q *MailQueue) sendReport(mail *QueuedMail, msg Message, action string, causes map[string]error) {
+	if q.report == nil {
+		return
+	}
+	data, err := io.ReadAll(messageReader(msg))
+	if err == nil {
+		err = q.report(mail, data, action, causes)
+	}
+	if err != nil {
+		slog.Error(err.Error(), "QueueID", mail.ID, "Action", action)
+	}
+}
+
+// backoff doubles the retry delay for every failed attempt, capped at maxBackoff.
+func (q *MailQueue) backoff(attempts int) time.Duration {
+	delay := q.initialBackoff
+	for i := 1; i < attempts && delay < q.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.maxBackoff {
+		delay = q.maxBackoff
+	}
+	return delay
+}
+
+func (q *MailQueue) remove(id string) {
+	// Remove the envelope first so a crash never leaves a message that would be delivered twice.
+	if err := os.Remove(q.envelopePath(id)); err != nil && !os.IsNotExist(err) {
+		slog.Error(fmt.Sprintf("remove queued envelope %s failed: %s", id, err.Error()))
+	}
+	if err := syncDir(q.dir); err != nil {
+		slog.Error(fmt.Sprintf("sync queue path %s failed: %s", q.dir, err.Error()))
+	}
+	if err := os.Remove(q.messagePath(id)); err != nil && !os.IsNotExist(err) {
+		slog.Error(fmt.Sprintf("remove queued message %s failed: %s", id, err.Error()))
+	}
+}
+
+// recover removes the files of interrupted writes: temporary files, and messages whose envelope was never
+// written, or was removed after delivery. The client was not told that such a message had been queued.
+func (q *MailQueue) recover() {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		slog.Error(fmt.Sprintf("scan mail queue %s failed: %s", q.dir, err.Error()))
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		orphan := strings.HasSuffix(name, ".tmp")
+		if id, ok := strings.CutSuffix(name, ".eml"); ok {
+			_, err := os.Stat(q.envelopePath(id))
+			orphan = os.IsNotExist(err)
+		}
+		if entry.IsDir() || !orphan {
+			continue
+		}
+		if err := os.Remove(filepath.Join(q.dir, name)); err != nil {
+			slog.Error(fmt.Sprintf("remove leftover queue file %s failed: %s", name, err.Error()))
+			continue
+		}
+		slog.Warn(fmt.Sprintf("Removed leftover queue file %s", name))
+	}
+}
+
+// list returns the IDs of all spooled messages, oldest first.
+func (q *MailQueue) list() ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, ".json"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (q *MailQueue) messagePath(id string) string {
+	return filepath.Join(q.dir, id+".eml")
+}
+
+func (q *MailQueue) envelopePath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+func (q *MailQueue) loadEnvelope(id string) (*QueuedMail, error) {
+	data, err := os.ReadFile(q.envelopePath(id))
+	if err != nil {
+		return nil, err
+	}
+	mail := new(QueuedMail)
+	if err = json.Unmarshal(data, mail); err != nil {
+		return nil, err
+	}
+	return mail, nil
+}
+
+func (q *MailQueue) saveEnvelope(mail *QueuedMail) error {
+	data, err := json.MarshalIndent(mail, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileSync(q.envelopePath(mail.ID), data)
+}
+
+// writeFileSync writes data to a temporary file, fsyncs it, renames it into place and syncs the directory.
+func writeFileSync(file string, data []byte) error {
+	return copyFileSync(file, bytes.NewReader(data))
+}
+
+// copyFileSync is writeFileSync for data read from r.
+func copyFileSync(file string, r io.Reader) error {
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, file); err != nil {
+		return err
+	}
+	// The rename itself is only durable once the directory is synced.
+	return syncDir(filepath.Dir(file))
+}
+
+// syncDir fsyncs the directory, making the files created, renamed or removed in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// seal encrypts the password of the sender of mail, bound to its queue ID and user.
+func (q *MailQueue) seal(mail *QueuedMail, password string) ([]byte, error) {
+	nonce := make([]byte, q.aead.NonceSize(), q.aead.NonceSize()+len(password)+q.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return q.aead.Seal(nonce, nonce, []byte(password), []byte(mail.ID+"\x00"+mail.AuthUser)), nil
+}
+
+// open returns the password sealed in the envelope, empty for an email that was received without AUTH.
+func (q *MailQueue) open(mail *QueuedMail) (string, error) {
+	if mail.AuthUser == "" {
+		return "", nil
+	}
+	size := q.aead.NonceSize()
+	if len(mail.Credential) < size {
+		return "", errCredentialUnavailable
+	}
+	password, err := q.aead.Open(nil, mail.Credential[:size], mail.Credential[size:], []byte(mail.ID+"\x00"+mail.AuthUser))
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errCredentialUnavailable, err)
+	}
+	defer clear(password)
+	return string(password), nil
+}
+
+// loadQueueKey reads the 32-byte key of the queue, generating it on first use.
+func loadQueueKey(file string) ([]byte, error) {
+	key, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err = writeFileSync(file, key); err != nil {
+			return nil, err
+		}
+		slog.Info(fmt.Sprintf("Generated the queue key %s", file))
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("the key must be 32 bytes long, not %d", len(key))
+	}
+	return key, nil
+}
+
+// newQueueID returns a sortable, unique queue ID such as 20250102150405.3F2A9C1D7B6E4F08.
+func newQueueID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return time.Now().Format("20060102150405") + "." + strings.ToUpper(hex.EncodeToString(buf)), nil
+}
+
+// isPermanentDeliveryError reports whether retrying the delivery can never succeed.
+func isPermanentDeliveryError(err error) bool {
+	if errors.Is(err, errRouteNotConfigured) || errors.Is(err, errCredentialUnavailable) {
+		return true
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 500
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useConfig makes cfg the configuration in force for the test, and runs it in a temporary working directory,
+// where SaveMail puts the emails of the notifications.
+func useConfig(t *testing.T, cfg *Config) {
+	t.Helper()
+	old := cfgPtr.Load()
+	cfgPtr.Store(cfg)
+	t.Cleanup(func() { cfgPtr.Store(old) })
+	t.Chdir(t.TempDir())
+}
+
+type deliveryLog struct {
+	mu        sync.Mutex
+	passwords []string
+	reports   []string
+	causes    []map[string]error
+	err       error
+}
+
+func (l *deliveryLog) deliver(mail *QueuedMail, password string, msg Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.passwords = append(l.passwords, password)
+	return l.err
+}
+
+func (l *deliveryLog) report(mail *QueuedMail, data []byte, action string, causes map[string]error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reports = append(l.reports, action)
+	l.causes = append(l.causes, causes)
+	return nil
+}
+
+func (l *deliveryLog) wait(t *testing.T, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		l.mu.Lock()
+		ok := done()
+		l.mu.Unlock()
+		if ok {
+			return
+		}
+	}
+	t.Fatal("timed out")
+}
+
+func newTestQueue(t *testing.T, dir string, log *deliveryLog) *MailQueue {
+	t.Helper()
+	q, err := NewMailQueue(dir, "", 1, 1, 60, 3600, 3600, 0, log.deliver, log.report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	useConfig(t, &Config{})
+	dir := t.TempDir()
+
+	// Spooled by a first process that stops before delivering it.
+	first := newTestQueue(t, dir, &deliveryLog{})
+	id, err := first.Enqueue("10.0.0.1", "user@example.com", "secret", "", "user@example.com", []string{"rcpt@example.org"}, MailOptions{}, bytes.NewReader([]byte("Subject: test\r\n\r\nbody\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, _ := os.ReadFile(filepath.Join(dir, id+".json"))
+	if bytes.Contains(envelope, []byte("secret")) {
+		t.Error("password stored in clear")
+	}
+
+	log := &deliveryLog{}
+	second := newTestQueue(t, dir, log)
+	second.Start()
+	defer second.Stop()
+	log.wait(t, func() bool { return len(log.passwords) == 1 })
+	if log.passwords[0] != "secret" {
+		t.Errorf("delivered with password %q", log.passwords[0])
+	}
+	log.wait(t, func() bool { return second.Len() == 0 })
+}
+
+func TestQueueCredentialsLost(t *testing.T) {
+	useConfig(t, &Config{})
+	dir := t.TempDir()
+
+	first := newTestQueue(t, dir, &deliveryLog{})
+	if _, err := first.Enqueue("10.0.0.1", "user@example.com", "secret", "", "user@example.com", []string{"rcpt@example.org"}, MailOptions{}, bytes.NewReader([]byte("Subject: test\r\n\r\nbody\r\n"))); err != nil {
+		t.Fatal(err)
+	}
+	// A new key can not open the credentials: the email is given up at once instead of retried until maxAge.
+	os.Remove(filepath.Join(dir, "queue.key"))
+
+	log := &deliveryLog{}
+	second := newTestQueue(t, dir, log)
+	second.Start()
+	defer second.Stop()
+	log.wait(t, func() bool { return len(log.reports) == 1 })
+	if log.reports[0] != DSNFailed || !errors.Is(log.causes[0]["rcpt@example.org"], errCredentialUnavailable) {
+		t.Errorf("got report %s for %v, want %s for %v", log.reports[0], log.causes[0], DSNFailed, errCredentialUnavailable)
+	}
+	if len(log.passwords) != 0 {
+		t.Error("delivered without credentials")
+	}
+	log.wait(t, func() bool { return second.Len() == 0 })
+}
+
+func TestQueueRemovesLeftovers(t *testing.T) {
+	useConfig(t, &Config{})
+	dir := t.TempDir()
+	q := newTestQueue(t, dir, &deliveryLog{})
+	id, err := q.Enqueue("10.0.0.1", "user@example.com", "secret", "", "user@example.com", []string{"rcpt@example.org"}, MailOptions{}, bytes.NewReader([]byte("Subject: test\r\n\r\nbody\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A crash before the envelope was written, and one while a file was written.
+	os.WriteFile(filepath.Join(dir, "20250102150405.0000000000000001.eml"), []byte("Subject: orphan\r\n\r\n"), 0600)
+	os.WriteFile(filepath.Join(dir, id+".json.tmp"), []byte("{"), 0600)
+
+	q.recover()
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	want := []string{id + ".eml", id + ".json", "queue.key"}
+	if !slices.Equal(names, want) {
+		t.Errorf("spool holds %v, want %v", names, want)
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := newTestQueue(t, t.TempDir(), &deliveryLog{})
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour}
+	for i, delay := range want {
+		if got := q.backoff(i + 1); got != delay {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, delay)
+		}
+	}
+}
+
+func TestQueueRetryAndExpiry(t *testing.T) {
+	useConfig(t, &Config{})
+	log := &deliveryLog{err: errors.New("connection refused")}
+	q := newTestQueue(t, t.TempDir(), log)
+	id, err := q.Enqueue("10.0.0.1", "user@example.com", "secret", "", "user@example.com", []string{"rcpt@example.org"}, MailOptions{}, bytes.NewReader([]byte("Subject: test\r\n\r\nbody\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A temporary failure reschedules the email after the backoff.
+	q.attempt(id)
+	mail, err := q.loadEnvelope(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mail.Attempts != 1 || mail.LastError != "connection refused" || time.Until(mail.NextAttempt) < 59*time.Second {
+		t.Errorf("after a failure: attempts %d, last error %q, next attempt in %s", mail.Attempts, mail.LastError, time.Until(mail.NextAttempt))
+	}
+	if len(log.reports) != 0 {
+		t.Errorf("reported %v", log.reports)
+	}
+
+	// Once older than maxAge, the next failure gives it up.
+	mail.CreatedAt = time.Now().Add(-2 * time.Hour)
+	if err = q.saveEnvelope(mail); err != nil {
+		t.Fatal(err)
+	}
+	q.attempt(id)
+	if len(log.reports) != 1 || log.reports[0] != DSNFailed || !errors.Is(log.causes[0]["rcpt@example.org"], errDeliveryExpired) {
+		t.Errorf("got reports %v for %v, want %s for %v", log.reports, log.causes, DSNFailed, errDeliveryExpired)
+	}
+	if q.Len() != 0 {
+		t.Error("expired email still queued")
+	}
+}
+
+func TestQueueRefusedRecipients(t *testing.T) {
+	useConfig(t, &Config{})
+	refused := &recipientErrors{}
+	refused.add("unknown@example.org", &textproto.Error{Code: 550, Msg: "5.1.1 no such user"})
+	refused.add("full@example.org", &textproto.Error{Code: 452, Msg: "4.2.2 mailbox full"})
+	log := &deliveryLog{err: refused}
+	q := newTestQueue(t, t.TempDir(), log)
+	to := []string{"rcpt@example.org", "unknown@example.org", "full@example.org"}
+	id, err := q.Enqueue("10.0.0.1", "user@example.com", "secret", "", "user@example.com", to, MailOptions{}, bytes.NewReader([]byte("Subject: test\r\n\r\nbody\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the recipient refused permanently is reported, the one refused temporarily is retried alone.
+	q.attempt(id)
+	if len(log.reports) != 1 || log.reports[0] != DSNFailed || len(log.causes[0]) != 1 || log.causes[0]["unknown@example.org"] == nil {
+		t.Errorf("got reports %v for %v, want %s for unknown@example.org", log.reports, log.causes, DSNFailed)
+	}
+	mail, err := q.loadEnvelope(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(mail.To, []string{"full@example.org"}) || mail.Attempts != 1 {
+		t.Errorf("after the attempt: to %v, attempts %d", mail.To, mail.Attempts)
+	}
+
+	log.err = nil
+	q.attempt(id)
+	if q.Len() != 0 {
+		t.Error("delivered email still queued")
+	}
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var CertStoreIns = new(CertStore)
+
+var reloadMu sync.Mutex
+
+// CertStore holds the server certificate so that it can be replaced on reload
+// while existing TLS sessions keep the certificate they were established with.
+type CertStore struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// Load reads the certificate and key configured in smtpdTLS, if TLS is enabled.
+func (store *CertStore) Load(cfg *Config) error {
+	if !cfg.SmtpdTLS.TLSEnabled {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.SmtpdTLS.Cert, cfg.SmtpdTLS.Key)
+	if err != nil {
+		return fmt.Errorf("load TLS certificate %s failed: %w", cfg.SmtpdTLS.Cert, err)
+	}
+	store.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (store *CertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := store.cert.Load()
+	if cert == nil {
+		return nil, errors.New("no TLS certificate loaded")
+	}
+	return cert, nil
+}
+
+// ServerTLSConfig returns the TLS configuration of the SMTP server, backed by CertStoreIns.
+func ServerTLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: CertStoreIns.GetCertificate}
+}
+
+// ReloadConfig loads the configuration file again and swaps it in atomically.
+// Rules, userDB, emailServer routes and the TLS certificate take effect for the next command of every session;
+// in-flight sessions are not interrupted. On any error the current configuration stays in force.
+func ReloadConfig(path string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		slog.Error(fmt.Sprintf("reload configuration failed, keeping the current one: %s", err.Error()))
+		return err
+	}
+	if err = CertStoreIns.Load(cfg); err != nil {
+		slog.Error(fmt.Sprintf("reload configuration failed, keeping the current one: %s", err.Error()))
+		return err
+	}
+
+	old := cfgPtr.Swap(cfg)
+	warnRestartRequired(old, cfg)
+	slog.Info(fmt.Sprintf("Configuration %s reloaded", path))
+	return nil
+}
+
+// warnRestartRequired logs the settings that are only read at start-up.
+func warnRestartRequired(old, cfg *Config) {
+	if old == nil {
+		return
+	}
+	if !reflect.DeepEqual(old.SmptdServer, cfg.SmptdServer) || !reflect.DeepEqual(old.Listeners, cfg.Listeners) ||
+		old.SmtpdTLS.TLSEnabled != cfg.SmtpdTLS.TLSEnabled || old.SmtpdAuth.Required != cfg.SmtpdAuth.Required {
+		slog.Warn("Changes to smptdServer, listeners, smtpdTLS.enabled and smtpdAuth.required take effect after a restart")
+	}
+	if old.Limits != cfg.Limits {
+		slog.Warn("Changes to limits take effect after a restart")
+	}
+	if old.BruteForce.Path != cfg.BruteForce.Path || old.Admin.Address != cfg.Admin.Address {
+		slog.Warn("Changes to bruteForce.path and admin.address take effect after a restart")
+	}
+	if old.Queue != cfg.Queue {
+		slog.Warn("Changes to queue take effect after a restart")
+	}
+	if old.SmtpProbe.Enable != cfg.SmtpProbe.Enable {
+		slog.Warn("Changes to smtpProbe.enable take effect after a restart")
+	}
+	if old.UpstreamPool != cfg.UpstreamPool {
+		slog.Warn("Changes to upstreamPool take effect after a restart")
+	}
+	if old.CredentialCache != cfg.CredentialCache {
+		slog.Warn("Changes to credentialCache take effect after a restart")
+	}
+	if old.Logging != cfg.Logging {
+		slog.Warn("Changes to logging take effect after a restart")
+	}
+}
+
+// WatchConfig reloads the configuration whenever the file's modification time or size changes,
+// checking every interval. It never returns.
+func WatchConfig(path string, interval time.Duration) {
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+
+	lastMod, lastSize := stat()
+	for range time.Tick(interval) {
+		mod, size := stat()
+		if size < 0 || (mod.Equal(lastMod) && size == lastSize) {
+			continue
+		}
+		lastMod, lastSize = mod, size
+		slog.Info(fmt.Sprintf("Configuration %s changed on disk", path))
+		ReloadConfig(path)
+	}
+}
@@ -0,0 +1,381 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/naive9527/mitmsmtpd/smtpd"
+
+	"github.com/emersion/go-message"
+)
+
+// Rule actions. accept, reject and quarantine end the evaluation;
+// tag, reroute and notify are applied and the evaluation continues with the next rule.
+const (
+	ActionAccept     = "accept"
+	ActionReject     = "reject"
+	ActionQuarantine = "quarantine"
+	ActionTag        = "tag"
+	ActionReroute    = "reroute"
+	ActionNotify     = "notify"
+)
+
+// Rule is one entry of the ordered rule list. It fires when all Match conditions hold
+// and the Except conditions (if any) do not.
+type Rule struct {
+	Name         string          `yaml:"name"`
+	Match        RuleConditions  `yaml:"match"`
+	Except       *RuleConditions `yaml:"except"`
+	Action       string          `yaml:"action"`       // accept, reject, quarantine, tag, reroute or notify
+	Code         int             `yaml:"code"`         // reject: SMTP reply code, 550 by default
+	EnhancedCode string          `yaml:"enhancedCode"` // reject: enhanced status code, 5.7.1 (or 4.7.1 for 4xx) by default
+	Message      string          `yaml:"message"`      // reject: reply text; notify: notification text
+	Header       string          `yaml:"header"`       // tag: header line added to the email, e.g. "X-Policy: finance"
+	Route        string          `yaml:"route"`        // reroute: emailServer entry used to relay the email
+	Notify       bool            `yaml:"notify"`       // Also notify administrators when the rule fires
+}
+
+// RuleConditions are the match conditions of a rule. Empty conditions match everything.
+// Regular expressions are matched against the whole value as given; use (?i) for case-insensitive matching.
+type RuleConditions struct {
+	Listener           []string          `yaml:"listener"`           // Names of the listeners the email may have been received on
+	ClientIP           []string          `yaml:"clientIP"`           // Client IP addresses or CIDR ranges
+	ClientIPRegexp     string            `yaml:"clientIPRegexp"`     // Regexp for the client IP address
+	AuthUser           string            `yaml:"authUser"`           // Regexp for the authenticated username
+	Sender             string            `yaml:"sender"`             // Regexp for MAIL FROM
+	Recipient          string            `yaml:"recipient"`          // Regexp for RCPT TO, the rule is evaluated for each recipient
+	Header             map[string]string `yaml:"header"`             // Header name to regexp for one of its values
+	Subject            string            `yaml:"subject"`            // Regexp for the decoded subject
+	AttachmentName     string            `yaml:"attachmentName"`     // Regexp for the filename of any attachment
+	AttachmentType     string            `yaml:"attachmentType"`     // Regexp for the content type of any attachment
+	SizeOver           *int64            `yaml:"sizeOver"`           // Whole email larger than this, in bytes
+	BodySizeOver       *int64            `yaml:"bodySizeOver"`       // Email body larger than this, in bytes
+	AttachmentSizeOver *int64            `yaml:"attachmentSizeOver"` // Attachments larger than this in total, in bytes
+	EmbeddedSizeOver   *int64            `yaml:"embeddedSizeOver"`   // Embedded content larger than this in total, in bytes
+	HasAttachment      *bool             `yaml:"hasAttachment"`      // Whether the email has attachments, even empty ones
+	HasEmbedded        *bool             `yaml:"hasEmbedded"`        // Whether the email has embedded content, even empty
+	Time               string            `yaml:"time"`               // Local time of day, e.g. "08:00-18:00" or "22:00-06:00"
+	Weekdays           []string          `yaml:"weekdays"`           // Local weekdays, e.g. ["Sat", "Sun"]
+
+	clientNets     []*net.IPNet
+	clientIPRe     *regexp.Regexp
+	authUserRe     *regexp.Regexp
+	senderRe       *regexp.Regexp
+	recipientRe    *regexp.Regexp
+	headerRe       map[string]*regexp.Regexp
+	subjectRe      *regexp.Regexp
+	attachNameRe   *regexp.Regexp
+	attachTypeRe   *regexp.Regexp
+	fromMin, toMin int // Minutes since midnight, -1 if Time is not set
+}
+
+// Attachment describes one attachment of an email.
+type Attachment struct {
+	Name string
+	Type string
+	Size int64
+}
+
+// Verdict is the outcome of applying the rules to an email.
+type Verdict struct {
+	Action  string       // accept, reject or quarantine
+	Rule    string       // Name of the rule that decided, empty for the default accept
+	Reply   *smtpd.Reply // reject: SMTP reply, e.g. 550 5.7.1 Attachments are not allowed
+	Headers []string     // Header lines added by tag rules
+	Route   string       // emailServer entry chosen by a reroute rule, empty for the default route
+	Notify  []string     // Notifications for administrators
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// compile checks the rule and compiles its conditions. name identifies the rule in error messages.
+func (rule *Rule) compile(name string, cfg *Config) error {
+	var errs []error
+	if err := rule.Match.compile(name + ".match"); err != nil {
+		errs = append(errs, err)
+	}
+	if rule.Except != nil {
+		if err := rule.Except.compile(name + ".except"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, cond := range []struct {
+		field string
+		*RuleConditions
+	}{{"match", &rule.Match}, {"except", rule.Except}} {
+		if cond.RuleConditions == nil {
+			continue
+		}
+		for _, listener := range cond.Listener {
+			if cfg.listener(listener) == nil {
+				errs = append(errs, fmt.Errorf("%s.%s.listener: %q is not the name of a listener", name, cond.field, listener))
+			}
+		}
+	}
+
+	switch rule.Action {
+	case ActionAccept, ActionQuarantine, ActionNotify:
+	case ActionReject:
+		if rule.Code == 0 {
+			rule.Code = 550
+		}
+		if rule.Code < 400 || rule.Code > 599 {
+			errs = append(errs, fmt.Errorf("%s.code: %d is not a 4xx or 5xx reply code", name, rule.Code))
+		}
+		if rule.EnhancedCode == "" {
+			rule.EnhancedCode = fmt.Sprintf("%d.7.1", rule.Code/100)
+		}
+		if rule.Message == "" {
+			rule.Message = "Message rejected by policy"
+		}
+	case ActionTag:
+		if key, _, ok := strings.Cut(rule.Header, ":"); !ok || strings.TrimSpace(key) == "" || strings.ContainsAny(rule.Header, "\r\n") {
+			errs = append(errs, fmt.Errorf("%s.header: %q is not a header line like \"X-Policy: value\"", name, rule.Header))
+		}
+	case ActionReroute:
+		if _, ok := cfg.EmailServer[rule.Route]; !ok {
+			errs = append(errs, fmt.Errorf("%s.route: %q is not an emailServer entry", name, rule.Route))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%s.action: unknown action %q (use accept, reject, quarantine, tag, reroute or notify)", name, rule.Action))
+	}
+	return errors.Join(errs...)
+}
+
+func (cond *RuleConditions) compile(name string) error {
+	var errs []error
+	compile := func(field, expr string) *regexp.Regexp {
+		if expr == "" {
+			return nil
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s.%s: invalid regular expression %q: %w", name, field, expr, err))
+		}
+		return re
+	}
+
+	cond.clientNets = nil
+	for _, addr := range cond.ClientIP {
+		ipNet, err := parseIPNet(addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s.clientIP: %w", name, err))
+			continue
+		}
+		cond.clientNets = append(cond.clientNets, ipNet)
+	}
+
+	cond.clientIPRe = compile("clientIPRegexp", cond.ClientIPRegexp)
+	cond.authUserRe = compile("authUser", cond.AuthUser)
+	cond.senderRe = compile("sender", cond.Sender)
+	cond.recipientRe = compile("recipient", cond.Recipient)
+	cond.subjectRe = compile("subject", cond.Subject)
+	cond.attachNameRe = compile("attachmentName", cond.AttachmentName)
+	cond.attachTypeRe = compile("attachmentType", cond.AttachmentType)
+	cond.headerRe = make(map[string]*regexp.Regexp, len(cond.Header))
+	for key, expr := range cond.Header {
+		cond.headerRe[key] = compile("header."+key, expr)
+	}
+
+	cond.fromMin, cond.toMin = -1, -1
+	if cond.Time != "" {
+		from, to, ok := strings.Cut(cond.Time, "-")
+		fromT, err1 := time.Parse("15:04", strings.TrimSpace(from))
+		toT, err2 := time.Parse("15:04", strings.TrimSpace(to))
+		if !ok || err1 != nil || err2 != nil {
+			errs = append(errs, fmt.Errorf("%s.time: %q is not a range like \"08:00-18:00\"", name, cond.Time))
+		} else {
+			cond.fromMin = fromT.Hour()*60 + fromT.Minute()
+			cond.toMin = toT.Hour()*60 + toT.Minute()
+		}
+	}
+	for _, day := range cond.Weekdays {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			errs = append(errs, fmt.Errorf("%s.weekdays: unknown weekday %q (use Mon ... Sun)", name, day))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseIPNet accepts a single IP address or a CIDR range.
+func parseIPNet(addr string) (*net.IPNet, error) {
+	addr = strings.TrimSpace(addr)
+	if strings.Contains(addr, "/") {
+		_, ipNet, err := net.ParseCIDR(addr)
+		return ipNet, err
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// terminal reports whether the rule ends the evaluation when it fires.
+func (rule *Rule) terminal() bool {
+	return rule.Action == ActionAccept || rule.Action == ActionReject || rule.Action == ActionQuarantine
+}
+
+// envelopeOnly reports whether the rule can be evaluated before the message is transferred.
+func (rule *Rule) envelopeOnly() bool {
+	return rule.Match.envelopeOnly() && (rule.Except == nil || rule.Except.envelopeOnly())
+}
+
+func (cond *RuleConditions) envelopeOnly() bool {
+	return len(cond.Header) == 0 && cond.Subject == "" && cond.AttachmentName == "" && cond.AttachmentType == "" &&
+		cond.SizeOver == nil && cond.BodySizeOver == nil && cond.AttachmentSizeOver == nil && cond.EmbeddedSizeOver == nil &&
+		cond.HasAttachment == nil && cond.HasEmbedded == nil
+}
+
+// perRecipient reports whether the rule has to be evaluated for each recipient separately.
+func (rule *Rule) perRecipient() bool {
+	return rule.Match.Recipient != "" || (rule.Except != nil && rule.Except.Recipient != "")
+}
+
+// matches reports whether the rule fires for the email and, for per-recipient rules, the given recipient.
+func (rule *Rule) matches(email *ValidateEmail, recipient string, now time.Time) bool {
+	if !rule.Match.matches(email, recipient, now) {
+		return false
+	}
+	return rule.Except == nil || !rule.Except.matches(email, recipient, now)
+}
+
+func (cond *RuleConditions) matches(email *ValidateEmail, recipient string, now time.Time) bool {
+	if len(cond.Listener) > 0 && !slices.Contains(cond.Listener, email.listener) {
+		return false
+	}
+	if len(cond.clientNets) > 0 {
+		ip := net.ParseIP(email.clientIP)
+		if ip == nil || !slices.ContainsFunc(cond.clientNets, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+			return false
+		}
+	}
+	if cond.clientIPRe != nil && !cond.clientIPRe.MatchString(email.clientIP) {
+		return false
+	}
+	if cond.authUserRe != nil && !cond.authUserRe.MatchString(email.AuthUser) {
+		return false
+	}
+	if cond.senderRe != nil && !cond.senderRe.MatchString(email.Sender) {
+		return false
+	}
+	if cond.recipientRe != nil && !cond.recipientRe.MatchString(recipient) {
+		return false
+	}
+	if cond.subjectRe != nil && !cond.subjectRe.MatchString(email.Subject) {
+		return false
+	}
+	for key, re := range cond.headerRe {
+		if !headerMatches(email.Header, key, re) {
+			return false
+		}
+	}
+	if cond.attachNameRe != nil && !slices.ContainsFunc(email.Attachments, func(a Attachment) bool { return cond.attachNameRe.MatchString(a.Name) }) {
+		return false
+	}
+	if cond.attachTypeRe != nil && !slices.ContainsFunc(email.Attachments, func(a Attachment) bool { return cond.attachTypeRe.MatchString(a.Type) }) {
+		return false
+	}
+	if cond.SizeOver != nil && email.Size <= *cond.SizeOver {
+		return false
+	}
+	if cond.BodySizeOver != nil && email.BodySize <= *cond.BodySizeOver {
+		return false
+	}
+	if cond.AttachmentSizeOver != nil && email.AttachmentSize <= *cond.AttachmentSizeOver {
+		return false
+	}
+	if cond.EmbeddedSizeOver != nil && email.EmbeddedContentSize <= *cond.EmbeddedSizeOver {
+		return false
+	}
+	if cond.HasAttachment != nil && *cond.HasAttachment != (len(email.Attachments) > 0) {
+		return false
+	}
+	if cond.HasEmbedded != nil && *cond.HasEmbedded != (email.EmbeddedContents > 0) {
+		return false
+	}
+	if cond.fromMin >= 0 {
+		minute := now.Hour()*60 + now.Minute()
+		if cond.fromMin <= cond.toMin {
+			if minute < cond.fromMin || minute >= cond.toMin {
+				return false
+			}
+		} else if minute < cond.fromMin && minute >= cond.toMin { // The range wraps around midnight
+			return false
+		}
+	}
+	if len(cond.Weekdays) > 0 && !slices.ContainsFunc(cond.Weekdays, func(day string) bool { return weekdays[strings.ToLower(day)] == now.Weekday() }) {
+		return false
+	}
+	return true
+}
+
+func headerMatches(header message.Header, key string, re *regexp.Regexp) bool {
+	fields := header.FieldsByKey(textproto.CanonicalMIMEHeaderKey(key))
+	for fields.Next() {
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyRules converts verificationRules into the equivalent reject rules, which are evaluated after the rules list.
+// Nothing is converted if the section is absent.
+func (cfg *Config) legacyRules() []Rule {
+	vr := cfg.VerificationRules
+	if vr == nil {
+		return nil
+	}
+
+	var rules []Rule
+	reject := func(name, message string, match RuleConditions, except *RuleConditions) {
+		rules = append(rules, Rule{Name: name, Match: match, Except: except, Action: ActionReject, Message: message, Notify: true})
+	}
+	size := func(n int) *int64 {
+		v := int64(n)
+		return &v
+	}
+	present := true
+
+	if vr.SenderIP != "" {
+		reject("verificationRules.senderIP", "Client IP address is not allowed", RuleConditions{}, &RuleConditions{ClientIPRegexp: vr.SenderIP})
+	}
+	if vr.Sender != "" {
+		reject("verificationRules.sender", "Sender address is not allowed", RuleConditions{}, &RuleConditions{Sender: vr.Sender})
+	}
+	if vr.Recipient != "" {
+		reject("verificationRules.recipient", "Recipient address is not allowed", RuleConditions{}, &RuleConditions{Recipient: vr.Recipient})
+	}
+	if vr.EmailBodySize > 0 {
+		reject("verificationRules.emailBodySize", "Email body size is too large", RuleConditions{BodySizeOver: size(vr.EmailBodySize)}, nil)
+	}
+	if !vr.Attachment.Allowed {
+		reject("verificationRules.attachment", "Attachments are not allowed to be sent", RuleConditions{HasAttachment: &present}, nil)
+	} else if vr.Attachment.MaxSize > 0 {
+		reject("verificationRules.attachment", "Email attachment size is too large", RuleConditions{AttachmentSizeOver: size(vr.Attachment.MaxSize)}, nil)
+	}
+	if !vr.EmbeddedContent.Allowed {
+		reject("verificationRules.embeddedContent", "Embedded content is not allowed to be sent", RuleConditions{HasEmbedded: &present}, nil)
+	} else if vr.EmbeddedContent.MaxSize > 0 {
+		reject("verificationRules.embeddedContent", "Email embedded content size is too large", RuleConditions{EmbeddedSizeOver: size(vr.EmbeddedContent.MaxSize)}, nil)
+	}
+	return rules
+}
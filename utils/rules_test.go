@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// loadTestConfig loads the configuration from text and makes it the one in force, see useConfig.
+func loadTestConfig(t *testing.T, text string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, cfg)
+	return cfg
+}
+
+func TestLegacyAttachmentRule(t *testing.T) {
+	loadTestConfig(t, `
+smptdServer:
+  address: ":2525"
+verificationRules:
+  attachment:
+    allowed: false
+  embeddedContent:
+    allowed: false
+`)
+	tests := []struct {
+		name   string
+		fill   func(email *ValidateEmail)
+		action string
+	}{
+		{"no attachment", func(email *ValidateEmail) {}, ActionAccept},
+		{"empty attachment", func(email *ValidateEmail) {
+			email.Attachments = []Attachment{{Name: "empty.txt", Type: "text/plain"}}
+		}, ActionReject},
+		{"attachment", func(email *ValidateEmail) {
+			email.Attachments = []Attachment{{Name: "report.pdf", Type: "application/pdf", Size: 1024}}
+			email.AttachmentSize = 1024
+		}, ActionReject},
+		{"empty embedded content", func(email *ValidateEmail) { email.EmbeddedContents = 1 }, ActionReject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email := NewValidateEmail("10.0.0.1", "user@example.com", "user@example.com", []string{"rcpt@example.org"}, 10, 0, 0)
+			tt.fill(email)
+			if verdict := email.ApplyRules(time.Now()); verdict.Action != tt.action {
+				t.Errorf("action %s, want %s", verdict.Action, tt.action)
+			}
+		})
+	}
+}
@@ -1,16 +1,23 @@
 package utils
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/smtp"
+	"net/textproto"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"github.com/naive9527/mitmsmtpd/smtpd"
 
 	"gopkg.in/gomail.v2"
 )
@@ -41,170 +48,594 @@ func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
 	return nil, nil
 }
 
-func GetAvailableSMTPIP(host string, port, retryInterval, maxRetry int) (string, error) {
-	var err error
-	var ips, ipv4Addresses []net.IP
-
-	for attempt := 0; attempt < maxRetry; attempt++ {
-		// DNS解析获取所有A记录
-		ips, err = net.LookupIP(host)
-		if err != nil {
-			slog.Error(fmt.Sprintf("attempt %d , DNS lookup failed for host %s: %v", attempt, host, err))
-			continue
-		}
+// usage:
+// auth := LoginAuth("loginname", "password")
+// err := smtp.SendMail(smtpServer + ":25", auth, fromAddress, toAddresses, []byte(message))
+// or
+// client, err := smtp.Dial(smtpServer)
+// client.Auth(LoginAuth("loginname", "password"))
 
-		for _, ip := range ips {
-			if ipv4 := ip.To4(); ipv4 != nil {
-				ipv4Addresses = append(ipv4Addresses, ipv4)
-			}
-		}
+// Message is an email to relay. It is read by offset, so it can be read several times, and a large email
+// can be read from a file instead of memory: *io.SectionReader and *bytes.Reader are Messages.
+type Message interface {
+	io.ReaderAt
+	Size() int64
+}
 
-		if len(ipv4Addresses) == 0 {
-			err = fmt.Errorf("no IPv4 addresses found for host %s", host)
-			slog.Error(fmt.Sprintf("attempt %d ,no IPv4 addresses found for host %s", attempt, host))
-			continue
-		}
+// messageReader returns a reader of the whole message, from the start.
+func messageReader(msg Message) io.Reader {
+	return io.NewSectionReader(msg, 0, msg.Size())
+}
 
-		// 尝试连接探测
-		for _, ip := range ipv4Addresses {
-			address := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+// MailOptions holds the ESMTP parameters of the client's MAIL and RCPT commands that have to be passed on upstream.
+type MailOptions struct {
+	Body     string                 `json:"body,omitempty"`     // BODY parameter: 7BIT, 8BITMIME or BINARYMIME (received with BDAT); empty if not given
+	SMTPUTF8 bool                   `json:"smtputf8,omitempty"` // SMTPUTF8 parameter: internationalized addresses and headers (RFC 6531)
+	Ret      string                 `json:"ret,omitempty"`      // DSN RET parameter: FULL or HDRS (RFC 3461)
+	EnvID    string                 `json:"envid,omitempty"`    // DSN ENVID parameter, xtext encoded
+	Rcpt     map[string]RcptOptions `json:"rcpt,omitempty"`     // DSN parameters by recipient
+}
 
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
+// RcptOptions holds the DSN parameters of a RCPT command (RFC 3461).
+type RcptOptions struct {
+	Notify string `json:"notify,omitempty"` // NEVER, or a list of SUCCESS, FAILURE and DELAY; empty if not given
+	ORcpt  string `json:"orcpt,omitempty"`  // Original recipient, "addr-type;xtext"
+}
 
-			conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
-			if err == nil {
-				conn.Close()
-				return ip.String(), nil
-			} else {
-				slog.Error(fmt.Sprintf("attempt %d , connection host %s failed for IP %s: %v", attempt, host, ip.String(), err))
-			}
+// MailOptionsFor returns the options of the mail transaction of the session.
+func MailOptionsFor(info *smtpd.SessionInfo) MailOptions {
+	_, smtputf8 := info.MailParams["SMTPUTF8"]
+	opts := MailOptions{Body: info.MailParams["BODY"], SMTPUTF8: smtputf8, Ret: info.MailParams["RET"], EnvID: info.MailParams["ENVID"]}
+	for rcpt, params := range info.RcptParams {
+		if opts.Rcpt == nil {
+			opts.Rcpt = make(map[string]RcptOptions)
 		}
-
-		// 如果本轮所有IP都失败，则等待重试间隔
-		err = fmt.Errorf("all IP addresses connect failed for host %s", host)
-		slog.Error(fmt.Sprintf("attempt %d , all IP addresses connect failed for host %s", attempt, host))
-		time.Sleep(time.Duration(retryInterval) * time.Second)
+		opts.Rcpt[rcpt] = RcptOptions{Notify: params["NOTIFY"], ORcpt: params["ORCPT"]}
 	}
-
-	return "", err
+	return opts
 }
 
-// usage:
-// auth := LoginAuth("loginname", "password")
-// err := smtp.SendMail(smtpServer + ":25", auth, fromAddress, toAddresses, []byte(message))
-// or
-// client, err := smtp.Dial(smtpServer)
-// client.Auth(LoginAuth("loginname", "password"))
-
-func SendMailExt(smtpServer string, smtpPort int, mechanisms, from, password string, to []string, data []byte) error {
-	var err error
+// SendMailExt relays the email to the email server of item, logging in as username, without logging in if
+// username is empty.
+func SendMailExt(ctx context.Context, item EmailServerItem, username, password, from string, to []string, opts MailOptions, msg Message) error {
+	smtpServer := item.Server
 	var auth smtp.Auth
-	switch {
-	case strings.Contains(mechanisms, "CRAM-MD5"):
-		auth = smtp.CRAMMD5Auth(from, password)
-	case strings.Contains(mechanisms, "PLAIN"):
-		auth = smtp.PlainAuth("", from, password, smtpServer)
-	case strings.Contains(mechanisms, "LOGIN"):
-		auth = LoginAuth(from, password)
-	default:
-		info := fmt.Sprintf("unsupported authentication type: %s,  the email can not sent out", mechanisms)
-		slog.Error(info)
-		return errors.New(info)
+	var err error
+	if username != "" {
+		if auth, err = NewUpstreamAuth(item.AuthMechanisms, smtpServer, username, password); err != nil {
+			return err
+		}
 	}
 
-	if CFG.SmtpProbe.Enable {
-		ip, err := GetAvailableSMTPIP(smtpServer, smtpPort, CFG.SmtpProbe.RetryInterval, CFG.SmtpProbe.MaxRetry)
+	dial := func(ctx context.Context) (*upstreamConn, error) {
+		addrs, err := upstreamAddrs(ctx, item)
 		if err != nil {
-			info := fmt.Sprintf("the email can not sent out, because the SMTP server %s:%d is not available: %s", smtpServer, smtpPort, err.Error())
-			slog.Error(info)
-			return errors.New(info)
+			return nil, err
 		}
-		err = SendMailByIP(ip, smtpPort, smtpServer, auth, from, to, data)
+		return dialUpstream(ctx, addrs, item, auth)
+	}
+	// With the pool, the lookup and the login only happen when no idle connection of the account is left.
+	if UpstreamPoolIns != nil {
+		err = UpstreamPoolIns.Send(ctx, poolKey{smtpServer, item.Port, username}, password, dial, from, to, opts, msg)
 	} else {
-		err = smtp.SendMail(fmt.Sprintf("%s:%d", smtpServer, smtpPort), auth, from, to, data)
+		err = sendMailConn(ctx, dial, from, to, opts, msg)
 	}
 
 	if err != nil {
 		info := fmt.Sprintf("%s the email sent out error %s", smtpServer, err.Error())
 		slog.Error(info)
-		return errors.New(info)
+		return fmt.Errorf("%s the email sent out error %w", smtpServer, err)
 	}
 	slog.Info(fmt.Sprintf("%s the email sent out success", smtpServer))
 	return nil
 }
 
-func SendMailData(from string, to []string, data []byte) error {
-	smtpDomain := strings.Split(from, "@")[1]
-	smtpServerItem, ok := CFG.EmailServer[smtpDomain]
+// upstreamAddrs returns the addresses of the email server of item in the order to try them, according to its
+// addressFamily: the healthy ones according to the smtpProbe health checks, or else those of a DNS lookup.
+func upstreamAddrs(ctx context.Context, item EmailServerItem) ([]string, error) {
+	if UpstreamHealthIns != nil {
+		return UpstreamHealthIns.Addresses(item)
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", item.Server)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	if addrs = orderAddresses(addrs, item.AddressFamily); len(addrs) == 0 {
+		return nil, fmt.Errorf("no %s address found for %s", item.AddressFamily, item.Server)
+	}
+	return addrs, nil
+}
+
+// orderAddresses keeps the addresses of the family preference, in the order to try them: with prefer-v4 and
+// prefer-v6 the families alternate, starting with the preferred one (RFC 8305). Within a family the order is kept.
+func orderAddresses(addrs []string, family string) []string {
+	var v4, v6 []string
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+			v6 = append(v6, addr)
+		} else {
+			v4 = append(v4, addr)
+		}
+	}
+	first, second := v4, v6
+	switch family {
+	case AddressFamilyIPv4Only:
+		return v4
+	case AddressFamilyIPv6Only:
+		return v6
+	case AddressFamilyPreferV6:
+		first, second = v6, v4
+	}
+	ordered := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// SendMailData relays the email with the credentials of the user that authenticated on the session,
+// never with the credentials cached for the MAIL FROM address; without credentials if authUser is empty.
+// route names the emailServer entry chosen by a reroute rule, empty for the default route.
+func SendMailData(ctx context.Context, authUser, route, from string, to []string, opts MailOptions, msg Message) error {
+	var password string
+	if authUser != "" {
+		var err error
+		if password, err = MailInfoCacheIns.GetUserPass(authUser); err != nil {
+			return err
+		}
+	}
+	return SendMailAs(ctx, authUser, password, route, from, to, opts, msg)
+}
+
+// SendMailAs is SendMailData with the password of authUser given, e.g. the one sealed in a queued email.
+func SendMailAs(ctx context.Context, authUser, password, route, from string, to []string, opts MailOptions, msg Message) error {
+	smtpServerItem, ok := RouteFor(authUser, from)
+	if route != "" {
+		smtpServerItem, ok = Cfg().EmailServer[route]
+	}
 	if !ok {
 		info := fmt.Sprintf("The email server is not configured for %s", from)
 		slog.Error(info)
-		return errors.New(info)
+		return fmt.Errorf("%w for %s", errRouteNotConfigured, from)
 	}
+	return SendMailExt(ctx, smtpServerItem, authUser, password, from, to, opts, msg)
+}
 
-	password, err := MailInfoCacheIns.GetUserPass(from)
-	if err != nil {
-		return err
+// RouteFor picks the upstream email server by the domain of the authenticated username,
+// or by the domain of the sender if the username is not an email address.
+func RouteFor(authUser, from string) (EmailServerItem, bool) {
+	address := from
+	if strings.Contains(authUser, "@") {
+		address = authUser
 	}
-
-	return SendMailExt(
-		smtpServerItem.Server,
-		smtpServerItem.Port,
-		smtpServerItem.AuthMechanisms,
-		from,
-		password,
-		to,
-		data)
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return EmailServerItem{}, false
+	}
+	item, ok := Cfg().EmailServer[strings.ToLower(address[at+1:])]
+	return item, ok
 }
 
 // 将smtp.SendMail的代码复制后，进行改写，因为直接使用ip地址发送邮件时，会证书验证失败
 // SendMailByIP 通过 IP 连接 SMTP，但证书校验用 domain
-func SendMailByIP(ip string, port int, domain string, a smtp.Auth, from string, to []string, msg []byte) error {
-	addr := net.JoinHostPort(ip, strconv.Itoa(port))
-	c, err := smtp.Dial(addr)
+// The connection is closed as soon as ctx is cancelled, e.g. when the client went away.
+// BODY 和 SMTPUTF8 参数按客户端的 MAIL 命令转发，BINARYMIME 邮件用 BDAT 发送
+// 邮件内容从 msg 流式写出，不会整个读入内存
+func SendMailByIP(ctx context.Context, ip string, port int, domain string, a smtp.Auth, from string, to []string, opts MailOptions, msg Message) error {
+	item := EmailServerItem{Server: domain, Port: port}
+	dial := func(ctx context.Context) (*upstreamConn, error) {
+		return dialUpstream(ctx, []string{ip}, item, a)
+	}
+	return sendMailConn(ctx, dial, from, to, opts, msg)
+}
+
+// sendMailConn relays the email over a new connection opened with dial and quits.
+func sendMailConn(ctx context.Context, dial func(ctx context.Context) (*upstreamConn, error), from string, to []string, opts MailOptions, msg Message) error {
+	uc, err := dial(ctx)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
-	if err = c.Hello("localhost"); err != nil {
+	defer uc.client.Close()
+	stop := context.AfterFunc(ctx, func() { uc.conn.Close() })
+	defer stop()
+
+	if err = mailFrom(uc.client, from, to, opts, msg); err != nil {
 		return err
 	}
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		config := &tls.Config{ServerName: domain}
-		if err = c.StartTLS(config); err != nil {
-			return err
+	if err = rcptData(uc.client, to, opts, msg); err != nil {
+		return err
+	}
+	return uc.client.Quit()
+}
+
+// upstreamConn is an authenticated SMTP connection to an upstream server.
+type upstreamConn struct {
+	conn     net.Conn
+	client   *smtp.Client
+	digest   [sha256.Size]byte // passwordDigest of the password the connection authenticated with
+	messages int               // Emails sent over the connection
+	lastUsed time.Time
+}
+
+// happyEyeballsDelay is how long a connection attempt is given before the next address is tried alongside (RFC 8305).
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// dialUpstream connects to the first address of addrs that answers, see raceDial, and completes the handshake
+// with the email server of item with newUpstreamConn. When that fails with a network or TLS error or a 4xx reply,
+// e.g. a 421 greeting, the next address is tried; a 5xx reply such as refused credentials would be the same on
+// every address.
+func dialUpstream(ctx context.Context, addrs []string, item EmailServerItem, a smtp.Auth) (*upstreamConn, error) {
+	for {
+		conn, rest, err := raceDial(ctx, addrs, item.Port)
+		if err != nil {
+			return nil, err
+		}
+		uc, err := newUpstreamConn(ctx, conn, item, a)
+		if err == nil {
+			return uc, nil
+		}
+		var protoErr *textproto.Error
+		if len(rest) == 0 || ctx.Err() != nil || errors.As(err, &protoErr) && protoErr.Code >= 500 {
+			return nil, err
+		}
+		slog.Warn(fmt.Sprintf("SMTP server %s failed at %s, trying the next address: %s", item.Server, conn.RemoteAddr(), err.Error()))
+		addrs = rest
+	}
+}
+
+// raceDial connects to the addresses in order, starting the next attempt when the previous one failed or has not
+// succeeded within happyEyeballsDelay. The first connection established wins, the other attempts are cancelled.
+// It also returns the addresses left to fail over to: all but the winner and those that failed.
+// Without any connection, the error of the first address is returned.
+func raceDial(ctx context.Context, addrs []string, port int) (net.Conn, []string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		i    int
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	failed := make([]error, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		i := next
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addrs[i], strconv.Itoa(port)))
+			results <- result{i, conn, err}
+		}()
+	}
+
+	start()
+	delay := time.NewTimer(happyEyeballsDelay)
+	defer delay.Stop()
+	for {
+		select {
+		case <-delay.C:
+			if next < len(addrs) {
+				start()
+				delay.Reset(happyEyeballsDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// 其他仍在进行的连接尝试被取消，已经建立的连接直接关闭
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				var rest []string
+				for i, addr := range addrs {
+					if i != r.i && failed[i] == nil {
+						rest = append(rest, addr)
+					}
+				}
+				return r.conn, rest, nil
+			}
+			failed[r.i] = r.err
+			if next < len(addrs) && ctx.Err() == nil {
+				start()
+				delay.Reset(happyEyeballsDelay)
+			} else if pending == 0 {
+				for _, err := range failed {
+					if err != nil {
+						return nil, nil, err
+					}
+				}
+			}
 		}
 	}
-	if a != nil && c.Extension != nil {
+}
+
+// newUpstreamConn greets the server on conn, secures the connection according to the tls mode of item and
+// authenticates with a. The handshake is aborted when ctx is cancelled.
+func newUpstreamConn(ctx context.Context, conn net.Conn, item EmailServerItem, a smtp.Auth) (*upstreamConn, error) {
+	if item.TLS == UpstreamTLSImplicit {
+		tlsConn := tls.Client(conn, item.clientTLSConfig())
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	c, err := smtp.NewClient(conn, item.Server)
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, err
+	}
+	err = upstreamHandshake(c, item, a)
+	if !stop() && err == nil {
+		err = ctx.Err() // Cancelled right after the handshake, the connection is closed already
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &upstreamConn{conn: conn, client: c, lastUsed: time.Now()}, nil
+}
+
+// upstreamHandshake upgrades the connection with STARTTLS as the tls mode of item asks, verifying the certificate
+// with item.clientTLSConfig, and authenticates with a, never over an unencrypted connection unless allowInsecureAuth.
+func upstreamHandshake(c *smtp.Client, item EmailServerItem, a smtp.Auth) error {
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+	if item.TLS != UpstreamTLSNone && item.TLS != UpstreamTLSImplicit {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(item.clientTLSConfig()); err != nil {
+				return err
+			}
+		} else if item.TLS == UpstreamTLSRequired {
+			return fmt.Errorf("smtp: %s does not offer STARTTLS, which tls: required needs", item.Server)
+		}
+	}
+	if a != nil {
+		if _, encrypted := c.TLSConnectionState(); !encrypted && !item.AllowInsecureAuth {
+			return fmt.Errorf("smtp: refusing to send the credentials to %s over an unencrypted connection", item.Server)
+		}
 		if ok, _ := c.Extension("AUTH"); !ok {
 			return errors.New("smtp: server doesn't support AUTH")
 		}
-		if err = c.Auth(a); err != nil {
+		if err := c.Auth(a); err != nil {
 			return err
 		}
 	}
-	if err = c.Mail(from); err != nil {
-		return err
+	return nil
+}
+
+// recipientErrors is returned when the upstream server refused some of the recipients of an email, with its
+// reply to each of them. The email was sent to the others; if all were refused, it was not sent at all.
+type recipientErrors struct {
+	Recipients []string         // Refused recipients, in the order of the envelope
+	Errors     map[string]error // Reply to each refused recipient
+}
+
+func (e *recipientErrors) add(rcpt string, err error) {
+	if e.Errors == nil {
+		e.Errors = make(map[string]error)
+	}
+	e.Recipients = append(e.Recipients, rcpt)
+	e.Errors[rcpt] = err
+}
+
+func (e *recipientErrors) Error() string {
+	refused := make([]string, len(e.Recipients))
+	for i, rcpt := range e.Recipients {
+		refused[i] = fmt.Sprintf("%s: %s", rcpt, e.Errors[rcpt].Error())
 	}
+	return "recipients refused: " + strings.Join(refused, "; ")
+}
+
+// Unwrap returns the reply to the first refused recipient: the connection is still in sync, and when all were
+// refused, it is the reply to pass on to the client.
+func (e *recipientErrors) Unwrap() error {
+	return e.Errors[e.Recipients[0]]
+}
+
+// rcptData adds the recipients and sends the message to those the upstream server accepted, completing the
+// transaction started by mailFrom. The recipients it refused are returned as *recipientErrors.
+func rcptData(c *smtp.Client, to []string, opts MailOptions, msg Message) error {
+	refused := &recipientErrors{}
 	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
-			return err
+		if err := rcptTo(c, addr, opts); err != nil {
+			if !isUpstreamReply(err) {
+				return err
+			}
+			refused.add(addr, err)
 		}
 	}
+	if len(refused.Recipients) > 0 && len(refused.Recipients) == len(to) {
+		return refused
+	}
+
+	var err error
+	if opts.Body == "BINARYMIME" {
+		err = sendBDAT(c, msg)
+	} else {
+		err = sendData(c, msg)
+	}
+	if err == nil && len(refused.Recipients) > 0 {
+		err = refused
+	}
+	return err
+}
+
+// sendData sends the message with DATA.
+func sendData(c *smtp.Client, msg Message) error {
 	w, err := c.Data()
 	if err != nil {
 		return err
 	}
-	_, err = w.Write(msg)
+	if _, err = io.Copy(w, messageReader(msg)); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// mailFrom starts the upstream transaction with the BODY and SMTPUTF8 parameters the client used.
+// smtp.Client.Mail adds them whenever the upstream server supports them, whatever the email, so the
+// command is written on the text connection. If the upstream server lacks an extension the email
+// needs, it is relayed without the parameter when that is harmless (7-bit content, ASCII addresses
+// and headers); otherwise it fails permanently, since the email can not be converted here.
+func mailFrom(c *smtp.Client, from string, to []string, opts MailOptions, msg Message) error {
+	asciiHeader, ascii, err := messageIsASCII(msg)
 	if err != nil {
 		return err
 	}
-	err = w.Close()
+
+	var params []string
+	switch {
+	case opts.Body == "BINARYMIME":
+		for _, ext := range []string{"CHUNKING", "BINARYMIME"} {
+			if ok, _ := c.Extension(ext); !ok {
+				return &textproto.Error{Code: 554, Msg: fmt.Sprintf("5.6.3 the upstream server does not support %s, the binary email can not be relayed", ext)}
+			}
+		}
+		params = append(params, "BODY=BINARYMIME")
+	case opts.Body == "8BITMIME" || !ascii:
+		if ok, _ := c.Extension("8BITMIME"); ok {
+			params = append(params, "BODY=8BITMIME")
+		} else if opts.Body == "8BITMIME" && !ascii {
+			return &textproto.Error{Code: 554, Msg: "5.6.3 the upstream server does not support 8BITMIME, the 8-bit email can not be relayed"}
+		}
+	}
+
+	if opts.SMTPUTF8 {
+		if ok, _ := c.Extension("SMTPUTF8"); ok {
+			params = append(params, "SMTPUTF8")
+		} else {
+			if !isASCII([]byte(from+strings.Join(to, ""))) || !asciiHeader {
+				return &textproto.Error{Code: 553, Msg: "5.6.7 the upstream server does not support SMTPUTF8, the internationalized email can not be relayed"}
+			}
+		}
+	}
+
+	// Without DSN support upstream the parameters are dropped; the upstream server then reports failures as usual.
+	if ok, _ := c.Extension("DSN"); ok {
+		if opts.Ret != "" {
+			params = append(params, "RET="+opts.Ret)
+		}
+		if opts.EnvID != "" {
+			params = append(params, "ENVID="+opts.EnvID)
+		}
+	}
+
+	_, _, err = cmd(c.Text, 250, "MAIL FROM:<%s>%s", from, joinParams(params))
+	return err
+}
+
+// rcptTo adds a recipient with its DSN parameters, if the upstream server supports DSN.
+func rcptTo(c *smtp.Client, addr string, opts MailOptions) error {
+	var params []string
+	if ok, _ := c.Extension("DSN"); ok {
+		rcpt := opts.Rcpt[addr]
+		if rcpt.Notify != "" {
+			params = append(params, "NOTIFY="+rcpt.Notify)
+		}
+		if rcpt.ORcpt != "" {
+			params = append(params, "ORCPT="+rcpt.ORcpt)
+		}
+	}
+	_, _, err := cmd(c.Text, 25, "RCPT TO:<%s>%s", addr, joinParams(params))
+	return err
+}
+
+func joinParams(params []string) string {
+	if len(params) == 0 {
+		return ""
+	}
+	return " " + strings.Join(params, " ")
+}
+
+// isASCII reports whether data only contains 7-bit characters.
+func isASCII(data []byte) bool {
+	for _, b := range data {
+		if b >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// messageIsASCII reports whether the header, up to the first empty line, and the whole message only contain 7-bit
+// characters. The message is read line by line, and only as far as needed.
+func messageIsASCII(msg Message) (header, whole bool, err error) {
+	header, whole = true, true
+	inHeader, lineStart := true, true
+	r := bufio.NewReader(messageReader(msg))
+	for {
+		line, err := r.ReadSlice('\n')
+		if inHeader && lineStart && (string(line) == "\r\n" || string(line) == "\n") {
+			inHeader = false
+		}
+		if !isASCII(line) {
+			whole = false
+			if inHeader {
+				header = false
+			}
+		}
+		if !header || (!whole && !inHeader) {
+			return header, whole, nil
+		}
+		switch err {
+		case nil, bufio.ErrBufferFull:
+			lineStart = err == nil
+		case io.EOF:
+			return header, whole, nil
+		default:
+			return header, whole, err
+		}
+	}
+}
+
+// sendBDAT sends the message in a single "BDAT <size> LAST" chunk (RFC 3030), which net/smtp does not know.
+func sendBDAT(c *smtp.Client, msg Message) error {
+	id := c.Text.Next()
+	c.Text.StartRequest(id)
+	err := c.Text.PrintfLine("BDAT %d LAST", msg.Size())
+	if err == nil {
+		_, err = io.Copy(c.Text.W, messageReader(msg))
+	}
+	if err == nil {
+		err = c.Text.W.Flush()
+	}
+	c.Text.EndRequest(id)
 	if err != nil {
 		return err
 	}
-	return c.Quit()
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	return err
+}
+
+// cmd sends a command and reads the response, like the unexported smtp.Client.cmd.
+func cmd(text *textproto.Conn, expectCode int, format string, args ...any) (int, string, error) {
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	return text.ReadResponse(expectCode)
 }
 
 func GenMailContent(content, clientip, from, emailFile string) string {
@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeUpstream is a minimal upstream SMTP server that accepts everything unless told otherwise.
+type fakeUpstream struct {
+	ln   net.Listener
+	rcpt map[string]string // Reply to RCPT TO by address
+
+	mu       sync.Mutex
+	conns    int
+	mailFrom func(conn, n int) string // Reply to the nth MAIL FROM of the connection, 250 if nil
+	messages []string                 // Emails received with DATA
+}
+
+func newFakeUpstream(t *testing.T) *fakeUpstream {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeUpstream{ln: ln, rcpt: make(map[string]string)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			id := f.conns
+			f.mu.Unlock()
+			go f.serve(id, conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeUpstream) port() int {
+	return f.ln.Addr().(*net.TCPAddr).Port
+}
+
+// connections returns the number of connections accepted.
+func (f *fakeUpstream) connections() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conns
+}
+
+// received returns the number of emails received.
+func (f *fakeUpstream) received() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.messages)
+}
+
+func (f *fakeUpstream) serve(id int, conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake ESMTP")
+	mails := 0
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		reply := "250 OK"
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply = "250-fake\r\n250 8BITMIME"
+		case "MAIL":
+			mails++
+			f.mu.Lock()
+			if f.mailFrom != nil {
+				reply = f.mailFrom(id, mails)
+			}
+			f.mu.Unlock()
+		case "RCPT":
+			addr := strings.TrimSuffix(strings.TrimPrefix(arg, "TO:<"), ">")
+			if r, ok := f.rcpt[addr]; ok {
+				reply = r
+			}
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.messages = append(f.messages, string(data))
+			f.mu.Unlock()
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		}
+		text.PrintfLine("%s", reply)
+		if strings.HasPrefix(reply, "421") {
+			return
+		}
+	}
+}
+
+func TestRcptDataRefusedRecipients(t *testing.T) {
+	f := newFakeUpstream(t)
+	f.rcpt["unknown@example.org"] = "550 5.1.1 no such user"
+	f.rcpt["full@example.org"] = "452 4.2.2 mailbox full"
+	to := []string{"rcpt@example.org", "unknown@example.org", "full@example.org"}
+	msg := bytes.NewReader([]byte("Subject: test\r\n\r\nbody\r\n"))
+
+	err := SendMailByIP(context.Background(), "127.0.0.1", f.port(), "localhost", nil, "user@example.com", to, MailOptions{}, msg)
+	var refused *recipientErrors
+	if !errors.As(err, &refused) {
+		t.Fatalf("SendMailByIP() = %v, want recipient errors", err)
+	}
+	if got := fmt.Sprint(refused.Recipients); got != "[unknown@example.org full@example.org]" {
+		t.Errorf("refused %s", got)
+	}
+	var protoErr *textproto.Error
+	if !errors.As(refused.Errors["full@example.org"], &protoErr) || protoErr.Code != 452 {
+		t.Errorf("reply to full@example.org: %v", refused.Errors["full@example.org"])
+	}
+	if n := f.received(); n != 1 {
+		t.Errorf("got %d messages, want the email sent to the accepted recipient", n)
+	}
+
+	// Nothing is sent when every recipient is refused, and the first reply is the one passed on.
+	err = SendMailByIP(context.Background(), "127.0.0.1", f.port(), "localhost", nil, "user@example.com", to[1:], MailOptions{}, msg)
+	if !errors.As(err, &protoErr) || protoErr.Code != 550 {
+		t.Errorf("SendMailByIP() = %v, want the 550 reply", err)
+	}
+	if n := f.received(); n != 1 {
+		t.Errorf("got %d messages, want none more", n)
+	}
+}
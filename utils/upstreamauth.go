@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/naive9527/mitmsmtpd/smtpd"
+)
+
+var errUpstreamAuthUnavailable = smtpd.NewReply(454, "4.7.0", "Temporary authentication failure, upstream server unavailable")
+
+var UpstreamAuthCacheIns = NewUpstreamAuthCache()
+
+// passwordKey keys the password digests kept in memory, see passwordDigest.
+var passwordKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("generate password digest key failed: %v", err))
+	}
+	return key
+}()
+
+// passwordDigest returns the HMAC-SHA256 of password under a random key generated at start-up: unlike a plain
+// hash, the digests in a core dump can not be looked up in precomputed tables or compared across processes.
+func passwordDigest(password string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, passwordKey)
+	mac.Write([]byte(password))
+	return [sha256.Size]byte(mac.Sum(nil))
+}
+
+// UpstreamAuthCache remembers credentials the upstream server accepted recently,
+// so that not every AUTH costs an upstream round trip. Only a keyed digest of the password is kept.
+type UpstreamAuthCache struct {
+	mu      sync.Mutex
+	entries map[string]upstreamAuthEntry
+}
+
+type upstreamAuthEntry struct {
+	digest  [sha256.Size]byte
+	expires time.Time
+}
+
+func NewUpstreamAuthCache() *UpstreamAuthCache {
+	return &UpstreamAuthCache{entries: make(map[string]upstreamAuthEntry)}
+}
+
+// Valid reports whether username/password was verified upstream and has not expired yet.
+func (cache *UpstreamAuthCache) Valid(username, password string) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, ok := cache.entries[username]
+	if !ok {
+		return false
+	}
+	if time.Now().After(entry.expires) {
+		delete(cache.entries, username)
+		return false
+	}
+	digest := passwordDigest(password)
+	return subtle.ConstantTimeCompare(entry.digest[:], digest[:]) == 1
+}
+
+func (cache *UpstreamAuthCache) Set(username, password string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.entries[username] = upstreamAuthEntry{digest: passwordDigest(password), expires: time.Now().Add(ttl)}
+}
+
+func (cache *UpstreamAuthCache) Delete(username string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	delete(cache.entries, username)
+}
+
+// VerifyUpstreamAuth performs a real AUTH against the upstream server chosen by the domain of username.
+// It returns (false, nil) if the upstream server rejected the credentials and an error if the
+// upstream server could not be asked.
+func VerifyUpstreamAuth(username, password string) (bool, error) {
+	cfg := Cfg()
+	ttl := time.Duration(cfg.SmtpdAuth.VerifyCacheTTL) * time.Second
+	if UpstreamAuthCacheIns.Valid(username, password) {
+		slog.Info("Upstream authentication cache hit", "Username", username)
+		return true, nil
+	}
+
+	at := strings.LastIndex(username, "@")
+	if at < 0 {
+		slog.Error(fmt.Sprintf("Upstream authentication needs an email address as username: %s", username))
+		return false, nil
+	}
+	smtpServerItem, ok := cfg.EmailServer[strings.ToLower(username[at+1:])]
+	if !ok {
+		slog.Error(fmt.Sprintf("The email server is not configured for %s", username))
+		return false, nil
+	}
+
+	auth, err := NewUpstreamAuth(smtpServerItem.AuthMechanisms, smtpServerItem.Server, username, password)
+	if err != nil {
+		return false, nil
+	}
+
+	err = smtpAuthProbe(smtpServerItem, auth)
+	if err != nil {
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) && protoErr.Code >= 500 {
+			slog.Error(fmt.Sprintf("Upstream %s rejected the credentials: %s", smtpServerItem.Server, err.Error()), "Username", username)
+			UpstreamAuthCacheIns.Delete(username)
+			return false, nil
+		}
+		slog.Error(fmt.Sprintf("Upstream %s authentication check failed: %s", smtpServerItem.Server, err.Error()), "Username", username)
+		return false, errUpstreamAuthUnavailable
+	}
+
+	UpstreamAuthCacheIns.Set(username, password, ttl)
+	slog.Info(fmt.Sprintf("Upstream %s accepted the credentials", smtpServerItem.Server), "Username", username)
+	return true, nil
+}
+
+// NewUpstreamAuth chooses the smtp.Auth for the mechanism configured on an emailServer entry.
+func NewUpstreamAuth(mechanisms, smtpServer, username, password string) (smtp.Auth, error) {
+	switch {
+	case strings.Contains(mechanisms, "CRAM-MD5"):
+		return smtp.CRAMMD5Auth(username, password), nil
+	case strings.Contains(mechanisms, "PLAIN"):
+		return smtp.PlainAuth("", username, password, smtpServer), nil
+	case strings.Contains(mechanisms, "LOGIN"):
+		return LoginAuth(username, password), nil
+	default:
+		info := fmt.Sprintf("unsupported authentication type: %s,  the email can not sent out", mechanisms)
+		slog.Error(info)
+		return nil, errors.New(info)
+	}
+}
+
+// smtpAuthProbe opens a session to the upstream server like a relay does, authenticates and quits without sending mail.
+func smtpAuthProbe(item EmailServerItem, a smtp.Auth) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	addrs, err := upstreamAddrs(ctx, item)
+	if err != nil {
+		return err
+	}
+	uc, err := dialUpstream(ctx, addrs, item, a)
+	if err != nil {
+		return err
+	}
+	uc.conn.SetDeadline(time.Now().Add(upstreamCommandTimeout))
+	return uc.client.Quit()
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+func TestUpstreamAuthCache(t *testing.T) {
+	cache := NewUpstreamAuthCache()
+	cache.Set("user@example.com", "secret", time.Hour)
+	if !cache.Valid("user@example.com", "secret") {
+		t.Error("verified password not valid")
+	}
+	if cache.Valid("user@example.com", "wrong") {
+		t.Error("wrong password valid")
+	}
+	if digest := cache.entries["user@example.com"].digest; digest == sha256.Sum256([]byte("secret")) {
+		t.Error("unkeyed digest stored")
+	}
+
+	cache.Set("user@example.com", "secret", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if cache.Valid("user@example.com", "secret") {
+		t.Error("expired entry valid")
+	}
+}
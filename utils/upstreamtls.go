@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// TLS modes of an emailServer entry. Whatever the mode, AUTH is refused over an unencrypted connection
+// unless allowInsecureAuth is set, so a server that stops offering STARTTLS never gets the credentials in clear.
+const (
+	UpstreamTLSNone     = "none"     // Plain text, even if the server offers STARTTLS
+	UpstreamTLSStartTLS = "starttls" // STARTTLS if the server offers it
+	UpstreamTLSRequired = "required" // STARTTLS, the connection fails if the server does not offer it
+	UpstreamTLSImplicit = "implicit" // TLS from the first byte (SMTPS, port 465)
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// compileTLS checks the TLS settings of the emailServer entry, fills in their defaults and builds the tls.Config
+// the server certificate is verified with: for item.Server, against caFile or the system CAs, and if pins are
+// configured, one of the certificates presented must match one of them.
+func (item *EmailServerItem) compileTLS(domain string) error {
+	var errs []error
+	switch item.TLS {
+	case "":
+		item.TLS = UpstreamTLSStartTLS
+	case UpstreamTLSStartTLS, UpstreamTLSRequired, UpstreamTLSImplicit:
+	case UpstreamTLSNone:
+		if !item.AllowInsecureAuth {
+			errs = append(errs, fmt.Errorf("emailServer.%s.tls: none would send the credentials in clear, which needs allowInsecureAuth", domain))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("emailServer.%s.tls: unknown mode %q (use none, starttls, required or implicit)", domain, item.TLS))
+	}
+
+	if item.TLSMinVersion == "" {
+		item.TLSMinVersion = "1.2"
+	}
+	minVersion, ok := tlsVersions[item.TLSMinVersion]
+	if !ok {
+		errs = append(errs, fmt.Errorf("emailServer.%s.tlsMinVersion: unknown version %q (use 1.0, 1.1, 1.2 or 1.3)", domain, item.TLSMinVersion))
+	}
+	config := &tls.Config{ServerName: item.Server, MinVersion: minVersion}
+
+	if item.CAFile != "" {
+		if pem, err := os.ReadFile(item.CAFile); err != nil {
+			errs = append(errs, fmt.Errorf("emailServer.%s.caFile: %w", domain, err))
+		} else {
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				errs = append(errs, fmt.Errorf("emailServer.%s.caFile: no PEM certificate found in %s", domain, item.CAFile))
+			}
+		}
+	}
+
+	var certPins, keyPins [][sha256.Size]byte
+	for _, pin := range item.PinnedCerts {
+		// openssl x509 -noout -fingerprint -sha256 prints the fingerprint with colons
+		digest, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(digest) != sha256.Size {
+			errs = append(errs, fmt.Errorf("emailServer.%s.pinnedCerts: %q is not a hex SHA-256 fingerprint", domain, pin))
+			continue
+		}
+		certPins = append(certPins, [sha256.Size]byte(digest))
+	}
+	for _, pin := range item.PinnedKeys {
+		// Also accepted in the sha256//<base64> form of curl --pinnedpubkey
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256//"))
+		if err != nil || len(digest) != sha256.Size {
+			errs = append(errs, fmt.Errorf("emailServer.%s.pinnedKeys: %q is not a base64 SHA-256 digest", domain, pin))
+			continue
+		}
+		keyPins = append(keyPins, [sha256.Size]byte(digest))
+	}
+	if len(certPins) > 0 || len(keyPins) > 0 {
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				if slices.Contains(certPins, sha256.Sum256(cert.Raw)) || slices.Contains(keyPins, sha256.Sum256(cert.RawSubjectPublicKeyInfo)) {
+					return nil
+				}
+			}
+			return fmt.Errorf("tls: the certificate of %s matches none of the pinned certificates and keys", cs.ServerName)
+		}
+	}
+
+	item.tlsConfig = config
+	return errors.Join(errs...)
+}
+
+// clientTLSConfig returns the tls.Config to connect to the email server with; the defaults for item.Server
+// if the entry was not compiled.
+func (item EmailServerItem) clientTLSConfig() *tls.Config {
+	if item.tlsConfig == nil {
+		return &tls.Config{ServerName: item.Server}
+	}
+	return item.tlsConfig
+}
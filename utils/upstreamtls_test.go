@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSignedCert returns a self-signed certificate for name.
+func selfSignedCert(t *testing.T, name string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// fingerprint formats the SHA-256 of the certificate the way openssl x509 -fingerprint does.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	var parts []string
+	for _, b := range sum {
+		parts = append(parts, strings.ToUpper(hex.EncodeToString([]byte{b})))
+	}
+	return strings.Join(parts, ":")
+}
+
+func keyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256//" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestUpstreamTLSPins(t *testing.T) {
+	cert := selfSignedCert(t, "smtp.example.com")
+	other := selfSignedCert(t, "smtp.example.com")
+	state := tls.ConnectionState{ServerName: "smtp.example.com", PeerCertificates: []*x509.Certificate{cert}}
+
+	tests := []struct {
+		name  string
+		certs []string
+		keys  []string
+		match bool
+	}{
+		{"certificate", []string{fingerprint(other), fingerprint(cert)}, nil, true},
+		{"key", nil, []string{keyPin(cert)}, true},
+		{"either", []string{fingerprint(other)}, []string{keyPin(cert)}, true},
+		{"other certificate", []string{fingerprint(other)}, nil, false},
+		{"other key", nil, []string{keyPin(other)}, false},
+	}
+	for _, tt := range tests {
+		item := EmailServerItem{Server: "smtp.example.com", PinnedCerts: tt.certs, PinnedKeys: tt.keys}
+		if err := item.compileTLS("example.com"); err != nil {
+			t.Fatalf("%s: compileTLS() = %v", tt.name, err)
+		}
+		err := item.clientTLSConfig().VerifyConnection(state)
+		if tt.match && err != nil {
+			t.Errorf("%s: VerifyConnection() = %v, want the pin to match", tt.name, err)
+		} else if !tt.match && err == nil {
+			t.Errorf("%s: VerifyConnection() accepted a certificate matching no pin", tt.name)
+		}
+	}
+
+	// Pins that are not SHA-256 digests are configuration errors.
+	item := EmailServerItem{Server: "smtp.example.com", PinnedCerts: []string{"AB:CD"}, PinnedKeys: []string{"sha256//not base64"}}
+	err := item.compileTLS("example.com")
+	if err == nil || !strings.Contains(err.Error(), "pinnedCerts") || !strings.Contains(err.Error(), "pinnedKeys") {
+		t.Errorf("compileTLS() = %v, want both pins refused", err)
+	}
+
+	// Without pins only the usual verification applies.
+	item = EmailServerItem{Server: "smtp.example.com"}
+	if err := item.compileTLS("example.com"); err != nil || item.clientTLSConfig().VerifyConnection != nil {
+		t.Errorf("compileTLS() = %v, want no pin check", err)
+	}
+}
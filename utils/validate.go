@@ -1,26 +1,41 @@
 package utils
 
 import (
-	"errors"
 	"fmt"
 	"log/slog"
 	"strings"
+	"time"
+
+	"github.com/naive9527/mitmsmtpd/smtpd"
+
+	"github.com/emersion/go-message"
 )
 
-// ValidateEmail performs comprehensive validation based on verification rules
+// ValidateEmail holds what the rules are evaluated against.
+// Header, Subject, Size and the part sizes are filled in while the email is parsed.
 
 type ValidateEmail struct {
+	cfg                 *Config // Configuration snapshot the email is validated against
 	clientIP            string
+	listener            string // Name of the listener the email was received on
+	AuthUser            string
 	Sender              string
 	Recipient           []string
+	Header              message.Header
+	Subject             string
+	Size                int64
 	BodySize            int64
 	AttachmentSize      int64
 	EmbeddedContentSize int64
+	EmbeddedContents    int // Number of embedded parts, which may be empty
+	Attachments         []Attachment
 }
 
-func NewValidateEmail(clientIP, sender string, recipient []string, bodySize, attachmentSize, embeddedContentSize int64) *ValidateEmail {
+func NewValidateEmail(clientIP, authUser, sender string, recipient []string, bodySize, attachmentSize, embeddedContentSize int64) *ValidateEmail {
 	email := new(ValidateEmail)
+	email.cfg = Cfg()
 	email.clientIP = strings.TrimSpace(clientIP)
+	email.AuthUser = authUser
 	email.Sender = strings.TrimSpace(sender)
 	email.Recipient = recipient
 	email.BodySize = bodySize
@@ -29,87 +44,123 @@ func NewValidateEmail(clientIP, sender string, recipient []string, bodySize, att
 	return email
 }
 
-func (email *ValidateEmail) ValidateEmailSender() error {
-	if !CFG.VerificationRules.SenderRegexp.MatchString(email.Sender) {
-		info := fmt.Sprintf("Invalid email sender: %s", email.Sender)
-		slog.Error(info)
-		return errors.New(info)
+// ValidateSenderIdentity checks the MAIL FROM address against the user that authenticated on the session,
+// according to smtpdAuth.senderPolicy and smtpdAuth.senderAliases.
+func (email *ValidateEmail) ValidateSenderIdentity(authUser string) error {
+	if SenderAllowedFor(authUser, email.Sender) {
+		return nil
 	}
-	return nil
+	reply := smtpd.NewReply(553, "5.7.1", fmt.Sprintf("Sender address <%s> is not owned by user %s", email.Sender, authUser))
+	slog.Error(reply.Error())
+	return reply
 }
 
-func (email *ValidateEmail) ValidateEmailRecipient() error {
-	for _, recipient := range email.Recipient {
-		recipient = strings.TrimSpace(recipient)
-		if !CFG.VerificationRules.RecipientRegexp.MatchString(recipient) {
-			info := fmt.Sprintf("Invalid email recipient: %v", email.Recipient)
-			slog.Error(info)
-			return errors.New(info)
+// SenderAllowedFor reports whether authUser may use sender as MAIL FROM address.
+func SenderAllowedFor(authUser, sender string) bool {
+	cfg := Cfg()
+	sender = strings.ToLower(sender)
+	for _, alias := range cfg.SmtpdAuth.SenderAliases[authUser] {
+		alias = strings.ToLower(alias)
+		if alias == sender || (strings.HasPrefix(alias, "@") && strings.HasSuffix(sender, alias)) {
+			return true
 		}
 	}
-	return nil
-}
 
-func (email *ValidateEmail) ValidateEmailClientIP() error {
-	if !CFG.VerificationRules.SenderIPRegexp.MatchString(email.clientIP) {
-		info := fmt.Sprintf("Invalid email clientIP: %s", email.clientIP)
-		slog.Error(info)
-		return errors.New(info)
+	user := strings.ToLower(authUser)
+	switch cfg.SmtpdAuth.SenderPolicy {
+	case "any":
+		return true
+	case "domain":
+		at := strings.LastIndex(user, "@")
+		return at >= 0 && strings.HasSuffix(sender, user[at:])
+	default: // "exact"
+		return sender == user
 	}
-	return nil
 }
 
-func (email *ValidateEmail) ValidateBodySize() error {
-	// Check Email BodySize
-	slog.Info(fmt.Sprintf("Mail Body Size %d bytes", email.BodySize))
-	if CFG.VerificationRules.EmailBodySize == 0 {
-		return nil
-	}
+// ApplyRules evaluates the rules in order and returns the verdict. Without a deciding rule the email is accepted.
+// A rule with a recipient condition is evaluated for every recipient and fires if it fires for any of them.
+func (email *ValidateEmail) ApplyRules(now time.Time) *Verdict {
+	verdict := &Verdict{Action: ActionAccept}
+	for i := range email.cfg.rules {
+		rule := &email.cfg.rules[i]
+		recipient, ok := email.firingRecipient(rule, now)
+		if !ok {
+			continue
+		}
 
-	if email.BodySize <= int64(CFG.VerificationRules.EmailBodySize) {
-		return nil
-	} else {
-		info := fmt.Sprintf("Email body size is too large: %d Bytes", email.BodySize)
-		slog.Error(info)
-		return errors.New(info)
+		slog.Info("Rule matched", "Rule", rule.Name, "Action", rule.Action, "AuthUser", email.AuthUser, "From", email.Sender, "Recipient", recipient)
+		text := rule.Message
+		if text == "" {
+			text = fmt.Sprintf("rule %s (%s) matched", rule.Name, rule.Action)
+		}
+		if rule.Notify || rule.Action == ActionNotify {
+			verdict.Notify = append(verdict.Notify, fmt.Sprintf("%s: %s, from %s(%s)", rule.Name, text, email.Sender, email.clientIP))
+		}
+
+		switch rule.Action {
+		case ActionTag:
+			verdict.Headers = append(verdict.Headers, rule.Header)
+		case ActionReroute:
+			verdict.Route = rule.Route
+		case ActionNotify:
+		case ActionReject:
+			if recipient != "" {
+				text = fmt.Sprintf("%s: %s", recipient, text)
+			}
+			verdict.Reply = smtpd.NewReply(rule.Code, rule.EnhancedCode, text)
+			fallthrough
+		default: // accept, quarantine
+			verdict.Action, verdict.Rule = rule.Action, rule.Name
+			return verdict
+		}
 	}
+	return verdict
 }
-func (email *ValidateEmail) ValidateAttachments() error {
-	// Check Email attachments
-	info := ""
-	if email.AttachmentSize == 0 {
-		return nil
-	}
-	slog.Info(fmt.Sprintf("Mail Attachments Size %d bytes", email.AttachmentSize))
-	if CFG.VerificationRules.Attachment.Allowed {
-		if CFG.VerificationRules.Attachment.MaxSize == 0 || email.AttachmentSize <= int64(CFG.VerificationRules.Attachment.MaxSize) {
+
+// EnvelopeVerdict evaluates the rules at MAIL time (recipient is empty) or RCPT time (for one recipient),
+// before the message is transferred. Rules that depend on the content (or, at MAIL time, on the recipients)
+// cannot be evaluated yet: such reject rules are skipped, since they can only refuse the email as well,
+// and such accept or quarantine rules end the evaluation, since they might let the email through.
+// It returns nil if no rule decided. tag, reroute and notify rules are left for ApplyRules after DATA.
+func (email *ValidateEmail) EnvelopeVerdict(recipient string, now time.Time) *Verdict {
+	for i := range email.cfg.rules {
+		rule := &email.cfg.rules[i]
+		if !rule.terminal() {
+			continue
+		}
+		if !rule.envelopeOnly() || (recipient == "" && rule.perRecipient()) {
+			if rule.Action == ActionReject {
+				continue
+			}
 			return nil
-		} else {
-			info = fmt.Sprintf("Email attachment size is too large: %d Bytes", email.AttachmentSize)
 		}
-	} else {
-		info = "Attachments are not allowed to be sent."
+		if !rule.matches(email, recipient, now) {
+			continue
+		}
+
+		verdict := &Verdict{Action: rule.Action, Rule: rule.Name}
+		if rule.Action == ActionReject {
+			verdict.Reply = smtpd.NewReply(rule.Code, rule.EnhancedCode, rule.Message)
+			if rule.Notify {
+				verdict.Notify = append(verdict.Notify, fmt.Sprintf("%s: %s, from %s(%s) to %s", rule.Name, rule.Message, email.Sender, email.clientIP, recipient))
+			}
+		}
+		return verdict
 	}
-	slog.Error(info)
-	return errors.New(info)
+	return nil
 }
 
-func (email *ValidateEmail) ValidateEmbeddedContent() error {
-	// Check Email Embedded Content
-	info := ""
-	if email.EmbeddedContentSize == 0 {
-		return nil
+// firingRecipient reports whether the rule fires and, for per-recipient rules, for which recipient.
+func (email *ValidateEmail) firingRecipient(rule *Rule, now time.Time) (string, bool) {
+	if !rule.perRecipient() {
+		return "", rule.matches(email, "", now)
 	}
-	slog.Info(fmt.Sprintf("Mail Embedded Content Size %d bytes", email.EmbeddedContentSize))
-	if CFG.VerificationRules.EmbeddedContent.Allowed {
-		if CFG.VerificationRules.EmbeddedContent.MaxSize == 0 || email.EmbeddedContentSize <= int64(CFG.VerificationRules.EmbeddedContent.MaxSize) {
-			return nil
-		} else {
-			info = fmt.Sprintf("Email embedded content size is too large: %d Bytes", email.EmbeddedContentSize)
+	for _, recipient := range email.Recipient {
+		recipient = strings.TrimSpace(recipient)
+		if rule.matches(email, recipient, now) {
+			return recipient, true
 		}
-	} else {
-		info = "embedded content are not allowed to be sent."
 	}
-	slog.Error(info)
-	return errors.New(info)
+	return "", false
 }